@@ -1,28 +1,75 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/jgivc/fetchtracker/internal/app"
+	"github.com/jgivc/fetchtracker/internal/entity"
 )
 
+const usage = `Usage: %s [-c config.yml] [command]
+
+Commands:
+  serve               Start the server (default)
+  index [-dry-run]    Run the index process once and print the report
+  rollback            Make the previous index version active again
+  migrate-keys        Move the Redis keys written without a prefix under redis_prefix
+  link [-ttl 24h] [-ip addr] <file_id>
+                      Print a signed download link to the file
+  hash-password       Read a password from stdin and print its hash for the access frontmatter
+`
+
 func main() {
 	cfgFileName := flag.String("c", "config.yml", "Path to config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	app := app.New(*cfgFileName)
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve(app)
+	case "index":
+		index(app, flag.Args()[1:])
+	case "rollback":
+		if !app.RunRollback() {
+			os.Exit(1)
+		}
+	case "link":
+		signLink(app, flag.Args()[1:])
+	case "hash-password":
+		hashPassword()
+	case "migrate-keys":
+		if !app.RunMigrateKeys() {
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func serve(app *app.App) {
 	go app.Start()
 
 	c := make(chan os.Signal, 1)
 	defer close(c)
 	done := make(chan struct{})
 
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 	go func() {
 		defer close(done)
 
@@ -32,6 +79,8 @@ func main() {
 				go app.Index()
 			case syscall.SIGUSR2:
 				go app.Dump()
+			case syscall.SIGHUP:
+				go app.ReloadFilter()
 			case syscall.SIGTERM, syscall.SIGINT:
 				fmt.Println("Received termination signal. Shutting down...")
 				done <- struct{}{}
@@ -46,3 +95,52 @@ func main() {
 	time.Sleep(2 * time.Second)
 	fmt.Println("done")
 }
+
+func index(app *app.App, args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show the changes against the active version without saving anything")
+	fs.Parse(args)
+
+	if !app.RunIndex(entity.IndexOptions{DryRun: *dryRun}) {
+		os.Exit(1)
+	}
+}
+
+func signLink(app *app.App, args []string) {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 0, "How long the link is valid, links.ttl by default")
+	ip := fs.String("ip", "", "Bind the link to the client address")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "File ID is required")
+		os.Exit(2)
+	}
+
+	if !app.RunLink(fs.Arg(0), *ip, *ttl) {
+		os.Exit(1)
+	}
+}
+
+func hashPassword() {
+	// The password is read from stdin to keep it out of the shell history
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintf(os.Stderr, "Cannot read password: %s\n", err)
+		os.Exit(1)
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Password is required")
+		os.Exit(2)
+	}
+
+	hash, err := entity.HashPassword(password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot hash password: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(hash)
+}
@@ -2,6 +2,8 @@ package fsadapter
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"io"
@@ -16,6 +18,7 @@ import (
 	_ "embed"
 
 	"github.com/jgivc/fetchtracker/internal/adapter/fsadapter/mdadapter"
+	"github.com/jgivc/fetchtracker/internal/common"
 	"github.com/jgivc/fetchtracker/internal/config"
 	"github.com/jgivc/fetchtracker/internal/entity"
 	"github.com/jgivc/fetchtracker/internal/util"
@@ -32,12 +35,12 @@ const (
 	ParseModeMdCustomTemplate
 	ParseModeMdDefaultTemplate
 
-	maxFiles              = 100
 	mimeTypeUnknown       = "application/octet-stream"
 	mimeTypeCheckPartSize = 512
 
 	templateNameFile  = "FILE"
 	templateNameFiles = "FILES"
+	templateNamePager = "PAGER"
 
 	funcNameFile  = "file"
 	funcNameFiles = "files"
@@ -55,11 +58,21 @@ var (
 
 	//go:embed templates/index.html
 	defaultIndexContent []byte
+
+	//go:embed templates/category.html
+	defaultCategoryContent []byte
 )
 
 type PageContextIndex struct {
 	URL string
 	*entity.Download
+	Files []*entity.File // Files of the current page
+	Pager *entity.Pager  // nil if the file list is not paginated
+}
+
+type PageContextCategory struct {
+	URL string
+	*entity.Category
 }
 
 type PageContext struct {
@@ -67,13 +80,20 @@ type PageContext struct {
 	ContentHTML template.HTML
 	*entity.Download
 	Frontmatter *Frontmatter
+	Pager       *entity.Pager // nil if the file list is not paginated
 }
 
 type Frontmatter struct {
-	Title   string            `yaml:"title"`
-	Enabled *bool             `yaml:"enabled"`
-	Files   map[string]string `yaml:"files"`
-	Author  string            `yaml:"author"`
+	Title    string                 `yaml:"title"`
+	Enabled  *bool                  `yaml:"enabled"`
+	Files    map[string]string      `yaml:"files"`
+	Author   string                 `yaml:"author"`
+	Counting *entity.CountingPolicy `yaml:"counting"` // Overrides the global counting policy
+	Access   *entity.Access         `yaml:"access"`   // Restricts the download to the password or token holders
+	// The publish window of the download and of its files by the name, checked on every request
+	PublishAt time.Time                  `yaml:"publish_at"`
+	ExpiresAt time.Time                  `yaml:"expires_at"`
+	Schedule  map[string]entity.Schedule `yaml:"schedule"`
 }
 
 func (f *Frontmatter) IsEnabled() bool {
@@ -83,11 +103,15 @@ func (f *Frontmatter) IsEnabled() bool {
 	return *f.Enabled
 }
 
+// pageRenderer renders the download page with the files of the page, pager is nil if the file list is not paginated.
+type pageRenderer func(files []*entity.File, pager *entity.Pager) (string, error)
+
 type fsAdapter struct {
-	fs        afero.Fs
-	cfg       *config.FSAdapterConfig
-	skipFiles map[string]struct{}
-	md        goldmark.Markdown
+	fs            afero.Fs
+	cfg           *config.FSAdapterConfig
+	skipFiles     map[string]struct{}
+	md            goldmark.Markdown
+	templatesHash []byte // Hash of the built-in templates, a part of every fingerprint
 
 	log *slog.Logger
 }
@@ -115,12 +139,17 @@ func NewFSAdapterWithFS(fs afero.Fs, cfg *config.FSAdapterConfig, log *slog.Logg
 		),
 	)
 
+	hasher := sha1.New()
+	hasher.Write(defaultTemplateContent)
+	hasher.Write(defaultIndexContent)
+
 	fsa := &fsAdapter{
-		fs:        fs,
-		cfg:       cfg,
-		skipFiles: skipFilesMap,
-		md:        md,
-		log:       log,
+		fs:            fs,
+		cfg:           cfg,
+		skipFiles:     skipFilesMap,
+		md:            md,
+		templatesHash: hasher.Sum(nil),
+		log:           log,
 	}
 
 	return fsa, nil
@@ -137,13 +166,15 @@ func (a *fsAdapter) ToDownload(folderPath string) (*entity.Download, error) {
 		return nil, fmt.Errorf("invalid folder path")
 	}
 
-	files, err := a.readFiles(folderPath)
+	limits := a.cfg.FolderLimits(folderPath)
+
+	files, total, err := a.readFiles(folderPath, limits.MaxFiles)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get folder files: %w", err)
 	}
 
 	if len(files) < 1 {
-		return nil, fmt.Errorf("folder have no files")
+		return nil, common.ErrFolderHasNoFilesError
 	}
 
 	download := &entity.Download{
@@ -153,6 +184,11 @@ func (a *fsAdapter) ToDownload(folderPath string) (*entity.Download, error) {
 		SourcePath: folderPath,
 		CreatedAt:  time.Now(),
 		Files:      files,
+		TotalFiles: total,
+	}
+
+	if limits.PageSize > 0 && len(files) > limits.PageSize {
+		download.PageSize = limits.PageSize
 	}
 
 	switch a.getParseMode(folderPath) {
@@ -169,24 +205,139 @@ func (a *fsAdapter) ToDownload(folderPath string) (*entity.Download, error) {
 	return download, nil
 }
 
-func (a *fsAdapter) parseIndex(folderPath string, download *entity.Download) error {
-	tmpl, err := a.getTemplate(filepath.Join(folderPath, a.cfg.IndexPageFileName), defaultIndexContent, nil, download.Files)
+/*
+Fingerprint returns a hash of everything the download page depends on: names, sizes and modification times
+of the files, the content of the index, description and template files, the built-in templates and the settings.
+If the fingerprint has not changed, the page does not need to be rendered again.
+*/
+func (a *fsAdapter) Fingerprint(folderPath string) (string, error) {
+	entries, err := afero.ReadDir(a.fs, folderPath)
 	if err != nil {
-		return fmt.Errorf("cannot get index template: %w", err)
+		return "", fmt.Errorf("cannot read folder: %w", err)
+	}
+
+	limits := a.cfg.FolderLimits(folderPath)
+
+	hasher := sha1.New()
+	hasher.Write(a.templatesHash)
+	fmt.Fprintf(hasher, "%s\n%d\n%d\n", a.cfg.URL, limits.MaxFiles, limits.PageSize)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		switch entry.Name() {
+		case a.cfg.IndexPageFileName, a.cfg.DescFileName, a.cfg.TemplateFileName:
+			content, err := afero.ReadFile(a.fs, filepath.Join(folderPath, entry.Name()))
+			if err != nil {
+				return "", fmt.Errorf("cannot read file %s: %w", entry.Name(), err)
+			}
+
+			fmt.Fprintf(hasher, "%s\n", entry.Name())
+			hasher.Write(content)
+
+			continue
+		}
+
+		if _, exists := a.skipFiles[entry.Name()]; exists {
+			continue
+		}
+
+		fmt.Fprintf(hasher, "%s\n%d\n%d\n", entry.Name(), entry.Size(), entry.ModTime().UnixNano())
 	}
 
-	content, err := buildTemplate(tmpl, &PageContextIndex{URL: a.cfg.URL, Download: download})
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ToCategory builds the listing page of a folder that contains nested distributions.
+func (a *fsAdapter) ToCategory(folderPath string, items []*entity.CategoryItem) (*entity.Category, error) {
+	if strings.Contains(folderPath, "..") {
+		return nil, fmt.Errorf("invalid folder path")
+	}
+
+	if len(items) < 1 {
+		return nil, fmt.Errorf("category have no items")
+	}
+
+	category := &entity.Category{
+		ID:         util.GetIDFromString(&folderPath),
+		Title:      filepath.Base(folderPath),
+		SourcePath: folderPath,
+		CreatedAt:  time.Now(),
+		Items:      items,
+	}
+
+	tmpl, err := a.getTemplate("", defaultCategoryContent, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get category template: %w", err)
+	}
+
+	content, err := buildTemplate(tmpl, &PageContextCategory{URL: a.cfg.URL, Category: category})
 	if err != nil {
-		return fmt.Errorf("cannot build index template: %w", err)
+		return nil, fmt.Errorf("cannot build category template: %w", err)
+	}
+
+	category.PageContent = content
+	category.PageHash = util.GetIDFromString(&content)
+
+	return category, nil
+}
+
+func (a *fsAdapter) parseIndex(folderPath string, download *entity.Download) error {
+	return a.renderPages(download, func(files []*entity.File, pager *entity.Pager) (string, error) {
+		tmpl, err := a.getTemplate(filepath.Join(folderPath, a.cfg.IndexPageFileName), defaultIndexContent, nil, files)
+		if err != nil {
+			return "", fmt.Errorf("cannot get index template: %w", err)
+		}
+
+		content, err := buildTemplate(tmpl, &PageContextIndex{URL: a.cfg.URL, Download: download, Files: files, Pager: pager})
+		if err != nil {
+			return "", fmt.Errorf("cannot build index template: %w", err)
+		}
+
+		return content, nil
+	})
+}
+
+// setSchedule stores the publish windows of the frontmatter with the access restriction of the download.
+func setSchedule(fm *Frontmatter, download *entity.Download) error {
+	schedule := entity.Schedule{PublishAt: fm.PublishAt, ExpiresAt: fm.ExpiresAt}
+	if schedule.IsEmpty() && len(fm.Schedule) < 1 {
+		return nil
+	}
+
+	if err := schedule.Validate(); err != nil {
+		return fmt.Errorf("invalid schedule: %w", err)
+	}
+
+	names := make(map[string]struct{}, len(download.Files))
+	for _, file := range download.Files {
+		names[file.Name] = struct{}{}
 	}
 
-	download.PageContent = content
-	download.PageHash = util.GetIDFromString(&content)
+	for name, fileSchedule := range fm.Schedule {
+		if _, exists := names[name]; !exists {
+			return fmt.Errorf("schedule of %s: %w", name, common.ErrBrokenFileReferenceError)
+		}
+
+		if err := fileSchedule.Validate(); err != nil {
+			return fmt.Errorf("invalid schedule of %s: %w", name, err)
+		}
+	}
+
+	if download.Access == nil {
+		download.Access = &entity.Access{}
+	}
+
+	download.Access.Schedule = schedule
+	download.Access.Files = fm.Schedule
 
 	return nil
 }
 
 func (a *fsAdapter) parseMarkdown(folderPath string, download *entity.Download) error {
+	now := time.Now()
 	mdFileName := filepath.Join(folderPath, a.cfg.DescFileName)
 
 	fm, mdData, err := a.getFrontmatter(mdFileName)
@@ -196,12 +347,31 @@ func (a *fsAdapter) parseMarkdown(folderPath string, download *entity.Download)
 
 	if fm != nil {
 		download.Title = fm.Title
+		// A disabled download is rendered as a draft, the indexer gives it a preview token
 		download.Enabled = fm.IsEnabled()
 
-		if !download.Enabled {
-			return fmt.Errorf("folder %s is disabled by frontmatter variable", folderPath)
+		if fm.Counting != nil {
+			if err := fm.Counting.Validate(); err != nil {
+				return fmt.Errorf("invalid counting policy: %w", err)
+			}
+
+			download.Counting = fm.Counting
+		}
+
+		if fm.Access != nil {
+			if err := fm.Access.Validate(); err != nil {
+				return fmt.Errorf("invalid access: %w", err)
+			}
+
+			download.Access = fm.Access
+		}
+
+		if err := setSchedule(fm, download); err != nil {
+			return err
 		}
 
+		download.Hidden = download.Access.HiddenFiles(now)
+
 		if len(fm.Files) > 0 {
 			for i := range download.Files {
 				if fileDesc, exists := fm.Files[download.Files[i].Name]; exists {
@@ -219,37 +389,107 @@ func (a *fsAdapter) parseMarkdown(folderPath string, download *entity.Download)
 
 	// Get templateResolver
 	tResolver, err := newTemplateResolver(tmpl)
-	if err != nil {
+	if err != nil || tResolver.pagerTemplate == nil {
 		// Since it is not known which template was loaded, the user's or ours,
-		// we explicitly load our template to search for predefined templates FILE and FILES
-		ftmpl, err := a.getTemplate("", defaultTemplateContent, nil, nil)
-		if err != nil {
-			return fmt.Errorf("cannot get own template: %w", err)
+		// we explicitly load our template to search for predefined templates FILE, FILES and PAGER
+		ftmpl, err2 := a.getTemplate("", defaultTemplateContent, nil, nil)
+		if err2 != nil {
+			return fmt.Errorf("cannot get own template: %w", err2)
 		}
 
-		tResolver, err = newTemplateResolver(ftmpl)
 		if err != nil {
-			return fmt.Errorf("cannot get template: %w", err)
+			tResolver, err = newTemplateResolver(ftmpl)
+			if err != nil {
+				return fmt.Errorf("cannot get template: %w: %w", common.ErrTemplateError, err)
+			}
+		} else {
+			tResolver.pagerTemplate = ftmpl.Lookup(templateNamePager)
 		}
 	}
 
-	pc := parser.NewContext()
-	pc.Set(mdadapter.TemplateResolverKey, tResolver)
-	pc.Set(mdadapter.FileResolverKey, newFileResolver(download.Files))
+	render := func(hidden []string) pageRenderer {
+		return func(files []*entity.File, pager *entity.Pager) (string, error) {
+			pc := parser.NewContext()
+			pc.Set(mdadapter.TemplateResolverKey, tResolver)
+			pc.Set(mdadapter.FileResolverKey, newFileResolver(download.Files, files, pager, hidden))
+
+			// Convert markdown to html
+			var buf bytes.Buffer
+			if err := a.md.Convert(mdData, &buf, parser.WithContext(pc)); err != nil {
+				return "", fmt.Errorf("cannot convert markdown: %w: %w", common.ErrTemplateError, err)
+			}
+
+			// Convert entire page
+			content, err := buildTemplateHTML(tmpl, &PageContext{URL: a.cfg.URL, ContentHTML: template.HTML(buf.String()), Download: download, Frontmatter: fm, Pager: pager})
+			if err != nil {
+				return "", fmt.Errorf("cannot build page: %w", err)
+			}
 
-	// Convert markdown to html
-	var buf bytes.Buffer
-	if err := a.md.Convert(mdData, &buf, parser.WithContext(pc)); err != nil {
-		return fmt.Errorf("cannot convert markdown: %w", err)
+			return string(content), nil
+		}
 	}
 
-	// Convert entire page
-	content, err := buildTemplateHTML(tmpl, &PageContext{URL: a.cfg.URL, ContentHTML: template.HTML(buf.String()), Download: download, Frontmatter: fm})
-	if err != nil {
-		return fmt.Errorf("cannot build page: %w", err)
+	if err := a.renderPages(download, render(download.Hidden)); err != nil {
+		return err
 	}
 
-	download.PageContent = string(content)
+	return a.renderVariants(download, now, render)
+}
+
+/*
+renderVariants renders the download pages once more for every time a file window opens or closes after now,
+so the page served at the request time lists only the files available then, without a re-index.
+*/
+func (a *fsAdapter) renderVariants(download *entity.Download, now time.Time, render func(hidden []string) pageRenderer) error {
+	for _, at := range download.Access.FileChanges(now) {
+		variant := *download
+		if err := a.renderPages(&variant, render(download.Access.HiddenFiles(at))); err != nil {
+			return fmt.Errorf("cannot render page at %s: %w", at.Format(time.RFC3339), err)
+		}
+
+		pages := variant.Pages
+		if download.PageSize < 1 {
+			pages = []string{variant.PageContent}
+		}
+
+		download.Variants = append(download.Variants, &entity.PageVariant{From: at, Pages: pages})
+	}
+
+	return nil
+}
+
+/*
+renderPages renders the download page. If the file list is paginated, then render is called for every page
+with the files of that page.
+*/
+func (a *fsAdapter) renderPages(download *entity.Download, render pageRenderer) error {
+	if download.PageSize < 1 {
+		content, err := render(download.Files, nil)
+		if err != nil {
+			return err
+		}
+
+		download.PageContent = content
+		download.PageHash = util.GetIDFromString(&download.PageContent)
+
+		return nil
+	}
+
+	pageCount := entity.PageCount(download.PageSize, len(download.Files))
+	download.Pages = make([]string, 0, pageCount)
+	for page := 1; page <= pageCount; page++ {
+		pager := entity.NewPager(page, download.PageSize, len(download.Files))
+		start, end := pager.Bounds()
+
+		content, err := render(download.Files[start:end], pager)
+		if err != nil {
+			return fmt.Errorf("cannot render page %d: %w", page, err)
+		}
+
+		download.Pages = append(download.Pages, content)
+	}
+
+	download.PageContent = download.Pages[0]
 	download.PageHash = util.GetIDFromString(&download.PageContent)
 
 	return nil
@@ -335,7 +575,7 @@ func (a *fsAdapter) getTemplate(templateFileName string, defaultTemplateContent
 
 				file, exists := filesMap[fileName]
 				if !exists {
-					return "", fmt.Errorf("cannot find file: %s", fileName)
+					return "", fmt.Errorf("%w: %s", common.ErrBrokenFileReferenceError, fileName)
 				}
 
 				if len(args) > 0 {
@@ -365,19 +605,25 @@ func (a *fsAdapter) getTemplate(templateFileName string, defaultTemplateContent
 
 	tmpl, err = tmpl.Parse(string(content))
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse template content: %w", err)
+		return nil, fmt.Errorf("cannot parse template content: %w: %w", common.ErrTemplateError, err)
 	}
 
 	return tmpl, nil
 }
 
-func (a *fsAdapter) readFiles(folderPath string) ([]*entity.File, error) {
+/*
+readFiles returns up to maxFiles files of the folder and the total number of files found.
+*/
+func (a *fsAdapter) readFiles(folderPath string, maxFiles int) ([]*entity.File, int, error) {
 	entries, err := afero.ReadDir(a.fs, folderPath)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	var files []*entity.File
+	var (
+		files []*entity.File
+		total int
+	)
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			fDesc := &entity.File{
@@ -385,6 +631,7 @@ func (a *fsAdapter) readFiles(folderPath string) ([]*entity.File, error) {
 				SourcePath: filepath.Join(folderPath, entry.Name()),
 			}
 
+			// The redirect header is built from the URL by the offload profile when the file is sent
 			fDesc.URL = filepath.Join("/", filepath.Base(a.cfg.WorkDir), strings.Replace(fDesc.SourcePath, a.cfg.WorkDir, "/", 1))
 
 			if _, exists := a.skipFiles[fDesc.Name]; exists {
@@ -393,6 +640,11 @@ func (a *fsAdapter) readFiles(folderPath string) ([]*entity.File, error) {
 				continue
 			}
 
+			total++
+			if len(files) >= maxFiles {
+				continue
+			}
+
 			fDesc.ID = util.GetIDFromString(&fDesc.SourcePath)
 
 			stat, err := a.fs.Stat(fDesc.SourcePath)
@@ -411,20 +663,20 @@ func (a *fsAdapter) readFiles(folderPath string) ([]*entity.File, error) {
 
 			files = append(files, fDesc)
 		}
+	}
 
-		if len(files) >= maxFiles {
-			break
-		}
+	if total > len(files) {
+		a.log.Warn("Folder files truncated", slog.String("path", folderPath), slog.Int("limit", maxFiles), slog.Int("total", total))
 	}
 
-	return files, nil
+	return files, total, nil
 }
 
 func buildTemplate(tmpl *template.Template, data any) (string, error) {
 	buf := bytes.Buffer{}
 
 	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("cannot execute template: %w", err)
+		return "", fmt.Errorf("cannot execute template: %w: %w", common.ErrTemplateError, err)
 	}
 
 	return buf.String(), nil
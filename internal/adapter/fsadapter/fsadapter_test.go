@@ -2,13 +2,17 @@ package fsadapter
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/jgivc/fetchtracker/internal/common"
 	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
@@ -28,6 +32,7 @@ func TestFCAdapter(t *testing.T) {
 		workDir            string
 		files              map[string]string
 		expectError        bool
+		expectedErr        error
 		expectedGoldenFile string
 		logEnabled         bool
 	}{
@@ -42,6 +47,7 @@ func TestFCAdapter(t *testing.T) {
 				cfg.IndexPageFileName: "",
 			},
 			expectError: true,
+			expectedErr: common.ErrFolderHasNoFilesError,
 		},
 		{
 			name:    "Scenario 3: Empty folder with description file",
@@ -51,6 +57,7 @@ func TestFCAdapter(t *testing.T) {
 						Test test test`,
 			},
 			expectError: true,
+			expectedErr: common.ErrFolderHasNoFilesError,
 		},
 		{
 			name:    "Scenario 4: Default index",
@@ -166,6 +173,106 @@ Here is one file [[test10.txt]]
 			},
 			expectedGoldenFile: "scenario8.golden.html",
 		},
+		{
+			name:    "Scenario 9: Disabled by frontmatter is rendered as a draft",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt": "test1 content",
+				cfg.DescFileName: `---
+enabled: false
+---
+# Title`,
+			},
+			expectedGoldenFile: "scenario9.golden.html",
+		},
+		{
+			name:    "Scenario 10: Broken file reference",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt":      "test1 content",
+				cfg.DescFileName: "# Title\n\n[[test2.txt]]\n",
+			},
+			expectError: true,
+			expectedErr: common.ErrBrokenFileReferenceError,
+		},
+		{
+			name:    "Scenario 11: Template error",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt":           "test1 content",
+				cfg.IndexPageFileName: "<html>{{ .Title </html>",
+			},
+			expectError: true,
+			expectedErr: common.ErrTemplateError,
+		},
+		{
+			name:    "Scenario 12: Unknown counting mode",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt": "test1 content",
+				cfg.DescFileName: `---
+counting:
+  mode: sometimes
+---
+# Title`,
+			},
+			expectError: true,
+		},
+		{
+			name:    "Scenario 13: Plain text password",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt": "test1 content",
+				cfg.DescFileName: `---
+access:
+  password: secret
+---
+# Title`,
+			},
+			expectError: true,
+		},
+		{
+			name:    "Scenario 14: Invalid access cidr",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt": "test1 content",
+				cfg.DescFileName: `---
+access:
+  allow:
+  - 10.0.0.0/33
+---
+# Title`,
+			},
+			expectError: true,
+		},
+		{
+			name:    "Scenario 15: Schedule of a missing file",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt": "test1 content",
+				cfg.DescFileName: `---
+schedule:
+  test2.txt:
+    publish_at: 2030-01-01T00:00:00Z
+---
+# Title`,
+			},
+			expectError: true,
+			expectedErr: common.ErrBrokenFileReferenceError,
+		},
+		{
+			name:    "Scenario 16: Expires before publish",
+			workDir: "one",
+			files: map[string]string{
+				"test1.txt": "test1 content",
+				cfg.DescFileName: `---
+publish_at: 2030-01-01T00:00:00Z
+expires_at: 2029-01-01T00:00:00Z
+---
+# Title`,
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -196,6 +303,9 @@ Here is one file [[test10.txt]]
 			download, err := adapter.ToDownload(workdir)
 			if tc.expectError {
 				require.Error(t, err)
+				if tc.expectedErr != nil {
+					require.ErrorIs(t, err, tc.expectedErr)
+				}
 				return
 			}
 
@@ -215,3 +325,186 @@ Here is one file [[test10.txt]]
 		})
 	}
 }
+
+func TestFSAdapterLimits(t *testing.T) {
+	appCFG := &config.Config{}
+	appCFG.SetDefaults()
+	appCFG.IndexerConfig.WorkDir = "/test"
+	appCFG.IndexerConfig.Limits = config.FolderConfig{MaxFiles: 5, PageSize: 2}
+	appCFG.IndexerConfig.Folders = map[string]config.FolderConfig{
+		"big": {MaxFiles: 10, PageSize: -1},
+	}
+	cfg := appCFG.FSAdapterConfig()
+
+	testCases := []struct {
+		name          string
+		workDir       string
+		fileCount     int
+		desc          string
+		expectedFiles int
+		expectedTotal int
+		expectedPages int
+	}{
+		{
+			name:          "Default index with truncation and pagination",
+			workDir:       "one",
+			fileCount:     7,
+			expectedFiles: 5,
+			expectedTotal: 7,
+			expectedPages: 3,
+		},
+		{
+			name:      "Markdown with pagination",
+			workDir:   "two",
+			fileCount: 3,
+			desc: `# Files
+[[FILES]]
+
+Always here [[file1.txt]]
+`,
+			expectedFiles: 3,
+			expectedTotal: 3,
+			expectedPages: 2,
+		},
+		{
+			name:          "Folder override",
+			workDir:       "big",
+			fileCount:     12,
+			expectedFiles: 10,
+			expectedTotal: 12,
+		},
+		{
+			name:          "One page",
+			workDir:       "three",
+			fileCount:     2,
+			expectedFiles: 2,
+			expectedTotal: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			workdir := filepath.Join(cfg.WorkDir, tc.workDir)
+			require.NoError(t, fs.MkdirAll(workdir, os.ModeDir))
+
+			for n := 1; n <= tc.fileCount; n++ {
+				name := fmt.Sprintf("file%d.txt", n)
+				require.NoError(t, afero.WriteFile(fs, filepath.Join(workdir, name), []byte(name), os.ModeAppend))
+			}
+
+			if tc.desc != "" {
+				require.NoError(t, afero.WriteFile(fs, filepath.Join(workdir, cfg.DescFileName), []byte(tc.desc), os.ModeAppend))
+			}
+
+			log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+			adapter, err := NewFSAdapterWithFS(fs, cfg, log)
+			require.NoError(t, err)
+
+			download, err := adapter.ToDownload(workdir)
+			require.NoError(t, err)
+
+			require.Len(t, download.Files, tc.expectedFiles)
+			require.Equal(t, tc.expectedTotal, download.TotalFiles)
+			require.Len(t, download.Pages, tc.expectedPages)
+
+			if tc.expectedPages == 0 {
+				require.Zero(t, download.PageSize)
+
+				return
+			}
+
+			require.Equal(t, download.Pages[0], download.PageContent)
+			for i, page := range download.Pages {
+				pager := entity.NewPager(i+1, download.PageSize, len(download.Files))
+				start, end := pager.Bounds()
+
+				for n, file := range download.Files {
+					if n >= start && n < end {
+						require.Contains(t, page, "/file/"+file.ID+"/")
+					} else if file.Name != "file1.txt" || tc.desc == "" {
+						require.NotContains(t, page, "/file/"+file.ID+"/")
+					}
+				}
+
+				require.Contains(t, page, fmt.Sprintf("?page=%d", len(download.Pages)))
+			}
+		})
+	}
+}
+
+func TestFSAdapterSchedule(t *testing.T) {
+	appCFG := &config.Config{}
+	appCFG.SetDefaults()
+	appCFG.IndexerConfig.WorkDir = "/test"
+	cfg := appCFG.FSAdapterConfig()
+
+	fs := afero.NewMemMapFs()
+	workdir := filepath.Join(cfg.WorkDir, "one")
+	require.NoError(t, fs.MkdirAll(workdir, os.ModeDir))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(workdir, "test1.txt"), []byte("test1 content"), os.ModeAppend))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(workdir, "test2.txt"), []byte("test2 content"), os.ModeAppend))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(workdir, "test3.txt"), []byte("test3 content"), os.ModeAppend))
+	require.NoError(t, afero.WriteFile(fs, filepath.Join(workdir, cfg.DescFileName), []byte(`---
+publish_at: 2030-01-01T10:00:00+03:00
+schedule:
+  test2.txt:
+    expires_at: 2030-02-01T00:00:00Z
+  test3.txt:
+    publish_at: 2030-03-01T00:00:00Z
+---
+# Title
+
+[[test3.txt]]
+
+[[FILES]]
+`), os.ModeAppend))
+
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	adapter, err := NewFSAdapterWithFS(fs, cfg, log)
+	require.NoError(t, err)
+
+	download, err := adapter.ToDownload(workdir)
+	require.NoError(t, err)
+	require.NotNil(t, download.Access)
+	require.False(t, download.Access.IsProtected())
+
+	publishAt := time.Date(2030, 1, 1, 7, 0, 0, 0, time.UTC)
+	require.True(t, publishAt.Equal(download.Access.Schedule.PublishAt))
+
+	require.Equal(t, entity.ScheduleStatusPending, download.Access.Status("", publishAt.Add(-time.Second)))
+	require.Empty(t, download.Access.Status("test2.txt", publishAt))
+	require.Empty(t, download.Access.Status("test1.txt", publishAt.AddDate(1, 0, 0)))
+	require.Equal(t, entity.ScheduleStatusExpired, download.Access.Status("test2.txt", publishAt.AddDate(0, 1, 0)))
+
+	// The pending file is not listed on the page, but it stays in the files of the download
+	require.Equal(t, []string{"test3.txt"}, download.Hidden)
+	require.Len(t, download.Files, 3)
+	require.Contains(t, download.PageContent, "test2.txt")
+	require.NotContains(t, download.PageContent, "test3.txt")
+
+	// The page is rendered for every file window change, the one served at the request time lists the available files
+	require.Len(t, download.Variants, 2)
+
+	pageAt := func(at time.Time) string {
+		content, ok := entity.PageAt(download.Variants, 0, at)
+		if !ok {
+			return download.PageContent
+		}
+
+		return content
+	}
+
+	content := pageAt(publishAt)
+	require.Contains(t, content, "test2.txt")
+	require.NotContains(t, content, "test3.txt")
+
+	content = pageAt(time.Date(2030, 2, 1, 0, 0, 0, 0, time.UTC))
+	require.Contains(t, content, "test1.txt")
+	require.NotContains(t, content, "test2.txt", "expired")
+	require.NotContains(t, content, "test3.txt")
+
+	content = pageAt(time.Date(2030, 3, 15, 0, 0, 0, 0, time.UTC))
+	require.NotContains(t, content, "test2.txt")
+	require.Contains(t, content, "test3.txt", "published")
+}
@@ -34,13 +34,15 @@ var (
 )
 
 type FileResolver interface {
-	GetFile(fileName string) (*entity.File, error)
+	GetFile(fileName string) (*entity.File, error) // nil without an error if the file is not listed
 	GetFiles() []*entity.File
+	GetPager() *entity.Pager // nil if the file list is not paginated
 }
 
 type TemplateResolver interface {
 	GetFileTemplate() *template.Template
 	GetFilesTemplate() *template.Template
+	GetPagerTemplate() *template.Template // Optional
 }
 
 /*
@@ -115,6 +117,10 @@ func (s *FileNodeParser) makeNode(filename, description string, pc parser.Contex
 		return node
 	}
 
+	if file == nil {
+		return node
+	}
+
 	if description != "" {
 		fileCopy := *file
 		fileCopy.Description = description
@@ -200,6 +206,15 @@ func (p *FilesBlockParser) makeNode(pc parser.Context) *FilesNode {
 		return node
 	}
 
+	if pager := fr.GetPager(); pager != nil && pager.Pages > 1 {
+		if pagerTmpl := tr.GetPagerTemplate(); pagerTmpl != nil {
+			if err := pagerTmpl.Execute(buf, pager); err != nil {
+				node.Error = fmt.Errorf("cannot execute pager template: %w", err)
+				return node
+			}
+		}
+	}
+
 	node.HTML = buf.Bytes()
 
 	return node
@@ -3,7 +3,9 @@ package fsadapter
 import (
 	"fmt"
 	"html/template"
+	"slices"
 
+	"github.com/jgivc/fetchtracker/internal/common"
 	"github.com/jgivc/fetchtracker/internal/entity"
 )
 
@@ -12,15 +14,38 @@ const (
 )
 
 type fileResolver struct {
-	files []*entity.File
-	index map[string]int
+	files     []*entity.File // All files, used to resolve [[file]] references
+	pageFiles []*entity.File // Files of the current page, used for [[FILES]]
+	pager     *entity.Pager
+	index     map[string]int
+	hidden    map[string]struct{} // Files outside their windows, they are not listed
 }
 
-func newFileResolver(files []*entity.File) *fileResolver {
-	return &fileResolver{files: files}
+func newFileResolver(files, pageFiles []*entity.File, pager *entity.Pager, hidden []string) *fileResolver {
+	r := &fileResolver{files: files, pageFiles: pageFiles, pager: pager}
+
+	if len(hidden) > 0 {
+		r.hidden = make(map[string]struct{}, len(hidden))
+		for _, name := range hidden {
+			r.hidden[name] = struct{}{}
+		}
+
+		r.pageFiles = slices.DeleteFunc(slices.Clone(pageFiles), func(file *entity.File) bool {
+			_, exists := r.hidden[file.Name]
+
+			return exists
+		})
+	}
+
+	return r
 }
 
+// GetFile returns the file by the name, or nil without an error if the file is outside its window and is not listed.
 func (r *fileResolver) GetFile(fileName string) (*entity.File, error) {
+	if _, exists := r.hidden[fileName]; exists {
+		return nil, nil
+	}
+
 	if r.index == nil && len(r.files) > buildIndexThreshold {
 		r.buildIndex()
 
@@ -28,7 +53,7 @@ func (r *fileResolver) GetFile(fileName string) (*entity.File, error) {
 			return r.files[idx], nil
 		}
 
-		return nil, fmt.Errorf("cannot find file: %s", fileName)
+		return nil, fmt.Errorf("%w: %s", common.ErrBrokenFileReferenceError, fileName)
 	}
 
 	for i := range r.files {
@@ -38,7 +63,7 @@ func (r *fileResolver) GetFile(fileName string) (*entity.File, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("cannot find file: %s", fileName)
+	return nil, fmt.Errorf("%w: %s", common.ErrBrokenFileReferenceError, fileName)
 }
 
 func (r *fileResolver) buildIndex() {
@@ -51,12 +76,17 @@ func (r *fileResolver) buildIndex() {
 }
 
 func (r *fileResolver) GetFiles() []*entity.File {
-	return r.files
+	return r.pageFiles
+}
+
+func (r *fileResolver) GetPager() *entity.Pager {
+	return r.pager
 }
 
 type templateResolver struct {
 	fileTemplate  *template.Template
 	filesTemplate *template.Template
+	pagerTemplate *template.Template
 }
 
 func (r *templateResolver) GetFileTemplate() *template.Template {
@@ -67,10 +97,15 @@ func (r *templateResolver) GetFilesTemplate() *template.Template {
 	return r.filesTemplate
 }
 
+func (r *templateResolver) GetPagerTemplate() *template.Template {
+	return r.pagerTemplate
+}
+
 func newTemplateResolver(tmpl *template.Template) (*templateResolver, error) {
 	r := &templateResolver{
 		fileTemplate:  tmpl.Lookup(templateNameFile),
 		filesTemplate: tmpl.Lookup(templateNameFiles),
+		pagerTemplate: tmpl.Lookup(templateNamePager), // Optional
 	}
 
 	if r.fileTemplate == nil {
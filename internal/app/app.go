@@ -2,32 +2,98 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
 	"time"
 
 	"github.com/jgivc/fetchtracker/internal/adapter/fsadapter"
+	"github.com/jgivc/fetchtracker/internal/autoindex"
 	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/jgivc/fetchtracker/internal/filter"
 	httphandler "github.com/jgivc/fetchtracker/internal/handler/http"
+	"github.com/jgivc/fetchtracker/internal/iprules"
+	"github.com/jgivc/fetchtracker/internal/link"
+	"github.com/jgivc/fetchtracker/internal/realip"
+	"github.com/jgivc/fetchtracker/internal/report"
 	"github.com/jgivc/fetchtracker/internal/repository/download"
+	"github.com/jgivc/fetchtracker/internal/repository/job"
+	"github.com/jgivc/fetchtracker/internal/repository/kv"
+	"github.com/jgivc/fetchtracker/internal/repository/lock"
+	"github.com/jgivc/fetchtracker/internal/repository/migrate"
+	"github.com/jgivc/fetchtracker/internal/repository/salt"
+	"github.com/jgivc/fetchtracker/internal/repository/stats"
+	"github.com/jgivc/fetchtracker/internal/sender"
 	srvdownload "github.com/jgivc/fetchtracker/internal/service/download"
 	sindex "github.com/jgivc/fetchtracker/internal/service/index"
+	"github.com/jgivc/fetchtracker/internal/service/privacy"
+	"github.com/jgivc/fetchtracker/internal/session"
+	"github.com/jgivc/fetchtracker/internal/statuspage"
 	"github.com/jgivc/fetchtracker/internal/storage/index"
 	"github.com/redis/go-redis/v9"
 )
 
 const (
-	indexTimeout = 5 * time.Second
-	dumpTimeout  = 5 * time.Second
+	dumpTimeout = 5 * time.Second
+
+	jobTriggerSignal = "signal"
+	jobTriggerCLI    = "cli"
 )
 
+// versionWatcher follows the active version switched by other app instances.
+type versionWatcher interface {
+	WatchVersion(ctx context.Context)
+}
+
+// downloadRepository is the storage of the pages and counters, it is implemented for every storage driver.
+type downloadRepository interface {
+	sindex.DownloadRepository
+	srvdownload.DownloadRepository
+	versionWatcher
+}
+
+// downloadService is the service used by the public handlers.
+type downloadService interface {
+	httphandler.PageService
+	httphandler.CategoryService
+	httphandler.CounterService
+	httphandler.DownloadService
+	httphandler.HistoryService
+	httphandler.FilteredService
+	RunRollup(ctx context.Context)
+}
+
+// requestFilter excludes bots from the download counting, its patterns are reloaded on SIGHUP.
+type requestFilter interface {
+	httphandler.RequestFilter
+	Reload() error
+}
+
+// repositories are the repositories of the configured storage driver.
+type repositories struct {
+	download downloadRepository
+	jobs     sindex.JobRepository
+	locker   sindex.Locker
+	stats    srvdownload.StatsRepository
+	salts    privacy.SaltRepository
+}
+
 type App struct {
 	cfgPath string
 	cfg     *config.Config
 	srv     *http.Server
 	indexer *sindex.IndexerService
+	drepo   versionWatcher
+	dSrv    downloadService
+	pSrv    httphandler.Fingerprinter
+	filter  requestFilter
+	closer  io.Closer // The embedded storage, nil for Redis
+	cancel  context.CancelFunc
 	log     *slog.Logger
 }
 
@@ -37,21 +103,29 @@ func New(cfgPath string) *App {
 	}
 }
 
-func (a *App) Start() {
-	a.cfg = config.MustLoad(a.cfgPath)
+// Init loads the config and creates the services. It is called by Start and by the CLI commands.
+func (a *App) Init() {
+	a.initConfig()
+	log := a.log
 
-	opt, err := redis.ParseURL(a.cfg.RedisURL)
-	if err != nil {
-		panic(err)
-	}
+	repos := a.newRepositories(log)
 
-	rdb := redis.NewClient(opt)
-	ctx := context.Background()
-	_, err = rdb.Ping(ctx).Result()
+	fsa, err := fsadapter.NewFSAdapter(a.cfg.FSAdapterConfig(), log)
 	if err != nil {
 		panic(err)
 	}
 
+	store := index.NewIndexStorage(fsa, &a.cfg.IndexerConfig, log)
+	a.indexer = sindex.NewIndexService(store, repos.download, repos.jobs, repos.locker, a.cfg.IndexerConfig.Timeout, log)
+	a.drepo = repos.download
+	a.dSrv = srvdownload.NewDownloadService(repos.download, repos.stats, &a.cfg.StatsConfig, &a.cfg.Counting, log)
+	a.pSrv = privacy.NewPrivacyService(repos.salts, &a.cfg.Privacy, log)
+}
+
+// initConfig loads the config and creates the logger.
+func (a *App) initConfig() {
+	a.cfg = config.MustLoad(a.cfgPath)
+
 	lo := &slog.HandlerOptions{}
 	switch a.cfg.LogLevel {
 	case config.LogLevelInfo:
@@ -65,28 +139,137 @@ func (a *App) Start() {
 	default:
 		panic("unknown log level")
 	}
-	log := slog.New(slog.NewTextHandler(os.Stderr, lo))
-	a.log = log
+	a.log = slog.New(slog.NewTextHandler(os.Stderr, lo))
+}
+
+// newRepositories creates the repositories for the configured storage driver.
+func (a *App) newRepositories(log *slog.Logger) *repositories {
+	var store kv.Store
+
+	switch a.cfg.Storage.Driver {
+	case config.StorageDriverMemory:
+		store = kv.NewMemoryStore()
+	case config.StorageDriverBolt:
+		bs, err := kv.NewBoltStore(a.cfg.Storage.Path)
+		if err != nil {
+			panic(err)
+		}
+		store = bs
+	default:
+		rdb := a.newRedisClient()
+		prefix := a.cfg.RedisPrefix
+
+		drepo, err := download.NewDownloadRepository(rdb, prefix, &a.cfg.StatsConfig, log)
+		if err != nil {
+			panic(err)
+		}
+
+		return &repositories{
+			download: drepo,
+			jobs:     job.NewJobRepository(rdb, prefix, a.cfg.IndexerConfig.JobsHistory, log),
+			locker:   lock.NewLockRepository(rdb, prefix, log),
+			stats:    stats.NewStatsRepository(rdb, prefix, &a.cfg.StatsConfig, log),
+			salts:    salt.NewSaltRepository(rdb, prefix, log),
+		}
+	}
+
+	log.Info("Use embedded storage", slog.String("driver", a.cfg.Storage.Driver))
+	a.closer = store
+
+	return &repositories{
+		download: kv.NewDownloadRepository(store, &a.cfg.StatsConfig, log),
+		jobs:     kv.NewJobRepository(store, a.cfg.IndexerConfig.JobsHistory, log),
+		locker:   kv.NewLockRepository(store, log),
+		stats:    kv.NewStatsRepository(store, &a.cfg.StatsConfig, log),
+		salts:    kv.NewSaltRepository(store, log),
+	}
+}
 
-	drepo, err := download.NewDownloadRepository(rdb, log)
+func (a *App) newRedisClient() *redis.Client {
+	opt, err := redis.ParseURL(a.cfg.RedisURL)
 	if err != nil {
 		panic(err)
 	}
 
-	fsa, err := fsadapter.NewFSAdapter(a.cfg.FSAdapterConfig(), log)
+	rdb := redis.NewClient(opt)
+	_, err = rdb.Ping(context.Background()).Result()
 	if err != nil {
 		panic(err)
 	}
 
-	store := index.NewIndexStorage(fsa, &a.cfg.IndexerConfig, log)
-	a.indexer = sindex.NewIndexService(store, drepo, log)
-	dSrv := srvdownload.NewDownloadService(drepo, log)
+	return rdb
+}
 
-	http.Handle("GET /share/{id}/{$}", httphandler.NewPageHandler(dSrv, log))
-	http.Handle("GET /stat/{id}/{$}", httphandler.NewCounterHandler(dSrv, log))
-	http.Handle("POST /file/{id}/{$}", httphandler.NewDownloadHandler(&a.cfg.HandlerConfig, dSrv, log))
+// Start initializes the app, starts the HTTP server and the automatic index.
+func (a *App) Start() {
+	a.Init()
 
-	http.Handle("GET /index/{$}", httphandler.NewIndexHandler(a.indexer, a.cfg.HandlerConfig.URL, log))
+	log := a.log
+	dSrv := a.dSrv
+
+	rf, err := filter.NewFilter(&a.cfg.FilterConfig, log)
+	if err != nil {
+		panic(err)
+	}
+	a.filter = rf
+
+	resolver, err := realip.NewResolver(&a.cfg.HandlerConfig)
+	if err != nil {
+		panic(err)
+	}
+
+	if a.cfg.Access.Secret == "" {
+		log.Warn("Access secret is not set, the sessions of the protected distributions are lost on restart")
+	}
+
+	guard, err := session.NewSessions(&a.cfg.Access, &a.cfg.HandlerConfig.Cookie)
+	if err != nil {
+		panic(err)
+	}
+
+	addrs, err := iprules.NewPolicy(&a.cfg.Access.AddressRules)
+	if err != nil {
+		panic(err)
+	}
+
+	unpublished, err := statuspage.NewPages(&a.cfg.HandlerConfig.Unpublished)
+	if err != nil {
+		panic(err)
+	}
+
+	http.Handle("GET /share/{id}/{$}", httphandler.NewPageHandler(&a.cfg.HandlerConfig, &a.cfg.Privacy, dSrv, guard, resolver, addrs, unpublished, log))
+	http.Handle("POST /share/{id}/{$}", httphandler.NewLoginHandler(dSrv, guard, resolver, addrs, unpublished, log))
+	http.Handle("GET /category/{id}/{$}", httphandler.NewCategoryHandler(dSrv, resolver, addrs, log))
+	http.Handle("GET /stat/{id}/{$}", httphandler.NewCounterHandler(dSrv, guard, resolver, addrs, unpublished, log))
+	http.Handle("GET /stat/{id}/history", httphandler.NewHistoryHandler(dSrv, guard, resolver, addrs, unpublished, log))
+	http.Handle("GET /stat/filtered", httphandler.NewFilteredHandler(dSrv, resolver, addrs, log))
+	downloadHandler := httphandler.NewDownloadHandler(&a.cfg.Privacy, dSrv, rf, resolver, a.pSrv, sender.NewSender(&a.cfg.HandlerConfig, a.cfg.IndexerConfig.WorkDir, log), guard, addrs, unpublished, log)
+	http.Handle("POST /file/{id}/{$}", downloadHandler)
+
+	if a.cfg.Links.IsEnabled() {
+		signer := link.NewSigner(&a.cfg.Links)
+		http.Handle("GET "+link.PathPrefix+"{token}", httphandler.NewLinkHandler(signer, resolver, downloadHandler, log))
+		http.Handle("GET /link/{id}/{$}", httphandler.NewIssueLinkHandler(&a.cfg.Links, a.cfg.HandlerConfig.URL, dSrv, signer, resolver, guard, addrs, unpublished, log))
+	}
+
+	if a.cfg.Admin.IsEnabled() {
+		admin := func(h http.Handler) http.Handler {
+			return httphandler.NewAdminHandler(a.cfg.Admin.Token, h, log)
+		}
+
+		http.Handle("POST /index/{$}", admin(httphandler.NewIndexHandler(a.indexer, log)))
+		http.Handle("POST /index/rollback/{$}", admin(httphandler.NewRollbackHandler(a.indexer, log)))
+		http.Handle("GET /index/jobs/{$}", admin(httphandler.NewJobListHandler(a.indexer, log)))
+		http.Handle("GET /index/jobs/{id}", admin(httphandler.NewJobHandler(a.indexer, log)))
+	} else {
+		log.Warn("Admin token is not set, the index API is disabled")
+	}
+
+	var ctx context.Context
+	ctx, a.cancel = context.WithCancel(context.Background())
+	go a.drepo.WatchVersion(ctx)
+	go dSrv.RunRollup(ctx)
+	a.startAutoIndex(ctx)
 
 	a.srv = &http.Server{
 		Addr: a.cfg.Listen,
@@ -112,29 +295,247 @@ func (a *App) Dump() {
 	}
 }
 
+// ReloadFilter reloads the User-Agent patterns of the download filter on the HUP signal.
+func (a *App) ReloadFilter() {
+	if a.filter == nil {
+		return
+	}
+
+	if err := a.filter.Reload(); err != nil {
+		a.log.Error("Cannot reload filter", slog.Any("error", err))
+	}
+}
+
+// Index runs the index process on the USR1 signal and prints the report.
 func (a *App) Index() {
-	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
-	defer cancel()
+	a.printIndex(jobTriggerSignal, entity.IndexOptions{})
+}
+
+// RunIndex runs the index process once for the index command. It returns false if the index has failed.
+func (a *App) RunIndex(opts entity.IndexOptions) bool {
+	a.Init()
+	defer a.closeStorage()
+
+	if !a.checkSharedStorage("index") {
+		return false
+	}
+
+	return a.printIndex(jobTriggerCLI, opts)
+}
 
+// RunRollback makes the previous version active for the rollback command. It returns false if the rollback has failed.
+func (a *App) RunRollback() bool {
+	a.Init()
+	defer a.closeStorage()
+
+	if !a.checkSharedStorage("rollback") {
+		return false
+	}
+
+	ver, err := a.indexer.Rollback(context.Background())
+	if err != nil {
+		fmt.Printf("Cannot rollback: %s\n", err)
+
+		return false
+	}
+
+	fmt.Printf("Active version: %s\n", ver)
+
+	return true
+}
+
+/*
+RunLink prints a signed link to the file valid for ttl for the link command, bound to ip if it is set.
+It returns false if the link cannot be issued.
+*/
+func (a *App) RunLink(fileID, ip string, ttl time.Duration) bool {
+	a.Init()
+	defer a.closeStorage()
+
+	if !a.checkSharedStorage("link") {
+		return false
+	}
+
+	if !a.cfg.Links.IsEnabled() {
+		fmt.Println("Signed links are disabled, set links.secret")
+
+		return false
+	}
+
+	var addr netip.Addr
+	if ip != "" {
+		var err error
+		if addr, err = netip.ParseAddr(ip); err != nil {
+			fmt.Printf("Invalid address: %s\n", err)
+
+			return false
+		}
+	}
+
+	if ttl <= 0 {
+		ttl = a.cfg.Links.TTL
+	}
+
+	if _, err := a.dSrv.Download(context.Background(), fileID); err != nil {
+		fmt.Printf("Cannot find file: %s\n", err)
+
+		return false
+	}
+
+	path, expiresAt, err := link.NewSigner(&a.cfg.Links).Sign(fileID, addr, ttl)
+	if err != nil {
+		fmt.Printf("Cannot sign link: %s\n", err)
+
+		return false
+	}
+
+	fmt.Printf("%s%s\nExpires at: %s\n", a.cfg.HandlerConfig.URL, path, expiresAt.Format(time.RFC3339))
+
+	return true
+}
+
+/*
+RunMigrateKeys moves the Redis keys written without a prefix under redis_prefix for the migrate-keys command.
+The repositories are not created, they would write the prefixed keys before the migration.
+It returns false if the migration has failed.
+*/
+func (a *App) RunMigrateKeys() bool {
+	a.initConfig()
+
+	if a.cfg.Storage.Driver != config.StorageDriverRedis {
+		fmt.Printf("Keys are migrated only for the %s storage\n", config.StorageDriverRedis)
+
+		return false
+	}
+
+	rdb := a.newRedisClient()
+	defer rdb.Close()
+
+	moved, err := migrate.NewKeyMigrator(rdb, a.cfg.RedisPrefix, a.log).Migrate(context.Background())
+	fmt.Printf("Moved keys: %d\n", moved)
+
+	if err != nil {
+		fmt.Printf("Cannot migrate keys: %s\n", err)
+
+		return false
+	}
+
+	return true
+}
+
+/*
+checkSharedStorage reports whether the command works with the storage of the running server.
+The memory storage lives in the server process, a command would get an empty storage of its own and change nothing.
+*/
+func (a *App) checkSharedStorage(command string) bool {
+	if a.cfg.Storage.Driver != config.StorageDriverMemory {
+		return true
+	}
+
+	fmt.Printf("The %s command cannot be used with the %s storage, it is kept in the server process. Use the HTTP API of the server\n", command, config.StorageDriverMemory)
+
+	return false
+}
+
+func (a *App) printIndex(trigger string, opts entity.IndexOptions) bool {
 	fmt.Println("Building...")
 
-	infos, err := a.indexer.Index(ctx)
+	job, err := a.runIndexJob(trigger, opts)
 	if err != nil {
 		fmt.Printf("Cannot build index: %s\n", err)
 
-		return
+		return false
+	}
+
+	report.Write(os.Stdout, job.Report, a.cfg.HandlerConfig.URL, "\n")
+
+	fmt.Printf("Done in %s.\n", job.Duration)
+
+	return true
+}
+
+// runIndexJob starts the index job and waits until it is finished. It returns an error if the job has failed.
+func (a *App) runIndexJob(trigger string, opts entity.IndexOptions) (*entity.IndexJob, error) {
+	job, err := a.indexer.StartJob(trigger, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err = a.indexer.WaitJob(context.Background(), job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot wait job: %w", err)
 	}
 
-	for i, info := range infos {
-		fmt.Printf("%d. %s -> %s/share/%s, files: %d\n", i+1, info.SourcePath, a.cfg.HandlerConfig.URL, info.ID, info.FileCount)
+	if job.Status == entity.JobStatusFailed {
+		return nil, errors.New(job.Error)
 	}
 
-	fmt.Println("Done.")
+	return job, nil
+}
+
+func (a *App) startAutoIndex(ctx context.Context) {
+	cfg := &a.cfg.IndexerConfig
+
+	if cfg.Watch.Enabled {
+		w, err := autoindex.NewWatcher(cfg, a.autoIndex, a.log)
+		if err != nil {
+			panic(err)
+		}
+
+		go w.Start(ctx)
+	}
+
+	if cfg.Watch.Schedule != "" {
+		s, err := autoindex.NewScheduler(cfg.Watch.Schedule, a.autoIndex, a.log)
+		if err != nil {
+			panic(err)
+		}
+
+		go s.Start(ctx)
+	}
+}
+
+// autoIndex runs the index process started by the watcher or the schedule and logs a summary.
+func (a *App) autoIndex(trigger string) error {
+	log := a.log.With(slog.String("trigger", trigger))
+	log.Info("Automatic index started")
+
+	job, err := a.runIndexJob(trigger, entity.IndexOptions{})
+	if err != nil {
+		log.Error("Automatic index failed", slog.Any("error", err))
+
+		return err
+	}
+
+	log.Info("Automatic index done",
+		slog.String("job_id", job.ID),
+		slog.Int("shares", job.Shares),
+		slog.Int("truncated", len(job.Report.Truncated)),
+		slog.Int("failed", job.Failed),
+		slog.String("duration", job.Duration),
+	)
+
+	return nil
 }
 
 func (a *App) Stop() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	a.srv.Shutdown(ctx)
+	a.closeStorage()
+}
+
+func (a *App) closeStorage() {
+	if a.closer == nil {
+		return
+	}
+
+	if err := a.closer.Close(); err != nil {
+		a.log.Error("Cannot close storage", slog.Any("error", err))
+	}
 }
@@ -0,0 +1,46 @@
+package autoindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduler calls IndexFunc by the cron schedule, e.g. "*/30 * * * *".
+type scheduler struct {
+	cron *cron.Cron
+	log  *slog.Logger
+}
+
+func NewScheduler(schedule string, index IndexFunc, log *slog.Logger) (*scheduler, error) {
+	s := &scheduler{
+		cron: cron.New(),
+		log:  log.With(slog.String("item", "Scheduler")),
+	}
+
+	_, err := s.cron.AddFunc(schedule, func() {
+		if err := index(TriggerSchedule); errors.Is(err, common.ErrIndexingProcessHasAlreadyStarted) {
+			s.log.Info("Index process is running, skip")
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse schedule %q: %w", schedule, err)
+	}
+
+	return s, nil
+}
+
+// Start runs the schedule until ctx is done.
+func (s *scheduler) Start(ctx context.Context) {
+	s.log.Info("Started")
+	s.cron.Start()
+
+	<-ctx.Done()
+
+	<-s.cron.Stop().Done()
+	s.log.Info("Stopped")
+}
@@ -0,0 +1,163 @@
+package autoindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+)
+
+const (
+	TriggerWatcher  = "watcher"
+	TriggerSchedule = "schedule"
+)
+
+// IndexFunc starts the index process. It returns common.ErrIndexingProcessHasAlreadyStarted if the process is running.
+type IndexFunc func(trigger string) error
+
+/*
+watcher watches work_dir with inotify and calls IndexFunc when a burst of changes is over.
+Folders are watched up to cfg.MaxDepth, the same depth the indexer scans.
+*/
+type watcher struct {
+	cfg   *config.IndexerConfig
+	index IndexFunc
+	fsw   *fsnotify.Watcher
+
+	mu    sync.Mutex
+	timer *time.Timer
+
+	log *slog.Logger
+}
+
+func NewWatcher(cfg *config.IndexerConfig, index IndexFunc, log *slog.Logger) (*watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create fs watcher: %w", err)
+	}
+
+	w := &watcher{
+		cfg:   cfg,
+		index: index,
+		fsw:   fsw,
+		log:   log.With(slog.String("item", "Watcher")),
+	}
+
+	if err := w.add(cfg.WorkDir); err != nil {
+		fsw.Close()
+
+		return nil, fmt.Errorf("cannot watch work dir: %w", err)
+	}
+
+	return w, nil
+}
+
+// Start handles the fs events until ctx is done.
+func (w *watcher) Start(ctx context.Context) {
+	defer w.fsw.Close()
+
+	w.log.Info("Started", slog.String("work_dir", w.cfg.WorkDir), slog.Duration("debounce", w.cfg.Watch.Debounce))
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.stopTimer()
+			w.log.Info("Stopped")
+
+			return
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+
+			w.log.Debug("Event", slog.String("name", event.Name), slog.String("op", event.Op.String()))
+
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := w.add(event.Name); err != nil {
+						w.log.Error("Cannot watch folder", slog.String("path", event.Name), slog.Any("error", err))
+					}
+				}
+			}
+
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+
+			w.schedule()
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+
+			w.log.Error("Watch error", slog.Any("error", err))
+		}
+	}
+}
+
+// add watches the folder and its subfolders up to cfg.MaxDepth.
+func (w *watcher) add(root string) error {
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if w.depth(path) > w.cfg.MaxDepth {
+			return filepath.SkipDir
+		}
+
+		return w.fsw.Add(path)
+	})
+}
+
+func (w *watcher) depth(path string) int {
+	rel, err := filepath.Rel(w.cfg.WorkDir, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+
+	return len(strings.Split(filepath.ToSlash(rel), "/"))
+}
+
+// schedule (re)starts the debounce timer.
+func (w *watcher) schedule() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	w.timer = time.AfterFunc(w.cfg.Watch.Debounce, w.fire)
+}
+
+func (w *watcher) fire() {
+	err := w.index(TriggerWatcher)
+	if errors.Is(err, common.ErrIndexingProcessHasAlreadyStarted) {
+		// The running process may have missed the changes, so try again later.
+		w.log.Info("Index process is running, postpone")
+		w.schedule()
+	}
+}
+
+func (w *watcher) stopTimer() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
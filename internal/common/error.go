@@ -7,4 +7,15 @@ var (
 	ErrFileNotFoundError                = fmt.Errorf("file not found")
 	ErrIndexingProcessHasAlreadyStarted = fmt.Errorf("indexing process has already started")
 	ErrNoDownloadsFoundError            = fmt.Errorf("no downloads found")
+	ErrJobNotFoundError                 = fmt.Errorf("job not found")
+	ErrNoPreviousVersionError           = fmt.Errorf("no previous version")
+	ErrLockIsHeldError                  = fmt.Errorf("lock is held by another process")
+	ErrInvalidLinkError                 = fmt.Errorf("invalid link")
+	ErrLinkExpiredError                 = fmt.Errorf("link has expired")
+	ErrTooManyAttemptsError             = fmt.Errorf("too many login attempts")
+
+	// Reasons the folder is skipped by the index process
+	ErrFolderHasNoFilesError    = fmt.Errorf("folder has no files")
+	ErrTemplateError            = fmt.Errorf("template error")
+	ErrBrokenFileReferenceError = fmt.Errorf("broken file reference")
 )
@@ -2,11 +2,15 @@ package config
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
+	"github.com/jgivc/fetchtracker/internal/entity"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,32 +20,102 @@ const (
 	LogLevelError = "error"
 	LogLevelDebug = "debug"
 
+	StorageDriverRedis  = "redis"
+	StorageDriverMemory = "memory"
+	StorageDriverBolt   = "bolt"
+
+	CookieSameSiteStrict = "strict"
+	CookieSameSiteLax    = "lax"
+	CookieSameSiteNone   = "none"
+
+	ServeModeRedirect = "redirect" // The web server sends the file by the redirect header
+	ServeModeDirect   = "direct"   // The app sends the file itself
+
+	OffloadNginx    = "nginx"    // X-Accel-Redirect to an internal location
+	OffloadSendfile = "sendfile" // X-Sendfile with an absolute path, Apache mod_xsendfile and lighttpd
+	OffloadCaddy    = "caddy"    // X-Accel-Redirect with the path under the root of the handle_response file_server
+
 	defaultListen            = ":10011"
 	defaultURL               = "http://127.0.0.1"
 	defaultLogLevel          = LogLevelInfo
 	defaultWorkDir           = "/tmp/testdata"
 	defaultWorkers           = 2
+	defaultMaxDepth          = 1
+	defaultMaxDirs           = 100
+	defaultMaxFiles          = 100
+	defaultWatchDebounce     = 5 * time.Second
+	defaultIndexTimeout      = 5 * time.Second
+	defaultJobsHistory       = 50
 	defaultIndexPageFileName = "index.html"
 	defaultTemplateFileName  = "template.html"
 	defaultDescFileName      = "description.md"
 	defaultRedisURL          = "http://127.0.0.1/0"
+	defaultStorageDriver     = StorageDriverRedis
+	defaultStoragePath       = "fetchtracker.db"
 	defaultRedirectHeader    = "X-Accel-Redirect"
+	defaultSendfileHeader    = "X-Sendfile"
+	defaultOffload           = OffloadNginx
 	defaultRealIPHeader      = "X-Real-IP"
 	defaultDumpFilename      = "/tmp/fetchtracker_counters.json"
+	defaultRollupInterval    = 5 * time.Minute
+	defaultHourlyRetention   = 48 * time.Hour
+	defaultDailyRetention    = 90 * 24 * time.Hour
+	minHourlyRetention       = 2 * time.Hour  // The hour must outlive the rollup
+	minDailyRetention        = 48 * time.Hour // The day must outlive the rollup into the month
+	defaultCountingMode      = entity.CountingModeWindow
+	defaultCountingWindow    = 24 * time.Hour
+	defaultRequiredHeader    = "User-Agent"
+	maxIPv6Prefix            = 128
+	defaultCookieMaxAge      = 365 * 24 * time.Hour
+	defaultServeMode         = ServeModeRedirect
+
+	defaultLinkTTL    = 24 * time.Hour
+	defaultSessionTTL = 7 * 24 * time.Hour
+
+	defaultLoginAttemptsPerAddress      = 30
+	defaultLoginAttemptsPerDistribution = 10
+	defaultLoginWindow                  = 15 * time.Minute
 
 	envHandlerURLname = "FT_URL"
+	envLinkSecretName = "FT_LINK_SECRET"
+	envAccessSecret   = "FT_ACCESS_SECRET"
+	envAdminToken     = "FT_ADMIN_TOKEN"
 )
 
+// defaultTrustedProxies are the loopback and private networks, a reverse proxy on the same host or in the same Docker network.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// FolderConfig holds the limits that can be overridden for a single folder.
+type FolderConfig struct {
+	MaxDirs  int `yaml:"max_dirs"`  // Maximum number of subfolders scanned in a folder
+	MaxFiles int `yaml:"max_files"` // Maximum number of files in a distribution
+	PageSize int `yaml:"page_size"` // Number of files on a distribution page, 0 - no pagination
+}
+
+// WatchConfig configures automatic re-indexing.
+type WatchConfig struct {
+	Enabled  bool          `yaml:"enabled"`  // Watch work_dir with inotify and re-index on changes
+	Debounce time.Duration `yaml:"debounce"` // How long to wait for a burst of changes to settle
+	Schedule string        `yaml:"schedule"` // Cron expression, an alternative or an addition to watching
+}
+
 type IndexerConfig struct {
-	WorkDir              string   `yaml:"work_dir"`
-	Workers              int      `yaml:"workers"`
-	IndexPageFileName    string   `yaml:"index_filename"` // If it is present in the shared folder, the page is generated only based on it. Template and markdown files are ignored.
-	DescFileName         string   `yaml:"desc_filename"`
-	TemplateFileName     string   `yaml:"template_filename"`
-	DefaultIndexTemplate string   `yaml:"index_template"`
-	DefaultMDTemplate    string   `yaml:"md_template"`
-	SkipFiles            []string `yaml:"skip_files"`
-	DumpFileName         string   `yaml:"dump_filename"`
+	WorkDir              string                  `yaml:"work_dir"`
+	Workers              int                     `yaml:"workers"`
+	Timeout              time.Duration           `yaml:"timeout"`      // Maximum duration of the index process
+	Incremental          bool                    `yaml:"incremental"`  // Re-render only the folders that have changed since the last index
+	JobsHistory          int                     `yaml:"jobs_history"` // Number of finished index jobs kept in the history
+	MaxDepth             int                     `yaml:"max_depth"`    // How deep to look for distributions. Parent folders of nested distributions become categories.
+	Limits               FolderConfig            `yaml:"limits"`
+	Folders              map[string]FolderConfig `yaml:"folders"`        // Per-folder limits. The key is a folder path relative to work_dir.
+	IndexPageFileName    string                  `yaml:"index_filename"` // If it is present in the shared folder, the page is generated only based on it. Template and markdown files are ignored.
+	DescFileName         string                  `yaml:"desc_filename"`
+	TemplateFileName     string                  `yaml:"template_filename"`
+	DefaultIndexTemplate string                  `yaml:"index_template"`
+	DefaultMDTemplate    string                  `yaml:"md_template"`
+	SkipFiles            []string                `yaml:"skip_files"`
+	DumpFileName         string                  `yaml:"dump_filename"`
+	Watch                WatchConfig             `yaml:"watch"`
 }
 
 type FSAdapterConfig struct {
@@ -51,20 +125,160 @@ type FSAdapterConfig struct {
 	DescFileName      string
 	TemplateFileName  string
 	SkipFiles         []string
+	Limits            FolderConfig
+	Folders           map[string]FolderConfig
 }
 
 type HandlerConfig struct {
-	URL            string `yaml:"url"`
-	RedirectHeader string `yaml:"header_redirect"`
-	RealIPHeader   string `yaml:"header_realip"`
+	URL            string            `yaml:"url"`
+	RedirectHeader string            `yaml:"header_redirect"`
+	RealIPHeader   string            `yaml:"header_realip"`   // X-Real-IP, X-Forwarded-For, Forwarded or another header with a single address
+	TrustedProxies []string          `yaml:"trusted_proxies"` // The header is used only if the request comes from these CIDRs. Loopback and private networks by default
+	IPv6Prefix     int               `yaml:"ipv6_prefix"`     // IPv6 addresses are deduplicated by this prefix, e.g. 64. 0 - by the full address
+	Cookie         CookieConfig      `yaml:"cookie"`
+	ServeMode      string            `yaml:"serve_mode"`  // redirect or direct. Direct serves the files from work_dir without a web server in front
+	RateLimit      int64             `yaml:"rate_limit"`  // Bytes per second per download in the direct mode, 0 - no limit
+	Offload        OffloadConfig     `yaml:"offload"`     // How the web server is asked to send the file in the redirect mode
+	Unpublished    UnpublishedConfig `yaml:"unpublished"` // Responses to the distributions and files outside their publish window
+}
+
+/*
+UnpublishedConfig sets the responses to the distributions and files that are not published yet or have expired.
+The pending ones are answered with 404, the expired ones with expired_status.
+*/
+type UnpublishedConfig struct {
+	ExpiredStatus int    `yaml:"expired_status"` // 410 by default, 404 hides that the distribution has existed
+	NotFoundPage  string `yaml:"not_found_page"` // HTML file of the 404 response, empty - a plain text
+	GonePage      string `yaml:"gone_page"`      // HTML file of the 410 response, empty - a plain text
+}
+
+/*
+OffloadConfig sets the redirect header value: the prefix followed by the file path relative to work_dir.
+The X-Accel headers are understood by nginx only.
+*/
+type OffloadConfig struct {
+	Profile   string `yaml:"profile"`    // nginx, sendfile or caddy
+	Prefix    string `yaml:"prefix"`     // nginx: the internal location, /<work_dir name>/ by default. sendfile: the work_dir path on the web server host. caddy: / by default
+	Buffering string `yaml:"buffering"`  // X-Accel-Buffering: yes or no, empty - not sent
+	LimitRate int64  `yaml:"limit_rate"` // X-Accel-Limit-Rate in bytes per second, 0 - not sent
+	Charset   string `yaml:"charset"`    // X-Accel-Charset for nginx, the charset of the text Content-Type for the others. Empty - not sent
+}
+
+// CookieConfig sets the attributes of the user cookie.
+type CookieConfig struct {
+	MaxAge   time.Duration `yaml:"max_age"`   // One year by default
+	Secure   *bool         `yaml:"secure"`    // Only send over HTTPS, true by default. Set false for plain HTTP
+	SameSite string        `yaml:"same_site"` // strict, lax or none
+	Domain   string        `yaml:"domain"`    // Empty - the current host only
+}
+
+// IsSecure reports whether the cookie is sent only over HTTPS.
+func (c *CookieConfig) IsSecure() bool {
+	return c.Secure == nil || *c.Secure
+}
+
+// AdminConfig configures the index API, it is enabled if the token is set.
+type AdminConfig struct {
+	Token string `yaml:"token"` // Bearer token of the /index/ requests, FT_ADMIN_TOKEN overrides it
+}
+
+// IsEnabled reports whether the index API is served.
+func (c *AdminConfig) IsEnabled() bool {
+	return c.Token != ""
+}
+
+// LinksConfig configures the signed download links, they are enabled if the secret is set.
+type LinksConfig struct {
+	Secret     string        `yaml:"secret"`      // HMAC key, FT_LINK_SECRET overrides it
+	TTL        time.Duration `yaml:"ttl"`         // How long an issued link is valid
+	BindIP     bool          `yaml:"bind_ip"`     // The links issued over HTTP are valid only from the client address
+	SecureLink bool          `yaml:"secure_link"` // Issue the links in the nginx secure_link_md5 format
+}
+
+// IsEnabled reports whether the signed links are issued and accepted.
+func (c *LinksConfig) IsEnabled() bool {
+	return c.Secret != ""
+}
+
+/*
+AccessConfig configures the sessions of the password protected distributions and the address rules of all distributions.
+Without the secret a random one is generated on start, so the sessions are lost on restart and are not shared by the instances.
+*/
+type AccessConfig struct {
+	Secret              string           `yaml:"secret"`      // HMAC key of the session cookies, FT_ACCESS_SECRET overrides it
+	SessionTTL          time.Duration    `yaml:"session_ttl"` // How long the user stays logged in, a week by default
+	LoginLimit          LoginLimitConfig `yaml:"login_limit"`
+	entity.AddressRules `yaml:",inline"` // Allow and deny CIDRs of the pages, counters, files, categories and /stat/filtered
+}
+
+/*
+LoginLimitConfig limits the password and token attempts, every password attempt costs a slow hash.
+The attempts are counted by each instance in memory and only by the client address,
+so a client guessing the password does not lock the other users out of the distribution.
+*/
+type LoginLimitConfig struct {
+	PerAddress      int           `yaml:"per_address"`      // Attempts of one client address on all distributions, 30 by default
+	PerDistribution int           `yaml:"per_distribution"` // Attempts of one client address on one distribution, 10 by default
+	Window          time.Duration `yaml:"window"`           // The attempts are counted in this window, 15m by default
+}
+
+// PrivacyConfig configures how the users are tracked to detect repeated downloads.
+type PrivacyConfig struct {
+	DailySalt  bool `yaml:"daily_salt"`  // Hash the IP + User-Agent fingerprint with a salt that changes every day, so it cannot be linked across days
+	NoCookie   bool `yaml:"no_cookie"`   // Do not set the user cookie, the users are tracked by the fingerprint only
+	RespectDNT bool `yaml:"respect_dnt"` // Do not track the requests with DNT: 1 or Sec-GPC: 1
+}
+
+// StorageConfig selects the storage of the pages and counters.
+type StorageConfig struct {
+	Driver string `yaml:"driver"` // redis, memory or bolt. The memory storage is lost on restart.
+	Path   string `yaml:"path"`   // Database file of the bolt driver
+}
+
+// FilterConfig configures excluding bots and crawlers from the download counting. The filtered downloads are still served.
+type FilterConfig struct {
+	Enabled         *bool    `yaml:"enabled"`          // Enabled by default
+	UserAgentsFile  string   `yaml:"user_agents_file"` // Extra User-Agent patterns, one regular expression per line. Reloaded on SIGHUP
+	NoBuiltin       bool     `yaml:"no_builtin"`       // Do not use the built-in User-Agent patterns
+	DenyCIDRs       []string `yaml:"deny_cidrs"`       // Addresses of the scanners and monitoring, e.g. 10.0.0.0/8
+	RequiredHeaders []string `yaml:"required_headers"` // A request without any of them is filtered. User-Agent by default
+}
+
+// IsEnabled reports whether the filter is enabled.
+func (c *FilterConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// StatsRetention sets how long the download history buckets are kept.
+type StatsRetention struct {
+	Hourly  time.Duration `yaml:"hourly"`
+	Daily   time.Duration `yaml:"daily"`
+	Monthly time.Duration `yaml:"monthly"` // 0 - keep forever
+}
+
+// StatsConfig configures the download history.
+type StatsConfig struct {
+	Timezone       string         `yaml:"timezone"`        // IANA time zone of the days and months, e.g. Europe/Moscow, or Local. UTC by default
+	RollupInterval time.Duration  `yaml:"rollup_interval"` // How often the finished hours are rolled up into days and months
+	Retention      StatsRetention `yaml:"retention"`
+	Location       *time.Location `yaml:"-"`
 }
 
 type Config struct {
-	Listen        string        `yaml:"listen"`
-	RedisURL      string        `yaml:"redis"`
-	LogLevel      string        `yaml:"log_level"`
-	IndexerConfig IndexerConfig `yaml:"indexer"`
-	HandlerConfig HandlerConfig `yaml:"handler"`
+	Listen        string                `yaml:"listen"`
+	RedisURL      string                `yaml:"redis"`
+	RedisPrefix   string                `yaml:"redis_prefix"` // Prefix of all Redis keys, so several apps can share one Redis
+	Storage       StorageConfig         `yaml:"storage"`
+	LogLevel      string                `yaml:"log_level"`
+	IndexerConfig IndexerConfig         `yaml:"indexer"`
+	HandlerConfig HandlerConfig         `yaml:"handler"`
+	StatsConfig   StatsConfig           `yaml:"stats"`
+	Counting      entity.CountingPolicy `yaml:"counting"` // Global counting policy, frontmatter can override it per distribution
+	FilterConfig  FilterConfig          `yaml:"filter"`
+	Privacy       PrivacyConfig         `yaml:"privacy"`
+	Links         LinksConfig           `yaml:"links"`
+	Access        AccessConfig          `yaml:"access"`
+	Admin         AdminConfig           `yaml:"admin"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -113,10 +327,27 @@ func (c *Config) SetDefaults() error {
 		c.RedisURL = defaultRedisURL
 	}
 
+	// The prefix is used in the SCAN patterns
+	if strings.ContainsAny(c.RedisPrefix, "*?[]\\ ") {
+		return fmt.Errorf("invalid redis prefix: %s", c.RedisPrefix)
+	}
+
 	if c.LogLevel == "" {
 		c.LogLevel = defaultLogLevel
 	}
 
+	switch c.Storage.Driver {
+	case "":
+		c.Storage.Driver = defaultStorageDriver
+	case StorageDriverRedis, StorageDriverMemory, StorageDriverBolt:
+	default:
+		return fmt.Errorf("unknown storage driver: %s", c.Storage.Driver)
+	}
+
+	if c.Storage.Path == "" {
+		c.Storage.Path = defaultStoragePath
+	}
+
 	// IndexerConfig
 	if c.IndexerConfig.WorkDir == "" {
 		c.IndexerConfig.WorkDir = defaultWorkDir
@@ -126,6 +357,30 @@ func (c *Config) SetDefaults() error {
 		c.IndexerConfig.Workers = defaultWorkers
 	}
 
+	if c.IndexerConfig.Timeout <= 0 {
+		c.IndexerConfig.Timeout = defaultIndexTimeout
+	}
+
+	if c.IndexerConfig.JobsHistory < 1 {
+		c.IndexerConfig.JobsHistory = defaultJobsHistory
+	}
+
+	if c.IndexerConfig.MaxDepth < 1 {
+		c.IndexerConfig.MaxDepth = defaultMaxDepth
+	}
+
+	if c.IndexerConfig.Limits.MaxDirs < 1 {
+		c.IndexerConfig.Limits.MaxDirs = defaultMaxDirs
+	}
+
+	if c.IndexerConfig.Limits.MaxFiles < 1 {
+		c.IndexerConfig.Limits.MaxFiles = defaultMaxFiles
+	}
+
+	if c.IndexerConfig.Limits.PageSize < 0 {
+		c.IndexerConfig.Limits.PageSize = 0
+	}
+
 	if c.IndexerConfig.TemplateFileName == "" {
 		c.IndexerConfig.TemplateFileName = defaultTemplateFileName
 	}
@@ -150,6 +405,57 @@ func (c *Config) SetDefaults() error {
 		c.IndexerConfig.DumpFileName = defaultDumpFilename
 	}
 
+	if c.IndexerConfig.Watch.Debounce <= 0 {
+		c.IndexerConfig.Watch.Debounce = defaultWatchDebounce
+	}
+
+	// StatsConfig
+	loc, err := time.LoadLocation(c.StatsConfig.Timezone)
+	if err != nil {
+		return fmt.Errorf("cannot load stats timezone: %w", err)
+	}
+	c.StatsConfig.Location = loc
+
+	if c.StatsConfig.RollupInterval <= 0 {
+		c.StatsConfig.RollupInterval = defaultRollupInterval
+	}
+
+	if c.StatsConfig.Retention.Hourly <= 0 {
+		c.StatsConfig.Retention.Hourly = defaultHourlyRetention
+	}
+	c.StatsConfig.Retention.Hourly = max(c.StatsConfig.Retention.Hourly, minHourlyRetention)
+
+	if c.StatsConfig.Retention.Daily <= 0 {
+		c.StatsConfig.Retention.Daily = defaultDailyRetention
+	}
+	c.StatsConfig.Retention.Daily = max(c.StatsConfig.Retention.Daily, minDailyRetention)
+
+	if c.StatsConfig.Retention.Monthly < 0 {
+		c.StatsConfig.Retention.Monthly = 0
+	}
+
+	// Counting
+	if err := c.Counting.Validate(); err != nil {
+		return err
+	}
+
+	if c.Counting.Mode == "" {
+		c.Counting.Mode = defaultCountingMode
+	}
+
+	if c.Counting.Window == 0 {
+		c.Counting.Window = defaultCountingWindow
+	}
+
+	if c.Counting.CookieOnly == nil {
+		c.Counting.CookieOnly = new(bool)
+	}
+
+	// FilterConfig
+	if c.FilterConfig.RequiredHeaders == nil {
+		c.FilterConfig.RequiredHeaders = []string{defaultRequiredHeader}
+	}
+
 	// HandlerConfig
 	// Fix handler URL
 	var (
@@ -184,14 +490,142 @@ func (c *Config) SetDefaults() error {
 	// To prevent double slash
 	c.HandlerConfig.URL = strings.TrimSuffix(strURL, "/")
 
+	if err := c.HandlerConfig.Offload.setDefaults(c.IndexerConfig.WorkDir); err != nil {
+		return err
+	}
+
 	if c.HandlerConfig.RedirectHeader == "" {
 		c.HandlerConfig.RedirectHeader = defaultRedirectHeader
+		if c.HandlerConfig.Offload.Profile == OffloadSendfile {
+			c.HandlerConfig.RedirectHeader = defaultSendfileHeader
+		}
 	}
 
 	if c.HandlerConfig.RealIPHeader == "" {
 		c.HandlerConfig.RealIPHeader = defaultRealIPHeader
 	}
 
+	if c.HandlerConfig.TrustedProxies == nil {
+		c.HandlerConfig.TrustedProxies = defaultTrustedProxies
+	}
+
+	if c.HandlerConfig.IPv6Prefix < 0 || c.HandlerConfig.IPv6Prefix > maxIPv6Prefix {
+		return fmt.Errorf("invalid ipv6 prefix: %d", c.HandlerConfig.IPv6Prefix)
+	}
+
+	if c.HandlerConfig.Cookie.MaxAge <= 0 {
+		c.HandlerConfig.Cookie.MaxAge = defaultCookieMaxAge
+	}
+
+	switch c.HandlerConfig.Cookie.SameSite {
+	case "":
+		c.HandlerConfig.Cookie.SameSite = CookieSameSiteStrict
+	case CookieSameSiteStrict, CookieSameSiteLax:
+	case CookieSameSiteNone:
+		// Browsers reject SameSite=None without Secure
+		if !c.HandlerConfig.Cookie.IsSecure() {
+			return fmt.Errorf("cookie same_site none requires secure")
+		}
+	default:
+		return fmt.Errorf("unknown cookie same_site: %s", c.HandlerConfig.Cookie.SameSite)
+	}
+
+	switch c.HandlerConfig.ServeMode {
+	case "":
+		c.HandlerConfig.ServeMode = defaultServeMode
+	case ServeModeRedirect, ServeModeDirect:
+	default:
+		return fmt.Errorf("unknown serve mode: %s", c.HandlerConfig.ServeMode)
+	}
+
+	if c.HandlerConfig.RateLimit < 0 {
+		return fmt.Errorf("negative rate limit: %d", c.HandlerConfig.RateLimit)
+	}
+
+	switch c.HandlerConfig.Unpublished.ExpiredStatus {
+	case 0:
+		c.HandlerConfig.Unpublished.ExpiredStatus = http.StatusGone
+	case http.StatusGone, http.StatusNotFound:
+	default:
+		return fmt.Errorf("expired status must be %d or %d: %d", http.StatusGone, http.StatusNotFound, c.HandlerConfig.Unpublished.ExpiredStatus)
+	}
+
+	if secret := os.Getenv(envLinkSecretName); secret != "" {
+		c.Links.Secret = secret
+	}
+
+	if c.Links.TTL <= 0 {
+		c.Links.TTL = defaultLinkTTL
+	}
+
+	if secret := os.Getenv(envAccessSecret); secret != "" {
+		c.Access.Secret = secret
+	}
+
+	if token := os.Getenv(envAdminToken); token != "" {
+		c.Admin.Token = token
+	}
+
+	if c.Access.SessionTTL <= 0 {
+		c.Access.SessionTTL = defaultSessionTTL
+	}
+
+	if c.Access.LoginLimit.PerAddress < 1 {
+		c.Access.LoginLimit.PerAddress = defaultLoginAttemptsPerAddress
+	}
+
+	if c.Access.LoginLimit.PerDistribution < 1 {
+		c.Access.LoginLimit.PerDistribution = defaultLoginAttemptsPerDistribution
+	}
+
+	if c.Access.LoginLimit.Window <= 0 {
+		c.Access.LoginLimit.Window = defaultLoginWindow
+	}
+
+	if err := c.Access.AddressRules.Validate(); err != nil {
+		return fmt.Errorf("invalid access rules: %w", err)
+	}
+
+	return nil
+}
+
+func (c *OffloadConfig) setDefaults(workDir string) error {
+	switch c.Profile {
+	case "":
+		c.Profile = defaultOffload
+	case OffloadNginx, OffloadSendfile, OffloadCaddy:
+	default:
+		return fmt.Errorf("unknown offload profile: %s", c.Profile)
+	}
+
+	if c.Prefix == "" {
+		switch c.Profile {
+		case OffloadNginx:
+			c.Prefix = "/" + filepath.Base(workDir)
+		case OffloadSendfile:
+			c.Prefix = workDir
+		case OffloadCaddy:
+			c.Prefix = "/"
+		}
+	}
+
+	if c.Profile == OffloadSendfile && !filepath.IsAbs(c.Prefix) {
+		return fmt.Errorf("sendfile offload prefix must be absolute: %s", c.Prefix)
+	}
+
+	// The file path is appended after a single slash
+	c.Prefix = strings.TrimSuffix(c.Prefix, "/") + "/"
+
+	switch c.Buffering {
+	case "", "yes", "no":
+	default:
+		return fmt.Errorf("invalid offload buffering: %s", c.Buffering)
+	}
+
+	if c.LimitRate < 0 {
+		return fmt.Errorf("negative offload limit rate: %d", c.LimitRate)
+	}
+
 	return nil
 }
 
@@ -203,9 +637,54 @@ func (c *Config) FSAdapterConfig() *FSAdapterConfig {
 		DescFileName:      c.IndexerConfig.DescFileName,
 		TemplateFileName:  c.IndexerConfig.TemplateFileName,
 		SkipFiles:         c.IndexerConfig.SkipFiles,
+		Limits:            c.IndexerConfig.Limits,
+		Folders:           c.IndexerConfig.Folders,
 	}
 }
 
+// FolderLimits returns the limits for the folder with per-folder overrides applied.
+func (c *IndexerConfig) FolderLimits(folderPath string) FolderConfig {
+	return folderLimits(c.WorkDir, folderPath, c.Limits, c.Folders)
+}
+
+// FolderLimits returns the limits for the folder with per-folder overrides applied.
+func (c *FSAdapterConfig) FolderLimits(folderPath string) FolderConfig {
+	return folderLimits(c.WorkDir, folderPath, c.Limits, c.Folders)
+}
+
+func folderLimits(workDir, folderPath string, defaults FolderConfig, folders map[string]FolderConfig) FolderConfig {
+	if len(folders) == 0 {
+		return defaults
+	}
+
+	rel, err := filepath.Rel(workDir, folderPath)
+	if err != nil {
+		return defaults
+	}
+
+	override, exists := folders[filepath.ToSlash(rel)]
+	if !exists {
+		return defaults
+	}
+
+	if override.MaxDirs > 0 {
+		defaults.MaxDirs = override.MaxDirs
+	}
+
+	if override.MaxFiles > 0 {
+		defaults.MaxFiles = override.MaxFiles
+	}
+
+	// Negative page size disables pagination for the folder
+	if override.PageSize > 0 {
+		defaults.PageSize = override.PageSize
+	} else if override.PageSize < 0 {
+		defaults.PageSize = 0
+	}
+
+	return defaults
+}
+
 func (c *Config) Validate() error {
 	panic("not implemented")
 }
@@ -0,0 +1,242 @@
+package entity
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 600000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+)
+
+/*
+Access restricts a distribution to the users who know the password or one of the tokens, to the allowed addresses
+and to the publish window. The password is stored as a hash made by the hash-password command, the tokens are compared as is.
+The windows are set by the publish_at, expires_at and schedule fields of the frontmatter, not in access.
+*/
+type Access struct {
+	Password     string   `yaml:"password" json:"password,omitempty"`
+	Tokens       []string `yaml:"tokens" json:"tokens,omitempty"`
+	AddressRules `yaml:",inline"`
+	Schedule     Schedule            `yaml:"-" json:"schedule,omitzero"`
+	Files        map[string]Schedule `yaml:"-" json:"files,omitempty"`   // Windows of the files by the name
+	Preview      string              `yaml:"-" json:"preview,omitempty"` // Secret token of the draft, set by the indexer for the disabled downloads
+}
+
+// AddressRules allow or deny the access by the client address CIDRs. Deny wins, an empty allow list allows any address.
+type AddressRules struct {
+	Allow []string `yaml:"allow" json:"allow,omitempty"`
+	Deny  []string `yaml:"deny" json:"deny,omitempty"`
+}
+
+// Validate checks that the CIDRs can be parsed.
+func (r *AddressRules) Validate() error {
+	for _, list := range [][]string{r.Allow, r.Deny} {
+		for _, cidr := range list {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				return fmt.Errorf("invalid cidr %s: %w", cidr, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsEmpty reports whether the rules allow any address.
+func (r *AddressRules) IsEmpty() bool {
+	return len(r.Allow) < 1 && len(r.Deny) < 1
+}
+
+// IsProtected reports whether the access needs the password or a token.
+func (a *Access) IsProtected() bool {
+	return a.Password != "" || len(a.Tokens) > 0 || a.IsDraft()
+}
+
+// IsDraft reports whether the download is disabled and is available only by the preview token.
+func (a *Access) IsDraft() bool {
+	return a != nil && a.Preview != ""
+}
+
+/*
+Status returns the publish status of the download at now, or of the file too if fileName is set.
+An empty string means it is available, the nil access is always available.
+*/
+func (a *Access) Status(fileName string, now time.Time) string {
+	if a == nil {
+		return ""
+	}
+
+	if status := a.Schedule.Status(now); status != "" {
+		return status
+	}
+
+	if fileName == "" {
+		return ""
+	}
+
+	schedule := a.Files[fileName]
+
+	return schedule.Status(now)
+}
+
+// HiddenFiles returns the sorted names of the files outside their windows at now, they are not listed on the page.
+func (a *Access) HiddenFiles(now time.Time) []string {
+	if a == nil {
+		return nil
+	}
+
+	var names []string
+	for name, schedule := range a.Files {
+		if schedule.Status(now) != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// FileChanges returns the sorted times after now a file window opens or closes at, the page is rendered for each of them.
+func (a *Access) FileChanges(now time.Time) []time.Time {
+	if a == nil {
+		return nil
+	}
+
+	var changes []time.Time
+	for _, schedule := range a.Files {
+		for _, at := range []time.Time{schedule.PublishAt, schedule.ExpiresAt} {
+			if at.After(now) {
+				changes = append(changes, at)
+			}
+		}
+	}
+
+	slices.SortFunc(changes, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	return slices.CompactFunc(changes, time.Time.Equal)
+}
+
+// Validate checks that the access is restricted by something and the password hash and the CIDRs can be parsed.
+func (a *Access) Validate() error {
+	if !a.IsProtected() && a.AddressRules.IsEmpty() {
+		return fmt.Errorf("access has neither password, tokens nor address rules")
+	}
+
+	if err := a.AddressRules.Validate(); err != nil {
+		return err
+	}
+
+	if a.Password != "" {
+		if _, _, _, err := parsePasswordHash(a.Password); err != nil {
+			return err
+		}
+	}
+
+	for _, token := range a.Tokens {
+		if token == "" {
+			return fmt.Errorf("empty access token")
+		}
+	}
+
+	return nil
+}
+
+// CheckToken reports whether secret is one of the tokens. The draft accepts only the preview token.
+func (a *Access) CheckToken(secret string) bool {
+	if secret == "" {
+		return false
+	}
+
+	if a.IsDraft() {
+		return subtle.ConstantTimeCompare([]byte(a.Preview), []byte(secret)) == 1
+	}
+
+	for _, token := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check reports whether secret is the password or one of the tokens. The password hash is slow by design, so the callers limit the attempts.
+func (a *Access) Check(secret string) bool {
+	if a.CheckToken(secret) {
+		return true
+	}
+
+	if secret == "" || a.IsDraft() || a.Password == "" {
+		return false
+	}
+
+	iterations, salt, hash, err := parsePasswordHash(a.Password)
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, secret, salt, iterations, len(hash))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, hash) == 1
+}
+
+// HashPassword returns the hash of the password for the access frontmatter: pbkdf2-sha256$iterations$salt$hash.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("cannot generate salt: %w", err)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeySize)
+	if err != nil {
+		return "", fmt.Errorf("cannot hash password: %w", err)
+	}
+
+	return strings.Join([]string{
+		passwordScheme,
+		strconv.Itoa(passwordIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+func parsePasswordHash(str string) (int, []byte, []byte, error) {
+	parts := strings.Split(str, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return 0, nil, nil, fmt.Errorf("password is not a %s hash", passwordScheme)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash iterations: %s", parts[1])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid password hash salt: %w", err)
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) < 1 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash: %s", parts[3])
+	}
+
+	return iterations, salt, hash, nil
+}
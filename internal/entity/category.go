@@ -0,0 +1,96 @@
+package entity
+
+import (
+	"slices"
+	"time"
+)
+
+// Category represents a folder that groups nested downloads and other categories.
+type Category struct {
+	ID          string          // Stable hash of the folder path
+	Title       string          // The folder name
+	PageContent string          // Generated listing page, empty if no item is listed at the index time
+	PageHash    string          // ETag
+	Items       []*CategoryItem // Nested downloads and categories
+	Pages       []*CategoryPage // Listing pages from the times the listed items change, in the time order
+	Windows     []Schedule      // The category is listed in any of the windows of its items, nil - always
+	SourcePath  string          // Internal path to the folder on the disk
+	CreatedAt   time.Time       // Creation time (of the first indexing)
+}
+
+// CategoryItem is a single entry of the category listing page.
+type CategoryItem struct {
+	ID      string
+	Title   string
+	Kind    string     // ShareKindDownload or ShareKindCategory
+	Windows []Schedule // The item is listed in any of the windows, nil - always
+}
+
+// CategoryPage is the listing page of the category from the time From on.
+type CategoryPage struct {
+	From    time.Time `json:"from"`
+	Content string    `json:"content,omitempty"` // Empty if no item is listed
+}
+
+// IsListed reports whether the item is listed at now.
+func (i *CategoryItem) IsListed(now time.Time) bool {
+	if i.Windows == nil {
+		return true
+	}
+
+	for _, window := range i.Windows {
+		if window.Status(now) == "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsGone reports whether all windows of the item have expired at now, so it is never listed again.
+func (i *CategoryItem) IsGone(now time.Time) bool {
+	if i.Windows == nil {
+		return false
+	}
+
+	for _, window := range i.Windows {
+		if window.Status(now) != ScheduleStatusExpired {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ListingChanges returns the sorted times after now the items are listed or unlisted at.
+func ListingChanges(items []*CategoryItem, now time.Time) []time.Time {
+	var changes []time.Time
+	for _, item := range items {
+		for _, window := range item.Windows {
+			for _, at := range []time.Time{window.PublishAt, window.ExpiresAt} {
+				if at.After(now) {
+					changes = append(changes, at)
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(changes, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	return slices.CompactFunc(changes, time.Time.Equal)
+}
+
+// CategoryContentAt returns the content of the last page that starts at or before now, or content if there is none.
+func CategoryContentAt(content string, pages []*CategoryPage, now time.Time) string {
+	for _, page := range pages {
+		if page.From.After(now) {
+			break
+		}
+
+		content = page.Content
+	}
+
+	return content
+}
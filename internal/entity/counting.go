@@ -0,0 +1,104 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	CountingModeEvery  = "every"  // Every request is counted
+	CountingModeWindow = "window" // A repeated download of the same user is counted once per window
+	CountingModeUnique = "unique" // Every user is counted once ever
+)
+
+/*
+CountingPolicy decides which downloads of a file are counted.
+The global policy is set in the config, the frontmatter of a distribution overrides any of its fields.
+*/
+type CountingPolicy struct {
+	Mode       string        `yaml:"mode" json:"mode,omitempty"`
+	Window     time.Duration `yaml:"window" json:"window,omitempty"`           // Dedup window of the window mode
+	CookieOnly *bool         `yaml:"cookie_only" json:"cookie_only,omitempty"` // Do not dedup by the fingerprint if the user has a cookie
+}
+
+// Validate checks the set fields of the policy.
+func (p *CountingPolicy) Validate() error {
+	switch p.Mode {
+	case "", CountingModeEvery, CountingModeWindow, CountingModeUnique:
+	default:
+		return fmt.Errorf("unknown counting mode: %s", p.Mode)
+	}
+
+	if p.Window < 0 {
+		return fmt.Errorf("negative counting window: %s", p.Window)
+	}
+
+	return nil
+}
+
+// Resolve returns the policy with the unset fields taken from def. p can be nil.
+func (p *CountingPolicy) Resolve(def *CountingPolicy) *CountingPolicy {
+	resolved := *def
+	if p == nil {
+		return &resolved
+	}
+
+	if p.Mode != "" {
+		resolved.Mode = p.Mode
+	}
+
+	if p.Window > 0 {
+		resolved.Window = p.Window
+	}
+
+	if p.CookieOnly != nil {
+		resolved.CookieOnly = p.CookieOnly
+	}
+
+	return &resolved
+}
+
+// IsCookieOnly reports whether the fingerprint is ignored when the user has a cookie.
+func (p *CountingPolicy) IsCookieOnly() bool {
+	return p.CookieOnly != nil && *p.CookieOnly
+}
+
+/*
+Downloader identifies the user who downloads a file. The IDs are prefixed by their kind, c: or f:.
+The downloader without IDs is anonymous: the user has asked not to be tracked, such downloads are neither deduplicated nor counted among the unique ones.
+*/
+type Downloader struct {
+	CookieID    string // Empty if the request has no valid cookie
+	Fingerprint string // Hash of the IP address and the User-Agent
+}
+
+// IsAnonymous reports whether the user cannot be identified.
+func (d *Downloader) IsAnonymous() bool {
+	return d.CookieID == "" && d.Fingerprint == ""
+}
+
+// ID returns the ID the user is counted by among the distinct downloaders, the cookie if any.
+func (d *Downloader) ID() string {
+	if d.CookieID != "" {
+		return d.CookieID
+	}
+
+	return d.Fingerprint
+}
+
+/*
+DedupIDs returns the IDs a repeated download is detected by. A download is a repeat if any of them has been seen.
+The fingerprint catches a user who has lost the cookie, but it also merges the users behind one address and browser.
+*/
+func (d *Downloader) DedupIDs(cookieOnly bool) []string {
+	var ids []string
+	if d.CookieID != "" {
+		ids = append(ids, d.CookieID)
+	}
+
+	if d.Fingerprint != "" && (d.CookieID == "" || !cookieOnly) {
+		ids = append(ids, d.Fingerprint)
+	}
+
+	return ids
+}
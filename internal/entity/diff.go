@@ -0,0 +1,32 @@
+package entity
+
+// DiffShare is a download added, removed or retitled by the index process.
+type DiffShare struct {
+	ID         string `json:"id"`
+	SourcePath string `json:"path"`
+	Title      string `json:"title,omitempty"`
+	OldTitle   string `json:"old_title,omitempty"`
+}
+
+// DiffFile is a file added or removed by the index process.
+type DiffFile struct {
+	ID         string `json:"id"`
+	DownloadID string `json:"download_id"`
+	Path       string `json:"path"`
+	Counter    int64  `json:"counter"` // The download counter, only for removed files
+}
+
+// IndexDiff is the difference between the scan result and the active version.
+type IndexDiff struct {
+	Added           []*DiffShare `json:"added,omitempty"`
+	Removed         []*DiffShare `json:"removed,omitempty"`
+	Retitled        []*DiffShare `json:"retitled,omitempty"`
+	FilesAdded      []*DiffFile  `json:"files_added,omitempty"`
+	FilesRemoved    []*DiffFile  `json:"files_removed,omitempty"`
+	CountersDeleted int          `json:"counters_deleted"` // Number of file counters that will be deleted, the counters of the active version are kept for the rollback
+}
+
+// IndexOptions are the options of the index process.
+type IndexOptions struct {
+	DryRun bool // Scan and compute the diff against the active version without saving anything
+}
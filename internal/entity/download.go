@@ -9,13 +9,64 @@ type Download struct {
 	PageContent string // HTML description from description.md
 	PageHash    string // ETag
 	Enabled     bool
-	Files       []*File   // The list of files belonging to this download
-	SourcePath  string    // Internal path to the folder on the disk
-	CreatedAt   time.Time // Creation time (of the first indexing)
+	Files       []*File         // The list of files belonging to this download
+	TotalFiles  int             // The number of files found in the folder, it is greater than len(Files) if the list was truncated
+	PageSize    int             // The number of files on a page, 0 if the file list is not paginated
+	Pages       []string        // All pages if the file list is paginated, Pages[0] is PageContent
+	SourcePath  string          // Internal path to the folder on the disk
+	CreatedAt   time.Time       // Creation time (of the first indexing)
+	Fingerprint string          // Hash of everything the page depends on, used by the incremental index
+	Unchanged   bool            // The folder has not changed since the last index, so the page was not rendered
+	Counting    *CountingPolicy // Counting policy from frontmatter, nil - the global one
+	Access      *Access         // Access restriction from frontmatter, nil - the download is public
+	Hidden      []string        // Names of the files left out of the page because they were outside their windows when it was rendered
+	Variants    []*PageVariant  // Pages rendered for the times a file window opens or closes after the index, in the time order
+}
+
+// PageVariant is the download page from the time From on, rendered without the files outside their windows at that time.
+type PageVariant struct {
+	From  time.Time `json:"from"`
+	Pages []string  `json:"pages"` // All pages of the file list, one if it is not paginated
+}
+
+// FolderState is the state of the indexed folder saved for the next incremental index.
+type FolderState struct {
+	Fingerprint string          `json:"fingerprint"`
+	Title       string          `json:"title"`
+	TotalFiles  int             `json:"total_files"`
+	Counting    *CountingPolicy `json:"counting,omitempty"`
+	Access      *Access         `json:"access,omitempty"`
+	Hidden      []string        `json:"hidden,omitempty"` // The page is rendered again when the hidden files change
 }
 
 type DownloadCounters struct {
 	ID         string        `yaml:"id"`
 	SourcePath string        `yaml:"path"`
+	Uniques    int64         `yaml:"uniques"` // Estimated number of distinct downloaders of any file
 	Files      []FileCounter `yaml:"files"`
 }
+
+/*
+PageAt returns the page of the last variant that starts at or before now, ok is false if no variant has started yet
+and the page rendered at the index time is served. The content is empty if the variant has no such page.
+*/
+func PageAt(variants []*PageVariant, page int, now time.Time) (content string, ok bool) {
+	var variant *PageVariant
+	for _, v := range variants {
+		if v.From.After(now) {
+			break
+		}
+
+		variant = v
+	}
+
+	if variant == nil {
+		return "", false
+	}
+
+	if idx := max(page, 1) - 1; idx < len(variant.Pages) {
+		content = variant.Pages[idx]
+	}
+
+	return content, true
+}
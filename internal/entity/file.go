@@ -16,4 +16,6 @@ type FileCounter struct {
 	Name       string `yaml:"name"`
 	SourcePath string `yaml:"path"`
 	Counter    int64  `yaml:"counter"`
+	Uniques    int64  `yaml:"uniques"`  // Estimated number of distinct downloaders
+	Filtered   int64  `yaml:"filtered"` // Number of downloads by bots that are not counted
 }
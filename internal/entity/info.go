@@ -1,7 +1,51 @@
 package entity
 
+const (
+	ShareKindDownload = "share"
+	ShareKindCategory = "category"
+
+	TruncatedDirs  = "dirs"
+	TruncatedFiles = "files"
+)
+
 type ShareInfo struct {
 	ID         string
+	Kind       string // ShareKindDownload or ShareKindCategory, it is also the first part of the page URL
 	SourcePath string
 	FileCount  int
 }
+
+// DraftInfo is a disabled download available only by its preview link.
+type DraftInfo struct {
+	ID         string `json:"id"`
+	SourcePath string `json:"path"`
+	Preview    string `json:"preview"` // The token of the preview link
+}
+
+// Truncation describes a folder whose content was cut by the configured limits.
+type Truncation struct {
+	SourcePath string
+	Kind       string // TruncatedDirs or TruncatedFiles
+	Limit      int
+	Total      int
+}
+
+// ScanResult is the result of the work_dir scan.
+type ScanResult struct {
+	Downloads  []*Download
+	Categories []*Category
+	Truncated  []*Truncation
+	Errors     []*FolderError
+}
+
+// IndexReport is the result of the index process.
+type IndexReport struct {
+	Shares    []*ShareInfo
+	Truncated []*Truncation
+	Errors    []*FolderError
+	Rendered  int              // Number of rendered downloads
+	Unchanged int              // Number of downloads copied from the previous version
+	Scheduled []*ScheduledItem // Downloads and files that are not published yet or have expired at the index time
+	Drafts    []*DraftInfo     // Disabled downloads with their preview tokens
+	Diff      *IndexDiff       // The changes against the active version, only for the dry run
+}
@@ -0,0 +1,53 @@
+package entity
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JobStatusRunning = "running"
+	JobStatusDone    = "done"
+	JobStatusFailed  = "failed"
+
+	SkipReasonNoFiles       = "no files"
+	SkipReasonTemplateError = "template error"
+	SkipReasonBrokenFileRef = "broken file reference"
+	SkipReasonError         = "error"
+)
+
+// FolderError is an error of a single folder that was skipped by the index process.
+type FolderError struct {
+	SourcePath string `json:"path"`
+	Reason     string `json:"reason"` // One of SkipReason*
+	Error      string `json:"error"`
+}
+
+// IndexProgress holds the counters of the running index process. The counters are updated by the scan workers.
+type IndexProgress struct {
+	Scanned  atomic.Int64 // Folders processed, including failed ones
+	Failed   atomic.Int64
+	Rendered atomic.Int64
+}
+
+// IndexJob is a single run of the index process.
+type IndexJob struct {
+	ID         string           `json:"id"`
+	Trigger    string           `json:"trigger"` // What started the job: http, signal, watcher, schedule
+	Status     string           `json:"status"`
+	DryRun     bool             `json:"dry_run,omitempty"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Duration   string           `json:"duration,omitempty"`
+	Scanned    int              `json:"scanned"`
+	Failed     int              `json:"failed"`
+	Rendered   int              `json:"rendered"`
+	Unchanged  int              `json:"unchanged"`
+	Shares     int              `json:"shares"`
+	Errors     []*FolderError   `json:"errors,omitempty"`
+	Scheduled  []*ScheduledItem `json:"scheduled,omitempty"` // Downloads and files that are not published yet or have expired
+	Drafts     []*DraftInfo     `json:"drafts,omitempty"`    // Disabled downloads with their preview tokens
+	Error      string           `json:"error,omitempty"`     // The reason the job failed
+	Diff       *IndexDiff       `json:"diff,omitempty"`      // The result of the dry run
+	Report     *IndexReport     `json:"-"`                   // Available only for the last job of the running instance
+}
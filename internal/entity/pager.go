@@ -0,0 +1,61 @@
+package entity
+
+// Pager describes the current page of a paginated file list.
+type Pager struct {
+	Page     int // Current page, starting from 1
+	Pages    int // Total number of pages
+	PageSize int // Number of files on a page
+	Total    int // Total number of files
+}
+
+func NewPager(page, pageSize, total int) *Pager {
+	return &Pager{
+		Page:     page,
+		Pages:    PageCount(pageSize, total),
+		PageSize: pageSize,
+		Total:    total,
+	}
+}
+
+// PageCount returns the number of pages needed to show total items.
+func PageCount(pageSize, total int) int {
+	if pageSize < 1 || total < 1 {
+		return 1
+	}
+
+	return (total + pageSize - 1) / pageSize
+}
+
+func (p *Pager) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p *Pager) HasNext() bool {
+	return p.Page < p.Pages
+}
+
+func (p *Pager) Prev() int {
+	return p.Page - 1
+}
+
+func (p *Pager) Next() int {
+	return p.Page + 1
+}
+
+// Numbers returns all page numbers, it is handy for range in templates.
+func (p *Pager) Numbers() []int {
+	numbers := make([]int, p.Pages)
+	for i := range numbers {
+		numbers[i] = i + 1
+	}
+
+	return numbers
+}
+
+// Bounds returns the bounds of the current page in the list of total items.
+func (p *Pager) Bounds() (int, int) {
+	start := min((p.Page-1)*p.PageSize, p.Total)
+	end := min(start+p.PageSize, p.Total)
+
+	return start, end
+}
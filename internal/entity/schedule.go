@@ -0,0 +1,50 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	ScheduleStatusPending = "pending" // The publish time has not come yet
+	ScheduleStatusExpired = "expired" // The expiration time has passed
+)
+
+// Schedule is the time window the distribution or the file is available in. A zero time does not limit the window.
+type Schedule struct {
+	PublishAt time.Time `yaml:"publish_at" json:"publish_at,omitzero"`
+	ExpiresAt time.Time `yaml:"expires_at" json:"expires_at,omitzero"`
+}
+
+// IsEmpty reports whether the window is not limited.
+func (s *Schedule) IsEmpty() bool {
+	return s.PublishAt.IsZero() && s.ExpiresAt.IsZero()
+}
+
+// Validate checks that the window ends after it starts.
+func (s *Schedule) Validate() error {
+	if !s.PublishAt.IsZero() && !s.ExpiresAt.IsZero() && !s.ExpiresAt.After(s.PublishAt) {
+		return fmt.Errorf("expires_at %s is not after publish_at %s", s.ExpiresAt.Format(time.RFC3339), s.PublishAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Status returns ScheduleStatusPending or ScheduleStatusExpired if now is outside the window, an empty string otherwise.
+func (s *Schedule) Status(now time.Time) string {
+	switch {
+	case !s.PublishAt.IsZero() && now.Before(s.PublishAt):
+		return ScheduleStatusPending
+	case !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt):
+		return ScheduleStatusExpired
+	default:
+		return ""
+	}
+}
+
+// ScheduledItem is a distribution or a file that is not available at the index time because of its schedule.
+type ScheduledItem struct {
+	SourcePath string    `json:"path"`
+	Status     string    `json:"status"` // ScheduleStatusPending or ScheduleStatusExpired
+	At         time.Time `json:"at"`     // When it is published or when it has expired
+}
@@ -0,0 +1,131 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	StatPeriodHour  = "hour"
+	StatPeriodDay   = "day"
+	StatPeriodMonth = "month"
+
+	statHourLayout  = "2006010215" // UTC, so the hour keys do not repeat on DST changes
+	statDayLayout   = "20060102"
+	statMonthLayout = "200601"
+)
+
+// StatBucket is a time bucket of the download history. Key identifies the bucket in the storage.
+type StatBucket struct {
+	Start time.Time
+	Key   string
+}
+
+// StatHistory is the download history of a distribution. Every series has a value for every point.
+type StatHistory struct {
+	ID          string             `json:"id"`
+	Period      string             `json:"period"`
+	Timezone    string             `json:"timezone"`
+	Points      []time.Time        `json:"points"`                 // Bucket start times
+	Total       []int64            `json:"total"`                  // Downloads of all distribution files
+	Files       map[string][]int64 `json:"files"`                  // Downloads of every file by file ID
+	Uniques     []int64            `json:"uniques,omitempty"`      // Distinct downloaders of the distribution, only for days and months
+	FileUniques map[string][]int64 `json:"file_uniques,omitempty"` // Distinct downloaders of every file, only for days and months
+}
+
+// UniqueHistory is the series of the distinct downloaders of a distribution and its files.
+type UniqueHistory struct {
+	Download []int64
+	Files    map[string][]int64
+}
+
+// DownloadStats are the counters of the distribution files with the estimated numbers of distinct downloaders.
+type DownloadStats struct {
+	Counters    map[string]int   `json:"counters"`
+	Uniques     int64            `json:"uniques"`      // Distinct downloaders of the distribution
+	FileUniques map[string]int64 `json:"file_uniques"` // Distinct downloaders of every file
+	Filtered    map[string]int64 `json:"filtered"`     // Downloads of every file by bots that are not counted
+}
+
+// UniquePeriods are the periods that have the distinct downloader estimates.
+var UniquePeriods = []string{StatPeriodDay, StatPeriodMonth}
+
+// ValidStatPeriod reports whether period is one of the history periods.
+func ValidStatPeriod(period string) bool {
+	switch period {
+	case StatPeriodHour, StatPeriodDay, StatPeriodMonth:
+		return true
+	}
+
+	return false
+}
+
+/*
+StatBucketKey returns the key of the bucket containing t.
+Hours are UTC hours, days and months are calendar days and months in loc.
+*/
+func StatBucketKey(period string, t time.Time, loc *time.Location) string {
+	switch period {
+	case StatPeriodHour:
+		return t.UTC().Format(statHourLayout)
+	case StatPeriodMonth:
+		return t.In(loc).Format(statMonthLayout)
+	default:
+		return t.In(loc).Format(statDayLayout)
+	}
+}
+
+// ParseStatBucketKey returns the start time of the bucket.
+func ParseStatBucketKey(period, key string, loc *time.Location) (time.Time, error) {
+	var (
+		t   time.Time
+		err error
+	)
+
+	switch period {
+	case StatPeriodHour:
+		t, err = time.Parse(statHourLayout, key)
+	case StatPeriodDay:
+		t, err = time.ParseInLocation(statDayLayout, key, loc)
+	case StatPeriodMonth:
+		t, err = time.ParseInLocation(statMonthLayout, key, loc)
+	default:
+		err = fmt.Errorf("unknown period: %s", period)
+	}
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid bucket key %s: %w", key, err)
+	}
+
+	return t, nil
+}
+
+// StatBuckets returns count buckets of the period up to the bucket containing now, the oldest first.
+func StatBuckets(period string, now time.Time, count int, loc *time.Location) []*StatBucket {
+	local := now.In(loc)
+	year, month, day := local.Date()
+
+	buckets := make([]*StatBucket, count)
+	for i := range count {
+		var start time.Time
+
+		n := count - 1 - i
+		switch period {
+		case StatPeriodHour:
+			start = now.Truncate(time.Hour).Add(-time.Duration(n) * time.Hour).In(loc)
+		case StatPeriodMonth:
+			start = time.Date(year, month-time.Month(n), 1, 0, 0, 0, 0, loc)
+		default:
+			start = time.Date(year, month, day-n, 0, 0, 0, 0, loc)
+		}
+
+		buckets[i] = &StatBucket{Start: start, Key: StatBucketKey(period, start, loc)}
+	}
+
+	return buckets
+}
+
+// StatDayEnds reports whether hour is the last hour of a day in loc, so the day can be rolled up into the month.
+func StatDayEnds(hour time.Time, loc *time.Location) bool {
+	return StatBucketKey(StatPeriodDay, hour, loc) != StatBucketKey(StatPeriodDay, hour.Add(time.Hour), loc)
+}
@@ -0,0 +1,148 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+)
+
+const (
+	ReasonUserAgent     = "user_agent"     // The User-Agent matches a bot pattern
+	ReasonDeniedAddress = "denied_address" // The address is in a deny CIDR
+	ReasonMissingHeader = "missing_header" // A required header is missing
+)
+
+//go:embed user_agents.txt
+var builtinUserAgents []byte
+
+/*
+filter decides whether a download request comes from a bot and must not be counted.
+The User-Agent patterns can be reloaded while the requests are checked.
+*/
+type filter struct {
+	cfg     *config.FilterConfig
+	agents  atomic.Pointer[regexp.Regexp] // nil if there are no patterns
+	deny    []netip.Prefix
+	headers []string
+	log     *slog.Logger
+}
+
+func NewFilter(cfg *config.FilterConfig, log *slog.Logger) (*filter, error) {
+	f := &filter{
+		cfg: cfg,
+		log: log.With(slog.String("item", "Filter")),
+	}
+
+	for _, cidr := range cfg.DenyCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny cidr %s: %w", cidr, err)
+		}
+
+		f.deny = append(f.deny, prefix.Masked())
+	}
+
+	for _, header := range cfg.RequiredHeaders {
+		f.headers = append(f.headers, http.CanonicalHeaderKey(header))
+	}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload loads the User-Agent patterns again. The previous patterns are kept if the file cannot be loaded.
+func (f *filter) Reload() error {
+	var patterns []string
+	if !f.cfg.NoBuiltin {
+		patterns = parsePatterns(builtinUserAgents)
+	}
+
+	if f.cfg.UserAgentsFile != "" {
+		data, err := os.ReadFile(f.cfg.UserAgentsFile)
+		if err != nil {
+			return fmt.Errorf("cannot read user agents file: %w", err)
+		}
+
+		patterns = append(patterns, parsePatterns(data)...)
+	}
+
+	if len(patterns) < 1 {
+		f.agents.Store(nil)
+
+		return nil
+	}
+
+	re, err := regexp.Compile("(?i)" + strings.Join(patterns, "|"))
+	if err != nil {
+		return fmt.Errorf("invalid user agent pattern: %w", err)
+	}
+
+	f.agents.Store(re)
+	f.log.Info("User agent patterns loaded", slog.Int("count", len(patterns)))
+
+	return nil
+}
+
+/*
+Check returns the reason to exclude the request from the count, or an empty string if it is counted.
+ip is the real address of the client, it is not checked if it cannot be parsed.
+*/
+func (f *filter) Check(header http.Header, ip string) string {
+	if !f.cfg.IsEnabled() {
+		return ""
+	}
+
+	for _, name := range f.headers {
+		if header.Get(name) == "" {
+			return ReasonMissingHeader
+		}
+	}
+
+	if len(f.deny) > 0 {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			addr = addr.Unmap()
+			for _, prefix := range f.deny {
+				if prefix.Contains(addr) {
+					return ReasonDeniedAddress
+				}
+			}
+		}
+	}
+
+	if re := f.agents.Load(); re != nil && re.MatchString(header.Get("User-Agent")) {
+		return ReasonUserAgent
+	}
+
+	return ""
+}
+
+// parsePatterns returns the patterns of the list, one per line. Empty lines and # comments are skipped.
+func parsePatterns(data []byte) []string {
+	var patterns []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Every pattern is a group, so an alternation inside it does not leak into the others
+		patterns = append(patterns, "(?:"+line+")")
+	}
+
+	return patterns
+}
@@ -0,0 +1,83 @@
+package filter
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+const browserUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+
+func TestFilter(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	agentsFile := filepath.Join(t.TempDir(), "agents.txt")
+	require.NoError(t, os.WriteFile(agentsFile, []byte("# Our monitoring\nmy-checker\n"), 0o644))
+
+	cfg := &config.FilterConfig{
+		UserAgentsFile:  agentsFile,
+		DenyCIDRs:       []string{"10.0.0.0/8", "2001:db8::/32"},
+		RequiredHeaders: []string{"user-agent", "Accept-Language"},
+	}
+
+	f, err := NewFilter(cfg, log)
+	require.NoError(t, err)
+
+	header := func(ua string) http.Header {
+		h := http.Header{}
+		h.Set("User-Agent", ua)
+		h.Set("Accept-Language", "en")
+
+		return h
+	}
+
+	for _, c := range []struct {
+		header http.Header
+		ip     string
+		reason string
+	}{
+		{header(browserUA), "192.0.2.1", ""},
+		{header("Mozilla/5.0 (Linux; Android 10; CUBOT X30) Chrome/126.0.0.0 Mobile Safari/537.36"), "192.0.2.1", ""},
+		{header("Mozilla/5.0 (Linux; Android 12; CUBOT_X50 Build/SP1A) Chrome/126.0.0.0 Mobile Safari/537.36"), "192.0.2.1", ""},
+		{header("okhttp/4.12.0"), "192.0.2.1", ""},
+		{header("python-requests/2.31.0"), "192.0.2.1", ""},
+		{header("Go-http-client/1.1"), "192.0.2.1", ""},
+		{header("NetMonitor/3.2 CFNetwork/1490.0.4 Darwin/23.2.0"), "192.0.2.1", ""},
+		{header("UptimeRobot/2.0; http://www.uptimerobot.com/"), "192.0.2.1", ReasonUserAgent},
+		{header("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"), "192.0.2.1", ReasonUserAgent},
+		{header("facebookexternalhit/1.1"), "192.0.2.1", ReasonUserAgent},
+		{header("Slackbot-LinkExpanding 1.0"), "192.0.2.1", ReasonUserAgent},
+		{header("sqlmap/1.8"), "192.0.2.1", ReasonUserAgent},
+		{header("My-Checker/2.0"), "192.0.2.1", ReasonUserAgent},
+		{header(browserUA), "10.1.2.3", ReasonDeniedAddress},
+		{header(browserUA), "::ffff:10.1.2.3", ReasonDeniedAddress},
+		{header(browserUA), "2001:db8::1", ReasonDeniedAddress},
+		{header(browserUA), "", ""},
+		{http.Header{"User-Agent": {browserUA}}, "192.0.2.1", ReasonMissingHeader},
+		{http.Header{}, "192.0.2.1", ReasonMissingHeader},
+	} {
+		require.Equal(t, c.reason, f.Check(c.header, c.ip), "%s %s", c.header.Get("User-Agent"), c.ip)
+	}
+
+	// A broken file keeps the loaded patterns
+	require.NoError(t, os.WriteFile(agentsFile, []byte("broken(\n"), 0o644))
+	require.Error(t, f.Reload())
+	require.Equal(t, ReasonUserAgent, f.Check(header("my-checker"), ""))
+
+	require.NoError(t, os.WriteFile(agentsFile, []byte("other-checker\n"), 0o644))
+	require.NoError(t, f.Reload())
+	require.Empty(t, f.Check(header("my-checker"), ""))
+
+	disabled := false
+	cfg.Enabled = &disabled
+	require.Empty(t, f.Check(http.Header{}, "10.1.2.3"))
+
+	_, err = NewFilter(&config.FilterConfig{DenyCIDRs: []string{"10.0.0.0"}}, log)
+	require.Error(t, err)
+}
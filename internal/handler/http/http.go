@@ -1,83 +1,325 @@
 package httphandler
 
 import (
-	"bytes"
 	"context"
+	"crypto/subtle"
+	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jgivc/fetchtracker/internal/common"
 	"github.com/jgivc/fetchtracker/internal/config"
 	"github.com/jgivc/fetchtracker/internal/entity"
-	"github.com/jgivc/fetchtracker/internal/util"
 )
 
 const (
-	downloadCookieName    = "download_token"
-	hdrUserAgent          = "User-Agent"
-	hdrContentDisposition = "Content-Disposition"
+	downloadCookieName = "download_token"
+	hdrUserAgent       = "User-Agent"
+	hdrDNT             = "DNT"
+	hdrGPC             = "Sec-GPC"
+	hdrAuthorization   = "Authorization"
+	hdrAuthenticate    = "WWW-Authenticate"
+
+	bearerPrefix = "Bearer "
 
 	prefixIDCookie      = "c" // cookie
 	prefixIDFingerpring = "f" // User-Agent + ip
+
+	paramPage    = "page"
+	paramDryRun  = "dry_run"
+	paramPeriod  = "period"
+	paramDetails = "details"
+	paramCount   = "count"
+	paramToken   = "token"
+
+	formPassword = "password"
+
+	msgTooManyAttempts = "Too many attempts, try again later"
+
+	maxHistoryCount = 1000
+
+	jobTriggerHTTP = "http"
+	jobsPath       = "/index/jobs/"
 )
 
 var (
 	idRegexp     = regexp.MustCompile(`^[a-f\d]{40}$`)
 	cookieRegexp = regexp.MustCompile(`^[a-f\d\-]{36}$`)
+	jobIDRegexp  = regexp.MustCompile(`^[a-f\d\-]{36}$`)
+
+	//go:embed templates/login.html
+	loginContent  string
+	loginTemplate = template.Must(template.New("login").Parse(loginContent))
 )
 
+// linkAccessKey marks the request context of the download by a signed link, the link grants the access by itself.
+type linkAccessKey struct{}
+
+type loginContext struct {
+	Error string
+}
+
 type PageService interface {
-	GetPage(ctx context.Context, id string) (string, error)
+	GetPage(ctx context.Context, id string, page int) (string, error)
+	GetAccess(ctx context.Context, id string) (*entity.Access, error)
+}
+
+// AddressPolicy checks the client address against the global and the distribution address rules.
+type AddressPolicy interface {
+	Allows(ip netip.Addr, access *entity.Access) bool
+}
+
+// UnpublishedWriter answers the requests of the distributions and files outside their publish window.
+type UnpublishedWriter interface {
+	Write(w http.ResponseWriter, scheduleStatus string)
+}
+
+// AccessGuard keeps the users of the password protected distributions logged in.
+type AccessGuard interface {
+	Check(r *http.Request, downloadID string, access *entity.Access) bool
+	GrantToken(w http.ResponseWriter, ip netip.Addr, downloadID string, access *entity.Access, token string) (bool, error)
+	Grant(w http.ResponseWriter, ip netip.Addr, downloadID string, access *entity.Access, secret string) (bool, error)
+}
+
+type CategoryService interface {
+	GetCategory(ctx context.Context, id string) (string, error)
 }
 
 type IndexService interface {
-	Index(ctx context.Context) ([]*entity.ShareInfo, error)
+	StartJob(trigger string, opts entity.IndexOptions) (*entity.IndexJob, error)
+	Job(ctx context.Context, id string) (*entity.IndexJob, error)
+	Jobs(ctx context.Context) ([]*entity.IndexJob, error)
+}
+
+type RollbackService interface {
+	Rollback(ctx context.Context) (string, error)
+}
+
+type rollbackResponse struct {
+	ActiveVersion string `json:"active_version"`
 }
 
 type CounterService interface {
-	GetDownloadCounters(ctx context.Context, id string) (map[string]int, error)
+	GetDownloadCounters(ctx context.Context, id string, page int) (map[string]int, error)
+	GetDownloadStats(ctx context.Context, id string, page int) (*entity.DownloadStats, error)
+	GetAccess(ctx context.Context, id string) (*entity.Access, error)
+}
+
+type HistoryService interface {
+	GetDownloadHistory(ctx context.Context, id, period string, count int) (*entity.StatHistory, error)
+	GetAccess(ctx context.Context, id string) (*entity.Access, error)
+}
+
+// defaultHistoryCounts is the number of points returned if count is not set.
+var defaultHistoryCounts = map[string]int{
+	entity.StatPeriodHour:  24,
+	entity.StatPeriodDay:   30,
+	entity.StatPeriodMonth: 12,
 }
 
 type DownloadService interface {
-	Download(ctx context.Context, id string) (string, error)
-	IncFileCounter(ctx context.Context, userID, fileID string) (int64, error)
+	Download(ctx context.Context, id string) (*entity.File, error)
+	GetFileAccess(ctx context.Context, fileID string) (string, *entity.Access, error)
+	IncFileCounter(ctx context.Context, downloader *entity.Downloader, fileID string) (int64, error)
+	CountFiltered(ctx context.Context, fileID, reason string) error
+}
+
+// RequestFilter returns the reason to exclude the download request from the count, or an empty string.
+type RequestFilter interface {
+	Check(header http.Header, ip string) string
+}
+
+// IPResolver finds the client address behind the trusted proxies.
+type IPResolver interface {
+	ClientIP(r *http.Request) netip.Addr
+	DedupIP(addr netip.Addr) netip.Addr
+}
+
+// FileSender sends the file to the client, by itself or by the web server in front.
+type FileSender interface {
+	Send(w http.ResponseWriter, r *http.Request, file *entity.File) error
+}
+
+// LinkSigner issues and checks the signed download links.
+type LinkSigner interface {
+	Sign(fileID string, ip netip.Addr, ttl time.Duration) (string, time.Time, error)
+	Verify(token string, query url.Values, ip netip.Addr) (string, error)
 }
 
-func NewIndexHandler(srv IndexService, siteURL string, log *slog.Logger) http.HandlerFunc {
+type linkResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Fingerprinter returns the ID of the user by the address and the User-Agent.
+type Fingerprinter interface {
+	Fingerprint(ctx context.Context, ip netip.Addr, userAgent string) (string, error)
+}
+
+type FilteredService interface {
+	GetFilteredReasons(ctx context.Context) (map[string]int64, error)
+}
+
+type filteredResponse struct {
+	Total   int64            `json:"total"`
+	Reasons map[string]int64 `json:"reasons"`
+}
+
+/*
+NewIndexHandler starts the index job and responds with 202 and the job. The job progress is available at /index/jobs/{id}.
+With ?dry_run=1 the job only computes the diff against the active version.
+*/
+func NewIndexHandler(srv IndexService, log *slog.Logger) http.HandlerFunc {
 	log = log.With(slog.String("handler", "IndexHandler"))
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Building...\r\n\r\n"))
-		infos, err := srv.Index(context.Background())
+		var opts entity.IndexOptions
+		if str := r.URL.Query().Get(paramDryRun); str != "" {
+			dryRun, err := strconv.ParseBool(str)
+			if err != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+
+				return
+			}
+
+			opts.DryRun = dryRun
+		}
+
+		job, err := srv.StartJob(jobTriggerHTTP, opts)
 		if err != nil {
 			switch {
 			case errors.Is(err, common.ErrIndexingProcessHasAlreadyStarted):
-				w.Write([]byte("Index process has already started.\r\n"))
+				http.Error(w, "Index process has already started", http.StatusConflict)
 			default:
-				w.Write([]byte("Cannot start index process. Something went wrong.\r\n"))
+				log.Error("Cannot start index job", slog.Any("error", err))
+				http.Error(w, "Cannot start index process", http.StatusInternalServerError)
 			}
 
 			return
 		}
 
-		buf := bytes.Buffer{}
-		for i, info := range infos {
-			buf.WriteString(fmt.Sprintf("%d. %s -> %s/share/%s, files: %d\r\n", i+1, info.SourcePath, siteURL, info.ID, info.FileCount))
+		w.Header().Set("Location", jobsPath+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	}
+}
+
+func NewJobHandler(srv IndexService, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "JobHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !jobIDRegexp.MatchString(id) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		job, err := srv.Job(context.Background(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, common.ErrJobNotFoundError):
+				http.Error(w, "Cannot find job", http.StatusNotFound)
+			default:
+				log.Error("Cannot get job", slog.String("id", id), slog.Any("error", err))
+				http.Error(w, "Cannot get job", http.StatusInternalServerError)
+			}
+
+			return
 		}
-		w.Write(buf.Bytes())
-		w.Write([]byte("\r\nDone."))
+
+		writeJSON(w, http.StatusOK, job)
 	}
 }
 
-func NewPageHandler(srv PageService, log *slog.Logger) http.HandlerFunc {
+func NewJobListHandler(srv IndexService, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "JobListHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := srv.Jobs(context.Background())
+		if err != nil {
+			log.Error("Cannot get jobs", slog.Any("error", err))
+			http.Error(w, "Cannot get jobs", http.StatusInternalServerError)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, jobs)
+	}
+}
+
+// NewRollbackHandler makes the previous version active again and responds with the version that is active now.
+func NewRollbackHandler(srv RollbackService, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "RollbackHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ver, err := srv.Rollback(context.Background())
+		if err != nil {
+			switch {
+			case errors.Is(err, common.ErrIndexingProcessHasAlreadyStarted):
+				http.Error(w, "Index process has already started", http.StatusConflict)
+			case errors.Is(err, common.ErrNoPreviousVersionError):
+				http.Error(w, "No previous version", http.StatusConflict)
+			default:
+				log.Error("Cannot rollback", slog.Any("error", err))
+				http.Error(w, "Cannot rollback", http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &rollbackResponse{ActiveVersion: ver})
+	}
+}
+
+/*
+NewAdminHandler passes the request to next only with the admin token in the Authorization: Bearer header, the others get 401.
+The index API starts and rolls back the index, so it must not be open to the users of the distributions.
+*/
+func NewAdminHandler(token string, next http.Handler, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "AdminHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := strings.CutPrefix(r.Header.Get(hdrAuthorization), bearerPrefix)
+		if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			log.Info("Unauthorized admin request", slog.String("path", r.URL.Path), slog.String("remote_addr", r.RemoteAddr))
+			w.Header().Set(hdrAuthenticate, "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+/*
+NewPageHandler serves the distribution page and sets the user cookie the repeated downloads are detected by.
+The cookie is not set in the no-cookie mode, nor if the user has asked not to be tracked and the DNT is respected.
+A protected distribution is served only to the logged in users, the others get the login form.
+A valid ?token= logs the user in and redirects to the URL without it, so the token does not stay in the logs, the Referer and the history.
+A draft is served only with its preview token, the others get 404 as if it did not exist.
+The requests from the addresses denied by the access rules get 403, the distribution outside its publish window 404 or 410.
+*/
+func NewPageHandler(cfg *config.HandlerConfig, privacy *config.PrivacyConfig, srv PageService, guard AccessGuard, resolver IPResolver, addrs AddressPolicy, unpublished UnpublishedWriter, log *slog.Logger) http.HandlerFunc {
 	log = log.With(slog.String("handler", "PageHandler"))
 
+	sameSite := map[string]http.SameSite{
+		config.CookieSameSiteStrict: http.SameSiteStrictMode,
+		config.CookieSameSiteLax:    http.SameSiteLaxMode,
+		config.CookieSameSiteNone:   http.SameSiteNoneMode,
+	}[cfg.Cookie.SameSite]
+
 	getUserID := func(r *http.Request) string {
 		cookie, err := r.Cookie(downloadCookieName)
 		if err == nil {
@@ -106,7 +348,60 @@ func NewPageHandler(srv PageService, log *slog.Logger) http.HandlerFunc {
 			return
 		}
 
-		content, err := srv.GetPage(context.Background(), id)
+		page, err := getPage(r)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		access, err := srv.GetAccess(context.Background(), id)
+		if err != nil {
+			http.Error(w, "Cannot get page", http.StatusInternalServerError)
+
+			return
+		}
+
+		ip := resolver.ClientIP(r)
+		if !allowAddress(w, ip, addrs, id, access, log) {
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, "") {
+			return
+		}
+
+		if !authorize(r, guard, id, access) {
+			var err error
+			if token := r.URL.Query().Get(paramToken); token != "" {
+				var ok bool
+				if ok, err = guard.GrantToken(w, ip, id, access, token); ok {
+					query := r.URL.Query()
+					query.Del(paramToken)
+					r.URL.RawQuery = query.Encode()
+					http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+
+					return
+				}
+			}
+
+			if hideDraft(w, unpublished, access) {
+				return
+			}
+
+			if errors.Is(err, common.ErrTooManyAttemptsError) {
+				log.Info("Too many login attempts", slog.String("id", id), slog.String("remote_addr", ip.String()))
+				writeLogin(w, http.StatusTooManyRequests, msgTooManyAttempts, log)
+
+				return
+			}
+
+			writeLogin(w, http.StatusUnauthorized, "", log)
+
+			return
+		}
+
+		content, err := srv.GetPage(context.Background(), id, page)
 		if err != nil {
 			switch {
 			case errors.Is(err, common.ErrPageNotFoundError):
@@ -118,23 +413,124 @@ func NewPageHandler(srv PageService, log *slog.Logger) http.HandlerFunc {
 			return
 		}
 
-		uid := getUserID(r)
 		cookie := http.Cookie{
 			Name:     downloadCookieName,
 			Path:     "/",
-			Value:    uid,
-			Expires:  time.Now().Add(24 * time.Hour * 365), // Cookie expires in 1 year
-			HttpOnly: true,                                 // Prevents JavaScript access (XSS protection)
-			Secure:   true,                                 // Only send over HTTPS
-			SameSite: http.SameSiteStrictMode,
+			Domain:   cfg.Cookie.Domain,
+			HttpOnly: true, // Prevents JavaScript access (XSS protection)
+			Secure:   cfg.Cookie.IsSecure(),
+			SameSite: sameSite,
+		}
+
+		switch {
+		case privacy.NoCookie:
+			// The cookie set before the mode was switched on is removed
+			if _, err := r.Cookie(downloadCookieName); err == nil {
+				cookie.MaxAge = -1
+				http.SetCookie(w, &cookie)
+			}
+		case privacy.RespectDNT && isDoNotTrack(r):
+		default:
+			cookie.Value = getUserID(r)
+			cookie.MaxAge = int(cfg.Cookie.MaxAge.Seconds())
+			http.SetCookie(w, &cookie)
 		}
-		http.SetCookie(w, &cookie)
 
 		w.Write([]byte(content))
 	}
 }
 
-func NewCounterHandler(srv CounterService, log *slog.Logger) http.HandlerFunc {
+/*
+NewLoginHandler checks the password or the access token posted by the login form of the protected distribution.
+On success the session cookie is set and the user is redirected back to the page, otherwise the form is shown again.
+*/
+func NewLoginHandler(srv PageService, guard AccessGuard, resolver IPResolver, addrs AddressPolicy, unpublished UnpublishedWriter, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "LoginHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !idRegexp.MatchString(id) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		access, err := srv.GetAccess(context.Background(), id)
+		if err != nil {
+			http.Error(w, "Cannot get page", http.StatusInternalServerError)
+
+			return
+		}
+
+		ip := resolver.ClientIP(r)
+		if !allowAddress(w, ip, addrs, id, access, log) {
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, "") {
+			return
+		}
+
+		if access != nil && access.IsProtected() {
+			ok, err := guard.Grant(w, ip, id, access, r.PostFormValue(formPassword))
+			switch {
+			case ok:
+			case hideDraft(w, unpublished, access):
+				return
+			case errors.Is(err, common.ErrTooManyAttemptsError):
+				log.Info("Too many login attempts", slog.String("id", id), slog.String("remote_addr", ip.String()))
+				writeLogin(w, http.StatusTooManyRequests, msgTooManyAttempts, log)
+
+				return
+			default:
+				log.Info("Wrong password", slog.String("id", id), slog.String("remote_addr", ip.String()))
+				writeLogin(w, http.StatusUnauthorized, "Wrong password or access token", log)
+
+				return
+			}
+		}
+
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	}
+}
+
+func NewCategoryHandler(srv CategoryService, resolver IPResolver, addrs AddressPolicy, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "CategoryHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !idRegexp.MatchString(id) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		if !allowAddress(w, resolver.ClientIP(r), addrs, id, nil, log) {
+			return
+		}
+
+		content, err := srv.GetCategory(context.Background(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, common.ErrPageNotFoundError):
+				http.Error(w, "Cannot get page", http.StatusNotFound)
+			default:
+				http.Error(w, "Cannot get page", http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		w.Write([]byte(content))
+	}
+}
+
+/*
+NewCounterHandler responds with the counters of the distribution files.
+With ?details=1 the counters are returned with the estimated numbers of distinct downloaders.
+The counters of a protected distribution are available only to the logged in users from the allowed addresses.
+*/
+func NewCounterHandler(srv CounterService, guard AccessGuard, resolver IPResolver, addrs AddressPolicy, unpublished UnpublishedWriter, log *slog.Logger) http.HandlerFunc {
 	log = log.With(slog.String("handler", "CounterHandler"))
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -145,7 +541,62 @@ func NewCounterHandler(srv CounterService, log *slog.Logger) http.HandlerFunc {
 			return
 		}
 
-		counters, err := srv.GetDownloadCounters(context.Background(), id)
+		page, err := getPage(r)
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		access, err := srv.GetAccess(context.Background(), id)
+		if err != nil {
+			http.Error(w, "Cannot get page", http.StatusInternalServerError)
+
+			return
+		}
+
+		if !allowAddress(w, resolver.ClientIP(r), addrs, id, access, log) {
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, "") {
+			return
+		}
+
+		if !authorize(r, guard, id, access) {
+			if hideDraft(w, unpublished, access) {
+				return
+			}
+
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		var details bool
+		if str := r.URL.Query().Get(paramDetails); str != "" {
+			details, err = strconv.ParseBool(str)
+			if err != nil {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		if details {
+			stats, err := srv.GetDownloadStats(context.Background(), id, page)
+			if err != nil {
+				http.Error(w, "Cannot get page", http.StatusInternalServerError)
+
+				return
+			}
+
+			writeJSON(w, http.StatusOK, stats)
+
+			return
+		}
+
+		counters, err := srv.GetDownloadCounters(context.Background(), id, page)
 		if err != nil {
 			http.Error(w, "Cannot get page", http.StatusInternalServerError)
 
@@ -159,15 +610,137 @@ func NewCounterHandler(srv CounterService, log *slog.Logger) http.HandlerFunc {
 	}
 }
 
-func NewDownloadHandler(cfg *config.HandlerConfig, srv DownloadService, log *slog.Logger) http.HandlerFunc {
+// NewFilteredHandler responds with the numbers of the downloads excluded from the count by the filter, by the reason.
+func NewFilteredHandler(srv FilteredService, resolver IPResolver, addrs AddressPolicy, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "FilteredHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowAddress(w, resolver.ClientIP(r), addrs, "", nil, log) {
+			return
+		}
+
+		reasons, err := srv.GetFilteredReasons(context.Background())
+		if err != nil {
+			log.Error("Cannot get filtered reasons", slog.Any("error", err))
+			http.Error(w, "Cannot get filtered downloads", http.StatusInternalServerError)
+
+			return
+		}
+
+		resp := &filteredResponse{Reasons: reasons}
+		for _, counter := range reasons {
+			resp.Total += counter
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+/*
+NewHistoryHandler responds with the download series of the distribution and of every its file.
+?period=hour|day|month sets the bucket size (day by default), ?count= the number of the last buckets.
+The history of a protected distribution is available only to the logged in users from the allowed addresses.
+*/
+func NewHistoryHandler(srv HistoryService, guard AccessGuard, resolver IPResolver, addrs AddressPolicy, unpublished UnpublishedWriter, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "HistoryHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !idRegexp.MatchString(id) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		period := r.URL.Query().Get(paramPeriod)
+		if period == "" {
+			period = entity.StatPeriodDay
+		}
+
+		if !entity.ValidStatPeriod(period) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		count := defaultHistoryCounts[period]
+		if str := r.URL.Query().Get(paramCount); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil || n < 1 || n > maxHistoryCount {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+
+				return
+			}
+
+			count = n
+		}
+
+		access, err := srv.GetAccess(context.Background(), id)
+		if err != nil {
+			log.Error("Cannot get access", slog.String("id", id), slog.Any("error", err))
+			http.Error(w, "Cannot get history", http.StatusInternalServerError)
+
+			return
+		}
+
+		if !allowAddress(w, resolver.ClientIP(r), addrs, id, access, log) {
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, "") {
+			return
+		}
+
+		if !authorize(r, guard, id, access) {
+			if hideDraft(w, unpublished, access) {
+				return
+			}
+
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		history, err := srv.GetDownloadHistory(context.Background(), id, period, count)
+		if err != nil {
+			switch {
+			case errors.Is(err, common.ErrPageNotFoundError):
+				http.Error(w, "Cannot find download", http.StatusNotFound)
+			default:
+				log.Error("Cannot get history", slog.String("id", id), slog.Any("error", err))
+				http.Error(w, "Cannot get history", http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, history)
+	}
+}
+
+/*
+NewDownloadHandler serves the file and counts the download.
+The requests excluded by the filter are served too, they are counted separately from the downloads.
+The download of a user who has asked not to be tracked is counted anonymously if the DNT is respected.
+A file of a protected distribution is served only to the logged in users or by a signed link, even if its ID is known.
+The downloads of a draft are served only with its preview and are counted as filtered with the preview reason.
+The downloads from the addresses denied by the access rules are refused and not counted, the signed links included.
+So are the downloads of the distributions and files outside their publish window.
+*/
+func NewDownloadHandler(privacy *config.PrivacyConfig, srv DownloadService, filter RequestFilter, resolver IPResolver, fingerprinter Fingerprinter, sender FileSender, guard AccessGuard, addrs AddressPolicy, unpublished UnpublishedWriter, log *slog.Logger) http.HandlerFunc {
 	log = log.With(slog.String("handler", "DownloadHandler"))
 
-	getUserID := func(r *http.Request) string {
+	getDownloader := func(r *http.Request, ip netip.Addr) *entity.Downloader {
+		var downloader entity.Downloader
+		if privacy.RespectDNT && isDoNotTrack(r) {
+			return &downloader
+		}
+
 		cookie, err := r.Cookie(downloadCookieName)
-		if err == nil {
+		if err == nil && !privacy.NoCookie {
 			if cookieRegexp.MatchString(cookie.Value) {
 				// log.Info("Cookie found", slog.String("cookie", cookie.Value))
-				return fmt.Sprintf("%s:%s", prefixIDCookie, cookie.Value)
+				downloader.CookieID = fmt.Sprintf("%s:%s", prefixIDCookie, cookie.Value)
 			}
 		}
 
@@ -176,12 +749,15 @@ func NewDownloadHandler(cfg *config.HandlerConfig, srv DownloadService, log *slo
 
 		}
 
-		fp := fmt.Sprintf("%s:%s", r.Header.Get(cfg.RealIPHeader), r.Header.Get(hdrUserAgent))
-		uid := util.GetIDFromString(&fp)
-
-		// log.Info("Cannot find cookie", slog.String("fingerprint", uid))
+		// The fingerprint is needed also with a cookie, the counting policy may dedup by both
+		fp, err := fingerprinter.Fingerprint(context.Background(), resolver.DedupIP(ip), r.Header.Get(hdrUserAgent))
+		if err != nil {
+			// The download is deduplicated by the cookie only, or counted anonymously
+			return &downloader
+		}
+		downloader.Fingerprint = fmt.Sprintf("%s:%s", prefixIDFingerpring, fp)
 
-		return fmt.Sprintf("%s:%s", prefixIDFingerpring, uid)
+		return &downloader
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -193,11 +769,41 @@ func NewDownloadHandler(cfg *config.HandlerConfig, srv DownloadService, log *slo
 			return
 		}
 
-		log := log.With("remote_addr", r.Header.Get(cfg.RealIPHeader), slog.String("file_id", fileID))
+		ip := resolver.ClientIP(r)
+		log := log.With(slog.String("remote_addr", ip.String()), slog.String("file_id", fileID))
 		log.Info("New download request")
 
+		downloadID, access, err := srv.GetFileAccess(context.Background(), fileID)
+		if err != nil {
+			http.Error(w, "Cannot get file", http.StatusInternalServerError)
+
+			return
+		}
+
+		if !allowAddress(w, ip, addrs, downloadID, access, log) {
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, "") {
+			log.Info("Download is not published", slog.String("download_id", downloadID))
+
+			return
+		}
+
+		if byLink, _ := r.Context().Value(linkAccessKey{}).(bool); !byLink && !authorize(r, guard, downloadID, access) {
+			log.Info("Download is forbidden", slog.String("download_id", downloadID))
+
+			if hideDraft(w, unpublished, access) {
+				return
+			}
+
+			http.Error(w, "Forbidden", http.StatusForbidden)
+
+			return
+		}
+
 		//FIXME: For errors you need to answer something to the user
-		path, err := srv.Download(context.Background(), fileID)
+		file, err := srv.Download(context.Background(), fileID)
 		if err != nil {
 			switch {
 			case errors.Is(err, common.ErrFileNotFoundError):
@@ -209,16 +815,222 @@ func NewDownloadHandler(cfg *config.HandlerConfig, srv DownloadService, log *slo
 			return
 		}
 
-		counter, err := srv.IncFileCounter(context.Background(), fmt.Sprintf("%s:%s", getUserID(r), fileID), fileID)
+		if !checkPublished(w, unpublished, access, file.Name) {
+			log.Info("File is not published", slog.String("download_id", downloadID))
+
+			return
+		}
+
+		if access.IsDraft() {
+			// The preview downloads of the authors are not counted at all
+			log.Info("Download file, preview", slog.String("id", fileID), slog.String("path", file.URL))
+		} else if reason := filter.Check(r.Header, ip.String()); reason != "" {
+			// The file is served anyway, a failed filtered counter must not break the download
+			_ = srv.CountFiltered(context.Background(), fileID, reason)
+
+			log.Info("Download file, not counted", slog.String("id", fileID), slog.String("path", file.URL), slog.String("reason", reason), slog.String("user_agent", r.Header.Get(hdrUserAgent)))
+		} else {
+			counter, err := srv.IncFileCounter(context.Background(), getDownloader(r, ip), fileID)
+			if err != nil {
+				http.Error(w, "Cannot get file", http.StatusInternalServerError)
+
+				return
+			}
+
+			log.Info("Download file", slog.String("id", fileID), slog.String("path", file.URL), slog.Int64("counter", counter))
+		}
+
+		if err := sender.Send(w, r, file); err != nil {
+			log.Error("Cannot send file", slog.String("path", file.URL), slog.Any("error", err))
+
+			switch {
+			case errors.Is(err, common.ErrFileNotFoundError):
+				http.Error(w, "Cannot find file", http.StatusNotFound)
+			default:
+				http.Error(w, "Cannot get file", http.StatusInternalServerError)
+			}
+		}
+	}
+}
+
+/*
+NewLinkHandler checks the signed link and passes the download of its file to next, the download handler.
+An invalid link is answered with 403, an expired one with 410.
+*/
+func NewLinkHandler(signer LinkSigner, resolver IPResolver, next http.Handler, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "LinkHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID, err := signer.Verify(r.PathValue("token"), r.URL.Query(), resolver.ClientIP(r))
+		if err != nil {
+			log.Info("Link is rejected", slog.String("token", r.PathValue("token")), slog.Any("error", err))
+
+			switch {
+			case errors.Is(err, common.ErrLinkExpiredError):
+				http.Error(w, "Link has expired", http.StatusGone)
+			default:
+				http.Error(w, "Invalid link", http.StatusForbidden)
+			}
+
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), linkAccessKey{}, true))
+		r.SetPathValue("id", fileID)
+		next.ServeHTTP(w, r)
+	}
+}
+
+/*
+NewIssueLinkHandler responds with a signed link to the file. The link is bound to the client address if bind_ip is set.
+The links to the files of a protected distribution are issued only to the logged in users from the allowed addresses.
+No links are issued to the files outside their publish window.
+*/
+func NewIssueLinkHandler(cfg *config.LinksConfig, baseURL string, srv DownloadService, signer LinkSigner, resolver IPResolver, guard AccessGuard, addrs AddressPolicy, unpublished UnpublishedWriter, log *slog.Logger) http.HandlerFunc {
+	log = log.With(slog.String("handler", "IssueLinkHandler"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("id")
+		if !idRegexp.MatchString(fileID) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		// The access is checked before the file is looked up, so the file IDs of a closed distribution are not revealed
+		downloadID, access, err := srv.GetFileAccess(context.Background(), fileID)
 		if err != nil {
 			http.Error(w, "Cannot get file", http.StatusInternalServerError)
 
 			return
 		}
 
-		log.Info("Download file", slog.String("id", fileID), slog.String("path", path), slog.Int64("counter", counter))
+		if !allowAddress(w, resolver.ClientIP(r), addrs, downloadID, access, log) {
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, "") {
+			return
+		}
+
+		if !authorize(r, guard, downloadID, access) {
+			if hideDraft(w, unpublished, access) {
+				return
+			}
+
+			http.Error(w, "Forbidden", http.StatusForbidden)
+
+			return
+		}
+
+		file, err := srv.Download(context.Background(), fileID)
+		if err != nil {
+			switch {
+			case errors.Is(err, common.ErrFileNotFoundError):
+				http.Error(w, "Cannot find file", http.StatusNotFound)
+			default:
+				http.Error(w, "Cannot get file", http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		if !checkPublished(w, unpublished, access, file.Name) {
+			return
+		}
+
+		var ip netip.Addr
+		if cfg.BindIP {
+			ip = resolver.ClientIP(r)
+		}
+
+		link, expiresAt, err := signer.Sign(fileID, ip, cfg.TTL)
+		if err != nil {
+			log.Error("Cannot sign link", slog.String("file_id", fileID), slog.Any("error", err))
+			http.Error(w, "Cannot sign link", http.StatusInternalServerError)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &linkResponse{URL: baseURL + link, ExpiresAt: expiresAt})
+	}
+}
+
+// authorize reports whether the user may access the download, the protected one needs a session.
+func authorize(r *http.Request, guard AccessGuard, downloadID string, access *entity.Access) bool {
+	return access == nil || !access.IsProtected() || guard.Check(r, downloadID, access)
+}
+
+// allowAddress responds with 403 and returns false if the client address is denied by the access rules.
+func allowAddress(w http.ResponseWriter, ip netip.Addr, addrs AddressPolicy, downloadID string, access *entity.Access, log *slog.Logger) bool {
+	if addrs.Allows(ip, access) {
+		return true
+	}
+
+	log.Info("Address is denied", slog.String("remote_addr", ip.String()), slog.String("download_id", downloadID))
+	http.Error(w, "Forbidden", http.StatusForbidden)
+
+	return false
+}
+
+// checkPublished answers with the unpublished page and returns false if the download or its file is outside the publish window.
+func checkPublished(w http.ResponseWriter, unpublished UnpublishedWriter, access *entity.Access, fileName string) bool {
+	status := access.Status(fileName, time.Now())
+	if status == "" {
+		return true
+	}
+
+	unpublished.Write(w, status)
+
+	return false
+}
+
+// hideDraft answers 404 to the user without the preview of the draft, so the draft looks like it does not exist. It returns false for the other downloads.
+func hideDraft(w http.ResponseWriter, unpublished UnpublishedWriter, access *entity.Access) bool {
+	if !access.IsDraft() {
+		return false
+	}
+
+	unpublished.Write(w, entity.ScheduleStatusPending)
+
+	return true
+}
+
+// writeLogin responds with the login form of the protected distribution.
+func writeLogin(w http.ResponseWriter, status int, message string, log *slog.Logger) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := loginTemplate.Execute(w, &loginContext{Error: message}); err != nil {
+		log.Error("Cannot write login form", slog.Any("error", err))
+	}
+}
+
+// isDoNotTrack reports whether the user has asked not to be tracked by the DNT or the Global Privacy Control header.
+func isDoNotTrack(r *http.Request) bool {
+	return r.Header.Get(hdrDNT) == "1" || r.Header.Get(hdrGPC) == "1"
+}
+
+// getPage returns the page number from the query string, 0 if it is not set.
+func getPage(r *http.Request) (int, error) {
+	str := r.URL.Query().Get(paramPage)
+	if str == "" {
+		return 0, nil
+	}
+
+	page, err := strconv.Atoi(str)
+	if err != nil || page < 1 {
+		return 0, fmt.Errorf("invalid page number: %s", str)
+	}
+
+	return page, nil
+}
 
-		w.Header().Set(hdrContentDisposition, "attachment") // Download instead view (for .pdf, etc)
-		w.Header().Set(cfg.RedirectHeader, path)
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,427 @@
+package httphandler
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/jgivc/fetchtracker/internal/iprules"
+	"github.com/jgivc/fetchtracker/internal/link"
+	"github.com/jgivc/fetchtracker/internal/realip"
+	"github.com/jgivc/fetchtracker/internal/session"
+	"github.com/jgivc/fetchtracker/internal/statuspage"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	publicID    = "1000000000000000000000000000000000000000"
+	protectedID = "2000000000000000000000000000000000000000"
+	officeID    = "3000000000000000000000000000000000000000"
+
+	publicFileID    = "a100000000000000000000000000000000000000"
+	protectedFileID = "a200000000000000000000000000000000000000"
+	officeFileID    = "a300000000000000000000000000000000000000"
+	unknownFileID   = "afff000000000000000000000000000000000000"
+
+	clientAddr = "192.0.2.1:1234"
+)
+
+type testDownload struct {
+	access *entity.Access
+	page   string
+	files  []*entity.File
+}
+
+// testService serves the downloads from memory and records the counted downloads.
+type testService struct {
+	downloads map[string]*testDownload
+	counted   []string
+}
+
+func (s *testService) GetPage(_ context.Context, id string, _ int) (string, error) {
+	d, ok := s.downloads[id]
+	if !ok {
+		return "", common.ErrPageNotFoundError
+	}
+
+	return d.page, nil
+}
+
+func (s *testService) GetAccess(_ context.Context, id string) (*entity.Access, error) {
+	if d, ok := s.downloads[id]; ok {
+		return d.access, nil
+	}
+
+	return nil, nil
+}
+
+func (s *testService) GetDownloadCounters(_ context.Context, id string, _ int) (map[string]int, error) {
+	d, ok := s.downloads[id]
+	if !ok {
+		return nil, common.ErrPageNotFoundError
+	}
+
+	counters := make(map[string]int)
+	for _, file := range d.files {
+		counters[file.ID] = 0
+	}
+
+	return counters, nil
+}
+
+func (s *testService) GetDownloadStats(_ context.Context, id string, _ int) (*entity.DownloadStats, error) {
+	return &entity.DownloadStats{}, nil
+}
+
+func (s *testService) find(fileID string) (string, *testDownload, *entity.File) {
+	for id, d := range s.downloads {
+		for _, file := range d.files {
+			if file.ID == fileID {
+				return id, d, file
+			}
+		}
+	}
+
+	return "", nil, nil
+}
+
+func (s *testService) Download(_ context.Context, fileID string) (*entity.File, error) {
+	if _, _, file := s.find(fileID); file != nil {
+		return file, nil
+	}
+
+	return nil, common.ErrFileNotFoundError
+}
+
+func (s *testService) GetFileAccess(_ context.Context, fileID string) (string, *entity.Access, error) {
+	if id, d, _ := s.find(fileID); d != nil {
+		return id, d.access, nil
+	}
+
+	return "", nil, nil
+}
+
+func (s *testService) IncFileCounter(_ context.Context, _ *entity.Downloader, fileID string) (int64, error) {
+	s.counted = append(s.counted, fileID)
+
+	return int64(len(s.counted)), nil
+}
+
+func (s *testService) CountFiltered(context.Context, string, string) error {
+	return nil
+}
+
+type testFilter struct{}
+
+func (testFilter) Check(http.Header, string) string {
+	return ""
+}
+
+type testFingerprinter struct{}
+
+func (testFingerprinter) Fingerprint(context.Context, netip.Addr, string) (string, error) {
+	return "fingerprint", nil
+}
+
+type testSender struct{}
+
+func (testSender) Send(w http.ResponseWriter, _ *http.Request, file *entity.File) error {
+	_, err := w.Write([]byte(file.URL))
+
+	return err
+}
+
+// newTestServer registers the handlers the way the app does and returns the server with the link signer.
+func newTestServer(t *testing.T, srv *testService) (http.Handler, LinkSigner) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	cfg := &config.HandlerConfig{URL: "http://example.com"}
+	privacy := &config.PrivacyConfig{}
+	links := &config.LinksConfig{Secret: "link-secret", TTL: time.Hour}
+
+	resolver, err := realip.NewResolver(cfg)
+	require.NoError(t, err)
+
+	guard, err := session.NewSessions(&config.AccessConfig{
+		Secret:     "access-secret",
+		SessionTTL: time.Hour,
+		LoginLimit: config.LoginLimitConfig{PerAddress: 100, PerDistribution: 100, Window: time.Minute},
+	}, &cfg.Cookie)
+	require.NoError(t, err)
+
+	addrs, err := iprules.NewPolicy(&entity.AddressRules{})
+	require.NoError(t, err)
+
+	unpublished, err := statuspage.NewPages(&config.UnpublishedConfig{ExpiredStatus: http.StatusGone})
+	require.NoError(t, err)
+
+	signer := link.NewSigner(links)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /share/{id}/{$}", NewPageHandler(cfg, privacy, srv, guard, resolver, addrs, unpublished, log))
+	mux.Handle("POST /share/{id}/{$}", NewLoginHandler(srv, guard, resolver, addrs, unpublished, log))
+	mux.Handle("GET /stat/{id}/{$}", NewCounterHandler(srv, guard, resolver, addrs, unpublished, log))
+	downloadHandler := NewDownloadHandler(privacy, srv, testFilter{}, resolver, testFingerprinter{}, testSender{}, guard, addrs, unpublished, log)
+	mux.Handle("POST /file/{id}/{$}", downloadHandler)
+	mux.Handle("GET "+link.PathPrefix+"{token}", NewLinkHandler(signer, resolver, downloadHandler, log))
+	mux.Handle("GET /link/{id}/{$}", NewIssueLinkHandler(links, cfg.URL, srv, signer, resolver, guard, addrs, unpublished, log))
+
+	return mux, signer
+}
+
+// serve sends the request with the cookies and returns the response.
+func serve(h http.Handler, method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = clientAddr
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w
+}
+
+func newTestService() *testService {
+	return &testService{downloads: map[string]*testDownload{
+		publicID: {
+			page:  "public page",
+			files: []*entity.File{{ID: publicFileID, Name: "public.txt", URL: "/data/public.txt"}},
+		},
+		protectedID: {
+			access: &entity.Access{Tokens: []string{"token"}},
+			page:   "protected page",
+			files:  []*entity.File{{ID: protectedFileID, Name: "protected.txt", URL: "/data/protected.txt"}},
+		},
+		officeID: {
+			access: &entity.Access{AddressRules: entity.AddressRules{Allow: []string{"10.0.0.0/8"}}},
+			page:   "office page",
+			files:  []*entity.File{{ID: officeFileID, Name: "office.txt", URL: "/data/office.txt"}},
+		},
+	}}
+}
+
+func TestLinks(t *testing.T) {
+	srv := newTestService()
+	h, signer := newTestServer(t, srv)
+
+	w := serve(h, http.MethodGet, "/link/"+publicFileID+"/", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"url":"http://example.com`+link.PathPrefix+publicFileID+".")
+
+	// The closed files are refused before the file is looked up
+	require.Equal(t, http.StatusNotFound, serve(h, http.MethodGet, "/link/"+unknownFileID+"/", nil).Code)
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, "/link/"+protectedFileID+"/", nil).Code)
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, "/link/"+officeFileID+"/", nil).Code)
+	require.Equal(t, http.StatusBadRequest, serve(h, http.MethodGet, "/link/bad/", nil).Code)
+
+	// The file of a protected distribution is not served by a guessed ID, but by a signed link
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodPost, "/file/"+protectedFileID+"/", url.Values{}).Code)
+	require.Empty(t, srv.counted)
+
+	path, _, err := signer.Sign(protectedFileID, netip.Addr{}, time.Hour)
+	require.NoError(t, err)
+
+	w = serve(h, http.MethodGet, path, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "/data/protected.txt", w.Body.String())
+	require.Equal(t, []string{protectedFileID}, srv.counted)
+
+	// The link does not widen the address rules
+	path, _, err = signer.Sign(officeFileID, netip.Addr{}, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, path, nil).Code)
+
+	path, _, err = signer.Sign(publicFileID, netip.Addr{}, -time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, serve(h, http.MethodGet, path, nil).Code)
+
+	path = strings.Replace(path, publicFileID, protectedFileID, 1)
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, path, nil).Code, "forged link")
+}
+
+func TestProtected(t *testing.T) {
+	srv := newTestService()
+	h, _ := newTestServer(t, srv)
+
+	w := serve(h, http.MethodGet, "/share/"+publicID+"/", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "public page", w.Body.String())
+
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, "/share/"+officeID+"/", nil).Code)
+
+	w = serve(h, http.MethodGet, "/share/"+protectedID+"/", nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.NotContains(t, w.Body.String(), "protected page")
+	require.Equal(t, http.StatusUnauthorized, serve(h, http.MethodGet, "/share/"+protectedID+"/?token=wrong", nil).Code)
+	require.Equal(t, http.StatusUnauthorized, serve(h, http.MethodGet, "/stat/"+protectedID+"/", nil).Code)
+	require.Equal(t, http.StatusForbidden, serve(h, http.MethodPost, "/file/"+protectedFileID+"/", url.Values{}).Code)
+
+	// The query token logs in and is dropped from the URL
+	w = serve(h, http.MethodGet, "/share/"+protectedID+"/?page=1&token=token", nil)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/share/"+protectedID+"/?page=1", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	w = serve(h, http.MethodGet, "/share/"+protectedID+"/", nil, cookies...)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "protected page", w.Body.String())
+	require.Equal(t, http.StatusOK, serve(h, http.MethodGet, "/stat/"+protectedID+"/", nil, cookies...).Code)
+
+	w = serve(h, http.MethodPost, "/file/"+protectedFileID+"/", url.Values{}, cookies...)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []string{protectedFileID}, srv.counted)
+
+	// The session of one distribution does not open another one
+	srv.downloads[publicID].access = &entity.Access{Tokens: []string{"other"}}
+	require.Equal(t, http.StatusUnauthorized, serve(h, http.MethodGet, "/share/"+publicID+"/", nil, cookies...).Code)
+
+	// The login form
+	w = serve(h, http.MethodPost, "/share/"+protectedID+"/", url.Values{formPassword: {"wrong"}})
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Empty(t, w.Result().Cookies())
+
+	w = serve(h, http.MethodPost, "/share/"+protectedID+"/", url.Values{formPassword: {"token"}})
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/share/"+protectedID+"/", w.Header().Get("Location"))
+	require.Equal(t, http.StatusOK, serve(h, http.MethodGet, "/share/"+protectedID+"/", nil, w.Result().Cookies()...).Code)
+
+	// A changed token ends the session
+	srv.downloads[protectedID].access = &entity.Access{Tokens: []string{"new"}}
+	require.Equal(t, http.StatusUnauthorized, serve(h, http.MethodGet, "/share/"+protectedID+"/", nil, cookies...).Code)
+}
+
+func TestUnpublished(t *testing.T) {
+	const (
+		pendingID = "4000000000000000000000000000000000000000"
+		expiredID = "5000000000000000000000000000000000000000"
+
+		pendingFileID = "a400000000000000000000000000000000000000"
+		expiredFileID = "a500000000000000000000000000000000000000"
+		oldFileID     = "a600000000000000000000000000000000000000"
+	)
+
+	now := time.Now()
+
+	srv := newTestService()
+	srv.downloads[pendingID] = &testDownload{
+		access: &entity.Access{Schedule: entity.Schedule{PublishAt: now.Add(time.Hour)}},
+		page:   "pending page",
+		files:  []*entity.File{{ID: pendingFileID, Name: "pending.txt", URL: "/data/pending.txt"}},
+	}
+	srv.downloads[expiredID] = &testDownload{
+		access: &entity.Access{Schedule: entity.Schedule{ExpiresAt: now.Add(-time.Hour)}},
+		page:   "expired page",
+		files:  []*entity.File{{ID: expiredFileID, Name: "expired.txt", URL: "/data/expired.txt"}},
+	}
+	srv.downloads[publicID].access = &entity.Access{Files: map[string]entity.Schedule{"old.txt": {ExpiresAt: now.Add(-time.Minute)}}}
+	srv.downloads[publicID].files = append(srv.downloads[publicID].files, &entity.File{ID: oldFileID, Name: "old.txt", URL: "/data/old.txt"})
+
+	h, signer := newTestServer(t, srv)
+
+	for _, c := range []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/share/" + pendingID + "/", http.StatusNotFound},
+		{http.MethodGet, "/share/" + expiredID + "/", http.StatusGone},
+		{http.MethodGet, "/stat/" + pendingID + "/", http.StatusNotFound},
+		{http.MethodGet, "/stat/" + expiredID + "/", http.StatusGone},
+		{http.MethodPost, "/file/" + pendingFileID + "/", http.StatusNotFound},
+		{http.MethodPost, "/file/" + expiredFileID + "/", http.StatusGone},
+		{http.MethodGet, "/link/" + pendingFileID + "/", http.StatusNotFound},
+		{http.MethodGet, "/link/" + expiredFileID + "/", http.StatusGone},
+		// The distribution is published, its file has expired
+		{http.MethodGet, "/share/" + publicID + "/", http.StatusOK},
+		{http.MethodPost, "/file/" + publicFileID + "/", http.StatusOK},
+		{http.MethodPost, "/file/" + oldFileID + "/", http.StatusGone},
+		{http.MethodGet, "/link/" + oldFileID + "/", http.StatusGone},
+	} {
+		var form url.Values
+		if c.method == http.MethodPost {
+			form = url.Values{}
+		}
+
+		require.Equal(t, c.status, serve(h, c.method, c.target, form).Code, "%s %s", c.method, c.target)
+	}
+
+	// The link issued before the file has expired does not serve it either
+	path, _, err := signer.Sign(oldFileID, netip.Addr{}, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusGone, serve(h, http.MethodGet, path, nil).Code)
+
+	require.Equal(t, []string{publicFileID}, srv.counted)
+}
+
+func TestDraft(t *testing.T) {
+	const (
+		draftID     = "6000000000000000000000000000000000000000"
+		draftFileID = "a700000000000000000000000000000000000000"
+	)
+
+	srv := newTestService()
+	srv.downloads[draftID] = &testDownload{
+		access: &entity.Access{Tokens: []string{"token"}, Preview: "preview"},
+		page:   "draft page",
+		files:  []*entity.File{{ID: draftFileID, Name: "draft.txt", URL: "/data/draft.txt"}},
+	}
+
+	h, _ := newTestServer(t, srv)
+
+	// The draft looks like it does not exist, its tokens are not accepted until it is published
+	for _, c := range []struct {
+		method string
+		target string
+		form   url.Values
+	}{
+		{http.MethodGet, "/share/" + draftID + "/", nil},
+		{http.MethodGet, "/share/" + draftID + "/?token=token", nil},
+		{http.MethodPost, "/share/" + draftID + "/", url.Values{formPassword: {"token"}}},
+		{http.MethodGet, "/stat/" + draftID + "/", nil},
+		{http.MethodPost, "/file/" + draftFileID + "/", url.Values{}},
+		{http.MethodGet, "/link/" + draftFileID + "/", nil},
+	} {
+		w := serve(h, c.method, c.target, c.form)
+		require.Equal(t, http.StatusNotFound, w.Code, "%s %s", c.method, c.target)
+		require.Empty(t, w.Result().Cookies(), "%s %s", c.method, c.target)
+	}
+
+	// The preview link opens the draft for its authors
+	w := serve(h, http.MethodGet, "/share/"+draftID+"/?token=preview", nil)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "/share/"+draftID+"/", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+
+	w = serve(h, http.MethodGet, "/share/"+draftID+"/", nil, cookies...)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "draft page", w.Body.String())
+	require.Equal(t, http.StatusOK, serve(h, http.MethodGet, "/link/"+draftFileID+"/", nil, cookies...).Code)
+
+	// The preview downloads are not counted
+	w = serve(h, http.MethodPost, "/file/"+draftFileID+"/", url.Values{}, cookies...)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "/data/draft.txt", w.Body.String())
+	require.Empty(t, srv.counted)
+}
@@ -0,0 +1,119 @@
+package iprules
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+type rules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+/*
+policy checks the client address against the global rules of the config and the rules of the distribution.
+The address must pass both, so a distribution can narrow the global rules but not widen them.
+The parsed rules of the distributions are cached by their CIDRs, a broken one is cached as nil.
+*/
+type policy struct {
+	global *rules
+	cache  sync.Map
+}
+
+func NewPolicy(global *entity.AddressRules) (*policy, error) {
+	r, err := parseRules(global)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy{global: r}, nil
+}
+
+// Allows reports whether the address may access the distribution, access is nil for a public one.
+func (p *policy) Allows(ip netip.Addr, access *entity.Access) bool {
+	if !p.global.allows(ip) {
+		return false
+	}
+
+	if access == nil || access.AddressRules.IsEmpty() {
+		return true
+	}
+
+	r := p.rules(&access.AddressRules)
+	if r == nil {
+		// The rules are checked by the indexer, a broken one denies rather than opens the distribution
+		return false
+	}
+
+	return r.allows(ip)
+}
+
+func (p *policy) rules(ar *entity.AddressRules) *rules {
+	key := strings.Join(ar.Allow, ",") + "|" + strings.Join(ar.Deny, ",")
+	if v, ok := p.cache.Load(key); ok {
+		return v.(*rules)
+	}
+
+	// A broken rule set is parsed to nil
+	r, _ := parseRules(ar)
+	p.cache.Store(key, r)
+
+	return r
+}
+
+func (r *rules) allows(ip netip.Addr) bool {
+	if len(r.allow) < 1 && len(r.deny) < 1 {
+		return true
+	}
+
+	if !ip.IsValid() {
+		return false
+	}
+
+	ip = ip.Unmap()
+
+	for _, prefix := range r.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(r.allow) < 1 {
+		return true
+	}
+
+	for _, prefix := range r.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseRules(ar *entity.AddressRules) (*rules, error) {
+	r := &rules{}
+
+	for _, c := range []struct {
+		cidrs []string
+		dst   *[]netip.Prefix
+	}{
+		{ar.Allow, &r.allow},
+		{ar.Deny, &r.deny},
+	} {
+		for _, cidr := range c.cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %s: %w", cidr, err)
+			}
+
+			*c.dst = append(*c.dst, prefix.Masked())
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,61 @@
+package iprules
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	_, err := NewPolicy(&entity.AddressRules{Allow: []string{"10.0.0.1"}})
+	require.Error(t, err, "a bare address is not a cidr")
+
+	open, err := NewPolicy(&entity.AddressRules{})
+	require.NoError(t, err)
+
+	p, err := NewPolicy(&entity.AddressRules{Deny: []string{"198.51.100.0/24"}})
+	require.NoError(t, err)
+
+	office := &entity.Access{AddressRules: entity.AddressRules{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.0.99.0/24"},
+	}}
+	tokens := &entity.Access{Tokens: []string{"token"}}
+	broken := &entity.Access{AddressRules: entity.AddressRules{Allow: []string{"10.0.0.0/33"}}}
+
+	for _, c := range []struct {
+		policy *policy
+		ip     string
+		access *entity.Access
+		want   bool
+	}{
+		{open, "192.0.2.1", nil, true},
+		{open, "", nil, true},
+		{open, "10.1.2.3", office, true},
+		{open, "::ffff:10.1.2.3", office, true},
+		{open, "2001:db8::1", office, true},
+		{open, "10.0.99.1", office, false},
+		{open, "192.0.2.1", office, false},
+		{open, "", office, false},
+		{open, "192.0.2.1", tokens, true},
+		{open, "10.1.2.3", broken, false},
+		{p, "192.0.2.1", nil, true},
+		{p, "198.51.100.7", nil, false},
+		{p, "198.51.100.7", tokens, false},
+		{p, "", nil, false},
+	} {
+		var ip netip.Addr
+		if c.ip != "" {
+			ip = netip.MustParseAddr(c.ip)
+		}
+
+		require.Equal(t, c.want, c.policy.Allows(ip, c.access), "%s %+v", c.ip, c.access)
+		// The second check uses the cached rules
+		require.Equal(t, c.want, c.policy.Allows(ip, c.access), "%s %+v", c.ip, c.access)
+	}
+
+	_, ok := open.cache.Load("10.0.0.0/33|")
+	require.True(t, ok, "the broken rules are cached")
+}
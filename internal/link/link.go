@@ -0,0 +1,132 @@
+package link
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+)
+
+const (
+	PathPrefix = "/d/" // The signed links are served under it
+
+	paramMD5     = "md5"
+	paramExpires = "expires"
+
+	tokenSeparator = "."
+	signatureSize  = 16
+)
+
+/*
+signer issues and checks the signed download links. A link carries the file ID, the expiration time and the signature,
+the signature of a link bound to the client address covers the address too.
+The link is /d/<file_id>.<expires>.<signature>, or /d/<file_id>?md5=<hash>&expires=<expires> in the nginx secure_link mode.
+*/
+type signer struct {
+	cfg *config.LinksConfig
+	now func() time.Time
+}
+
+func NewSigner(cfg *config.LinksConfig) *signer {
+	return &signer{
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+/*
+Sign returns the path of the link to the file valid for ttl and its expiration time. The link is bound to ip if it is valid.
+In the secure_link mode the binding is set by bind_ip for all links, so ip is required if it is set and ignored otherwise.
+*/
+func (s *signer) Sign(fileID string, ip netip.Addr, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := s.now().Add(ttl).Truncate(time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	if !s.cfg.SecureLink {
+		token := strings.Join([]string{fileID, expires, s.signature(fileID, expires, ip)}, tokenSeparator)
+
+		return PathPrefix + token, expiresAt, nil
+	}
+
+	if s.cfg.BindIP && !ip.IsValid() {
+		return "", time.Time{}, fmt.Errorf("client address is required by bind_ip")
+	}
+
+	uri := PathPrefix + fileID
+	query := url.Values{paramMD5: {s.secureLinkHash(uri, expires, ip)}, paramExpires: {expires}}
+
+	return uri + "?" + query.Encode(), expiresAt, nil
+}
+
+/*
+Verify returns the file ID of the link requested from ip. token is the last path element, query is the query of the link.
+It returns common.ErrInvalidLinkError if the signature does not match and common.ErrLinkExpiredError if the link has expired.
+*/
+func (s *signer) Verify(token string, query url.Values, ip netip.Addr) (string, error) {
+	var (
+		fileID, expires string
+		valid           bool
+	)
+
+	if s.cfg.SecureLink {
+		fileID, expires = token, query.Get(paramExpires)
+		valid = hmac.Equal([]byte(query.Get(paramMD5)), []byte(s.secureLinkHash(PathPrefix+fileID, expires, ip)))
+	} else {
+		parts := strings.Split(token, tokenSeparator)
+		if len(parts) != 3 {
+			return "", common.ErrInvalidLinkError
+		}
+
+		fileID, expires = parts[0], parts[1]
+		// The link is bound or not, the signature tells which
+		valid = hmac.Equal([]byte(parts[2]), []byte(s.signature(fileID, expires, netip.Addr{}))) ||
+			ip.IsValid() && hmac.Equal([]byte(parts[2]), []byte(s.signature(fileID, expires, ip)))
+	}
+
+	if !valid {
+		return "", common.ErrInvalidLinkError
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", common.ErrInvalidLinkError
+	}
+
+	if s.now().Unix() > expiresAt {
+		return "", common.ErrLinkExpiredError
+	}
+
+	return fileID, nil
+}
+
+// signature returns the truncated HMAC-SHA256 of the link fields.
+func (s *signer) signature(fileID, expires string, ip netip.Addr) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg.Secret))
+	mac.Write([]byte(fileID + tokenSeparator + expires))
+	if ip.IsValid() {
+		mac.Write([]byte(tokenSeparator + ip.String()))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:signatureSize])
+}
+
+// secureLinkHash returns the hash of secure_link_md5 "$secure_link_expires$uri$remote_addr <secret>", without the address if the links are not bound.
+func (s *signer) secureLinkHash(uri, expires string, ip netip.Addr) string {
+	str := expires + uri
+	if s.cfg.BindIP {
+		str += ip.String()
+	}
+
+	sum := md5.Sum([]byte(str + " " + s.cfg.Secret))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,95 @@
+package link
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+const fileID = "0123456789abcdef0123456789abcdef01234567"
+
+func TestSigner(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+
+	s := NewSigner(&config.LinksConfig{Secret: "secret"})
+	s.now = func() time.Time { return now }
+
+	verify := func(path string, ip netip.Addr) (string, error) {
+		u, err := url.Parse(path)
+		require.NoError(t, err)
+
+		return s.Verify(strings.TrimPrefix(u.Path, PathPrefix), u.Query(), ip)
+	}
+
+	path, expiresAt, err := s.Sign(fileID, netip.Addr{}, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Hour), expiresAt)
+	require.True(t, strings.HasPrefix(path, PathPrefix+fileID+".1700003600."))
+
+	id, err := verify(path, other)
+	require.NoError(t, err)
+	require.Equal(t, fileID, id, "an unbound link is valid from any address")
+
+	bound, _, err := s.Sign(fileID, client, time.Hour)
+	require.NoError(t, err)
+
+	_, err = verify(bound, client)
+	require.NoError(t, err)
+
+	_, err = verify(bound, other)
+	require.ErrorIs(t, err, common.ErrInvalidLinkError)
+
+	for _, tampered := range []string{
+		strings.Replace(path, fileID, strings.Repeat("f", 40), 1),
+		strings.Replace(path, ".1700003600.", ".1800003600.", 1),
+		path + "x",
+		PathPrefix + fileID,
+	} {
+		_, err = verify(tampered, client)
+		require.ErrorIs(t, err, common.ErrInvalidLinkError, tampered)
+	}
+
+	s.now = func() time.Time { return now.Add(2 * time.Hour) }
+	_, err = verify(path, client)
+	require.ErrorIs(t, err, common.ErrLinkExpiredError)
+}
+
+func TestSecureLink(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddr("192.0.2.1")
+
+	s := NewSigner(&config.LinksConfig{Secret: "secret", SecureLink: true, BindIP: true})
+	s.now = func() time.Time { return now }
+
+	_, _, err := s.Sign(fileID, netip.Addr{}, time.Hour)
+	require.Error(t, err, "the address is required by bind_ip")
+
+	path, _, err := s.Sign(fileID, client, time.Hour)
+	require.NoError(t, err)
+
+	u, err := url.Parse(path)
+	require.NoError(t, err)
+	require.Equal(t, PathPrefix+fileID, u.Path)
+	require.Equal(t, "1700003600", u.Query().Get("expires"))
+
+	// The hash nginx computes by secure_link_md5 "$secure_link_expires$uri$remote_addr secret"
+	sum := md5.Sum([]byte("1700003600" + PathPrefix + fileID + "192.0.2.1 secret"))
+	require.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), u.Query().Get("md5"))
+
+	id, err := s.Verify(fileID, u.Query(), client)
+	require.NoError(t, err)
+	require.Equal(t, fileID, id)
+
+	_, err = s.Verify(fileID, u.Query(), netip.MustParseAddr("192.0.2.2"))
+	require.ErrorIs(t, err, common.ErrInvalidLinkError)
+}
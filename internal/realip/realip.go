@@ -0,0 +1,163 @@
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+)
+
+const (
+	hdrForwarded     = "Forwarded"
+	hdrXForwardedFor = "X-Forwarded-For"
+)
+
+/*
+resolver finds the address of the client behind the trusted proxies.
+The header is used only if the request comes from a trusted proxy, otherwise anyone could set any address.
+*/
+type resolver struct {
+	header     string
+	trusted    []netip.Prefix
+	ipv6Prefix int
+}
+
+func NewResolver(cfg *config.HandlerConfig) (*resolver, error) {
+	r := &resolver{
+		header:     http.CanonicalHeaderKey(cfg.RealIPHeader),
+		ipv6Prefix: cfg.IPv6Prefix,
+	}
+
+	for _, cidr := range cfg.TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %w", cidr, err)
+		}
+
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+
+	return r, nil
+}
+
+/*
+ClientIP returns the address of the client. The address of the peer is returned if it is not a trusted proxy.
+The X-Forwarded-For and Forwarded headers are read from right to left, the first address that is not a trusted proxy is the client.
+The result is invalid if the peer address cannot be parsed.
+*/
+func (r *resolver) ClientIP(req *http.Request) netip.Addr {
+	peer := parseAddr(req.RemoteAddr)
+	if !r.isTrusted(peer) {
+		return peer
+	}
+
+	var hops []string
+	switch r.header {
+	case hdrXForwardedFor:
+		hops = splitValues(req.Header.Values(hdrXForwardedFor))
+	case hdrForwarded:
+		hops = forwardedFor(req.Header.Values(hdrForwarded))
+	default:
+		hops = req.Header.Values(r.header)
+		if len(hops) > 1 {
+			// A single address header set twice has been forged
+			return peer
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr := parseAddr(hops[i])
+		if !addr.IsValid() {
+			break
+		}
+
+		client = addr
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+
+	return client
+}
+
+// DedupIP returns the address the client is deduplicated by: the IPv6 address is cut to the configured prefix.
+func (r *resolver) DedupIP(addr netip.Addr) netip.Addr {
+	if r.ipv6Prefix <= 0 || !addr.Is6() || addr.Is4In6() {
+		return addr
+	}
+
+	prefix, err := addr.WithZone("").Prefix(r.ipv6Prefix)
+	if err != nil {
+		return addr
+	}
+
+	return prefix.Addr()
+}
+
+func (r *resolver) isTrusted(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseAddr parses an address with an optional port, IPv6 in brackets or not. IPv4-mapped addresses are unmapped.
+func parseAddr(str string) netip.Addr {
+	str = strings.Trim(strings.TrimSpace(str), `"`)
+
+	if addrPort, err := netip.ParseAddrPort(str); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+
+	if host, _, err := net.SplitHostPort(str); err == nil {
+		str = host
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(str, "["), "]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return addr.Unmap()
+}
+
+// splitValues returns the comma separated values of all header lines in order.
+func splitValues(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			result = append(result, strings.TrimSpace(part))
+		}
+	}
+
+	return result
+}
+
+// forwardedFor returns the for= addresses of the Forwarded header (RFC 7239) in order. An element without for= is an unknown hop.
+func forwardedFor(values []string) []string {
+	var result []string
+	for _, element := range splitValues(values) {
+		var hop string
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hop = value
+			}
+		}
+
+		result = append(result, hop)
+	}
+
+	return result
+}
@@ -0,0 +1,57 @@
+package realip
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver(t *testing.T) {
+	trusted := []string{"127.0.0.1/32", "10.0.0.0/8", "2001:db8:ffff::/48"}
+
+	for _, c := range []struct {
+		name   string
+		header string
+		remote string
+		values []string
+		client string
+	}{
+		{"untrusted peer", "X-Real-IP", "192.0.2.1:5000", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"real ip", "X-Real-IP", "127.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"no header", "X-Real-IP", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"forged real ip", "X-Real-IP", "127.0.0.1:5000", []string{"198.51.100.1", "198.51.100.2"}, "127.0.0.1"},
+		{"forwarded for", "X-Forwarded-For", "127.0.0.1:5000", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"forwarded for lines", "X-Forwarded-For", "127.0.0.1:5000", []string{"203.0.113.9", "198.51.100.1"}, "198.51.100.1"},
+		{"only proxies", "X-Forwarded-For", "127.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"garbage", "X-Forwarded-For", "127.0.0.1:5000", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6 peer", "X-Forwarded-For", "[2001:db8:ffff::1]:5000", []string{"2001:db8:1::5"}, "2001:db8:1::5"},
+		{"mapped ipv4", "X-Forwarded-For", "[::ffff:127.0.0.1]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"rfc 7239", "Forwarded", "127.0.0.1:5000", []string{`for=192.0.2.60;proto=http, for="[2001:db8:1::5]:4711";by=10.0.0.1, for=10.0.0.2`}, "2001:db8:1::5"},
+		{"rfc 7239 obfuscated", "Forwarded", "127.0.0.1:5000", []string{"for=198.51.100.1, for=_hidden, for=10.0.0.2"}, "10.0.0.2"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resolver, err := NewResolver(&config.HandlerConfig{RealIPHeader: c.header, TrustedProxies: trusted})
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodPost, "/file/1/", nil)
+			require.NoError(t, err)
+			req.RemoteAddr = c.remote
+			for _, value := range c.values {
+				req.Header.Add(c.header, value)
+			}
+
+			require.Equal(t, c.client, resolver.ClientIP(req).String())
+		})
+	}
+
+	resolver, err := NewResolver(&config.HandlerConfig{IPv6Prefix: 64})
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8:1:2::", resolver.DedupIP(netip.MustParseAddr("2001:db8:1:2:aaaa:bbbb:cccc:dddd")).String())
+	require.Equal(t, "192.0.2.1", resolver.DedupIP(netip.MustParseAddr("192.0.2.1")).String())
+
+	_, err = NewResolver(&config.HandlerConfig{TrustedProxies: []string{"10.0.0.1"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+// previewParam is the query parameter the page handler takes the preview token from.
+const previewParam = "token"
+
+// Write writes the human-readable index report. Every line is terminated by eol.
+func Write(w io.Writer, report *entity.IndexReport, siteURL, eol string) {
+	for i, info := range report.Shares {
+		switch info.Kind {
+		case entity.ShareKindCategory:
+			fmt.Fprintf(w, "%d. %s -> %s/%s/%s/%s", i+1, info.SourcePath, siteURL, info.Kind, info.ID, eol)
+		default:
+			fmt.Fprintf(w, "%d. %s -> %s/%s/%s/, files: %d%s", i+1, info.SourcePath, siteURL, info.Kind, info.ID, info.FileCount, eol)
+		}
+	}
+
+	fmt.Fprintf(w, "%sRendered: %d, unchanged: %d%s", eol, report.Rendered, report.Unchanged, eol)
+
+	if len(report.Truncated) > 0 {
+		fmt.Fprintf(w, "%sTruncated:%s", eol, eol)
+		for _, t := range report.Truncated {
+			fmt.Fprintf(w, "- %s: %s %d of %d%s", t.SourcePath, t.Kind, t.Limit, t.Total, eol)
+		}
+	}
+
+	if len(report.Drafts) > 0 {
+		fmt.Fprintf(w, "%sDrafts, available only by the preview links:%s", eol, eol)
+		for _, d := range report.Drafts {
+			fmt.Fprintf(w, "- %s -> %s/%s/%s/?%s=%s%s", d.SourcePath, siteURL, entity.ShareKindDownload, d.ID, previewParam, d.Preview, eol)
+		}
+	}
+
+	writeScheduled(w, report.Scheduled, entity.ScheduleStatusPending, "Upcoming", eol)
+	writeScheduled(w, report.Scheduled, entity.ScheduleStatusExpired, "Expired", eol)
+
+	if len(report.Errors) > 0 {
+		fmt.Fprintf(w, "%sSkipped:%s", eol, eol)
+		for _, e := range report.Errors {
+			fmt.Fprintf(w, "- %s: %s (%s)%s", e.SourcePath, e.Reason, e.Error, eol)
+		}
+	}
+
+	if report.Diff != nil {
+		writeDiff(w, report.Diff, eol)
+	}
+}
+
+// writeScheduled writes the downloads and files of the schedule status with the time they are published or have expired.
+func writeScheduled(w io.Writer, items []*entity.ScheduledItem, status, title, eol string) {
+	header := false
+	for _, item := range items {
+		if item.Status != status {
+			continue
+		}
+
+		if !header {
+			fmt.Fprintf(w, "%s%s:%s", eol, title, eol)
+			header = true
+		}
+
+		fmt.Fprintf(w, "- %s: %s%s", item.SourcePath, item.At.Format(time.RFC3339), eol)
+	}
+}
+
+func writeDiff(w io.Writer, diff *entity.IndexDiff, eol string) {
+	fmt.Fprintf(w, "%sDry run, nothing is saved. Changes against the active version:%s", eol, eol)
+
+	writeShares := func(title string, shares []*entity.DiffShare) {
+		if len(shares) == 0 {
+			return
+		}
+
+		fmt.Fprintf(w, "%s%s:%s", eol, title, eol)
+		for _, s := range shares {
+			if s.OldTitle != "" {
+				fmt.Fprintf(w, "~ %s: %q -> %q%s", s.SourcePath, s.OldTitle, s.Title, eol)
+			} else {
+				fmt.Fprintf(w, "- %s%s", s.SourcePath, eol)
+			}
+		}
+	}
+
+	writeShares("Added", diff.Added)
+	writeShares("Removed", diff.Removed)
+	writeShares("Retitled", diff.Retitled)
+
+	if len(diff.FilesAdded) > 0 {
+		fmt.Fprintf(w, "%sFiles added:%s", eol, eol)
+		for _, f := range diff.FilesAdded {
+			fmt.Fprintf(w, "+ %s%s", f.Path, eol)
+		}
+	}
+
+	if len(diff.FilesRemoved) > 0 {
+		fmt.Fprintf(w, "%sFiles removed:%s", eol, eol)
+		for _, f := range diff.FilesRemoved {
+			fmt.Fprintf(w, "- %s, counter: %d%s", f.Path, f.Counter, eol)
+		}
+	}
+
+	fmt.Fprintf(w, "%sCounters to delete: %d%s", eol, diff.CountersDeleted, eol)
+}
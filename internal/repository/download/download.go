@@ -2,11 +2,14 @@ package download
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"iter"
 	"log/slog"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -14,7 +17,10 @@ import (
 	"sync/atomic"
 
 	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
 	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/jgivc/fetchtracker/internal/repository/stats"
+	"github.com/jgivc/fetchtracker/internal/util"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -22,40 +28,99 @@ const (
 	KeyVersion1         = "v1"
 	KeyVersion2         = "v2"
 	KeyActiveVersion    = "av"  // STRING.
+	KeyVersionChannel   = "avc" // PUB/SUB channel. The new active version is published on every switch
 	KeyDownloadMap      = "dm"  // HASH. download_map:ver folder_id: folder_path
 	KeyFilesMap         = "fm"  // HASH. files_map:ver file_id: file_path
 	KeyDownloadFilesMap = "dfm" // HASH. download_files_map:ver:folder_id file_id: file_path
+	KeyFileDownloadMap  = "fdm" // HASH. file_download_map:ver file_id: folder_id
+	KeyFileMIMEMap      = "fmm" // HASH. file_mime_map:ver file_id: mime_type. Used by the direct serve mode
 	// KeyDownloadMap   = "download_map"   // HASH. Maps the stable hash of a distribution to its path in the file system. HGET download_map:v1 {хеш_раздачи} -> /path/to/folder
-	KeyPageContent = "pc" // HASH. {хеш_раздачи} -> HTML
+	KeyPageContent       = "pc"  // HASH. {хеш_раздачи} -> HTML
+	KeyDownloadFilesList = "dfl" // LIST. download_files_list:ver:folder_id [file_id, ...] in the page order
+	KeyDownloadPageSize  = "dps" // HASH. download_page_size:ver folder_id: page_size. Only for paginated downloads
+	KeyFolderState       = "fst" // HASH. folder_state:ver folder_id: JSON of entity.FolderState. Used by the incremental index
+	KeyCategoryMap       = "cm"  // HASH. category_map:ver category_id: folder_path
+	KeyCategoryContent   = "cc"  // HASH. category_content:ver category_id: HTML
+	KeyCategoryPages     = "ccp" // HASH. category_pages:ver category_id: JSON of []entity.CategoryPage. Only for the categories whose items have publish windows
+	KeyPageVariants      = "pv"  // HASH. page_variants:ver folder_id: JSON of []entity.PageVariant. Only for the distributions whose files have publish windows
+	KeyFileCounting      = "fcp" // HASH. file_counting_policy:ver file_id: JSON of entity.CountingPolicy. Only for the distributions that override the policy
 	// KeyDownloadVersion = "download_versions" // HASH. Maps the stable hash of a distribution to the hash of its page content (ETag). HGET download_versions:v1 {distribution_hash} -> {content_hash}
 	// KeyPageContent = "page_content" // STRING. Stores the full, ready-to-be-distributed HTML code of the distribution page. The key is an ETag.
 
-	KeyFileStats      = "fs" // HASH. Key storage of statistics. Maps a stable hash of a file to its counter. Allows atomic increment. HINCRBY file_stats {file_hash} 1
-	KeyUniqueDownload = "dl" // STRING. Used to cut off duplicate downloads. The key is the user ID (cookie/fingerprint). Set via SETNX with EX (TTL).
+	KeyFileStats      = "fs"  // HASH. Key storage of statistics. Maps a stable hash of a file to its counter. Allows atomic increment. HINCRBY file_stats {file_hash} 1
+	KeyUniqueDownload = "dl"  // STRING. Used to cut off duplicate downloads in the window mode. dl:user_id:file_id, user_id is the cookie or the fingerprint. Set via SETNX with EX (TTL).
+	KeyFileUsers      = "du"  // SET. Used to cut off duplicate downloads in the unique mode. download_users:file_id user_id, kept while the file counter exists.
+	KeyFileFolderMap  = "ffm" // HASH. file_folder_map file_id: folder_path. Not versioned, the counters of the files in the folders that failed to scan are kept by it.
 
 	KeyEmpty     = ""
 	KeySeparator = ":"
 
-	ScanCount                 = 1000
-	defaultDownloadExpiration = 24 * time.Hour
+	ScanCount = 1000
 )
 
 var (
 	// ClearableKeys = []string{KeyDownloadMap, KeyDownloadVersion, KeyPageContent}
-	ClearableKeys = []string{KeyDownloadMap, KeyFilesMap, KeyDownloadFilesMap, KeyPageContent}
+	ClearableKeys = []string{KeyDownloadMap, KeyFilesMap, KeyDownloadFilesMap, KeyFileDownloadMap, KeyDownloadFilesList, KeyDownloadPageSize, KeyPageContent, KeyFolderState, KeyCategoryMap, KeyCategoryContent, KeyCategoryPages, KeyPageVariants, KeyFileCounting, KeyFileMIMEMap}
 )
 
+/*
+countScript counts a download.
+KEYS: the file counters, the hourly history bucket, n dedup keys, then the unique downloader keys.
+ARGV: file ID, history TTL and dedup window in seconds, n, user ID, n dedup members,
+then the TTL of every unique downloader key, 0 - no TTL.
+A dedup key is a window key set with the window TTL or, if the window is 0, the set of the file users.
+The download is a repeat if any dedup key or member has been seen, n is 0 if every request is counted.
+The user is added to the unique downloaders also on a repeat, the day may have changed since the first download.
+It returns the current counter and 1 if the download has been counted, 0 if it is a repeat.
+*/
+var countScript = redis.NewScript(`
+local n = tonumber(ARGV[4])
+for i = 3 + n, #KEYS do
+	redis.call("PFADD", KEYS[i], ARGV[5])
+	if tonumber(ARGV[i + 3]) > 0 then
+		redis.call("EXPIRE", KEYS[i], ARGV[i + 3])
+	end
+end
+local counted = true
+for i = 1, n do
+	local added
+	if tonumber(ARGV[3]) > 0 then
+		added = redis.call("SET", KEYS[2 + i], "1", "NX", "EX", ARGV[3])
+	else
+		added = redis.call("SADD", KEYS[2 + i], ARGV[5 + i]) == 1
+	end
+	if not added then
+		counted = false
+	end
+end
+if counted then
+	local counter = redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+	redis.call("HINCRBY", KEYS[2], ARGV[1], 1)
+	redis.call("EXPIRE", KEYS[2], ARGV[2])
+	return {counter, 1}
+end
+return {tonumber(redis.call("HGET", KEYS[1], ARGV[1])) or 0, 0}
+`)
+
 type downloadRepository struct {
-	ver atomic.Value
-	cl  *redis.Client
-	log *slog.Logger
+	ver    atomic.Value
+	cl     *redis.Client
+	prefix string
+	stats  *config.StatsConfig
+	log    *slog.Logger
 }
 
-func NewDownloadRepository(cl *redis.Client, log *slog.Logger) (*downloadRepository, error) {
+/*
+NewDownloadRepository creates the Redis repository. prefix is added to all keys, it can be empty.
+The download history and the unique downloaders are written with the stats retention.
+*/
+func NewDownloadRepository(cl *redis.Client, prefix string, stats *config.StatsConfig, log *slog.Logger) (*downloadRepository, error) {
 
 	repo := &downloadRepository{
-		cl:  cl,
-		log: log.With(slog.String("item", "DownloadRepository")),
+		cl:     cl,
+		prefix: prefix,
+		stats:  stats,
+		log:    log.With(slog.String("item", "DownloadRepository")),
 	}
 
 	ver, _, err := repo.getVersions(context.Background())
@@ -71,7 +136,7 @@ func NewDownloadRepository(cl *redis.Client, log *slog.Logger) (*downloadReposit
 func (r *downloadRepository) Info(ctx context.Context) ([]*entity.ShareInfo, error) {
 	ver := r.getActiveVersion()
 
-	downloadMap, err := r.cl.HGetAll(ctx, getKey(KeyDownloadMap, ver)).Result()
+	downloadMap, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadMap, ver)).Result()
 	if err != nil {
 		return nil, fmt.Errorf("cannot get download map: %w", err)
 	}
@@ -82,22 +147,44 @@ func (r *downloadRepository) Info(ctx context.Context) ([]*entity.ShareInfo, err
 
 	infos := make([]*entity.ShareInfo, 0, len(downloadMap))
 	for id, path := range downloadMap {
-		files, err := r.cl.HGetAll(ctx, getKey(KeyDownloadFilesMap, ver, id)).Result()
+		files, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadFilesMap, ver, id)).Result()
 		if err != nil {
 			return nil, fmt.Errorf("cannot get download files: %w", err)
 		}
 
 		infos = append(infos, &entity.ShareInfo{
 			ID:         id,
+			Kind:       entity.ShareKindDownload,
 			SourcePath: path,
 			FileCount:  len(files),
 		})
 	}
 
+	categoryMap, err := r.cl.HGetAll(ctx, r.getKey(KeyCategoryMap, ver)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get category map: %w", err)
+	}
+
+	for id, path := range categoryMap {
+		infos = append(infos, &entity.ShareInfo{
+			ID:         id,
+			Kind:       entity.ShareKindCategory,
+			SourcePath: path,
+		})
+	}
+
+	slices.SortFunc(infos, func(a, b *entity.ShareInfo) int {
+		return strings.Compare(a.SourcePath, b.SourcePath)
+	})
+
 	return infos, nil
 }
 
-func (r *downloadRepository) Save(ctx context.Context, downloads []*entity.Download) error {
+/*
+Save writes the downloads to the standby version and makes it active.
+The counters of the deleted files are deleted, except the files in the failed folders: they are missing from the scan, not deleted.
+*/
+func (r *downloadRepository) Save(ctx context.Context, downloads []*entity.Download, categories []*entity.Category, failed []string) error {
 	verActive, verStandby, err := r.getVersions(ctx)
 	if err != nil {
 		r.log.Error("Cannot get standby data version")
@@ -106,28 +193,44 @@ func (r *downloadRepository) Save(ctx context.Context, downloads []*entity.Downl
 	}
 	r.log.Info("Save new data", slog.String("active_version", verActive), slog.String("standby_version", verStandby))
 
+	for _, download := range downloads {
+		if !download.Unchanged {
+			continue
+		}
+
+		if err := r.loadUnchanged(ctx, verActive, download); err != nil {
+			r.log.Error("Cannot load unchanged download", slog.String("id", download.ID), slog.String("version", verActive), slog.Any("error", err))
+
+			return fmt.Errorf("cannot load unchanged download %s: %w", download.SourcePath, err)
+		}
+	}
+
 	if err := r.clearOldData(ctx, verStandby); err != nil {
 		r.log.Error("Cannot clear old data", slog.String("version", verStandby), slog.Any("error", err))
 
 		return fmt.Errorf("cannot clear old data: %w", err)
 	}
 
-	if err := r.saveNewData(ctx, verStandby, downloads); err != nil {
+	if err := r.saveNewData(ctx, verStandby, downloads, categories); err != nil {
 		r.log.Error("Cannot save new data", slog.String("version", verStandby), slog.Any("error", err))
 
 		return fmt.Errorf("cannot save new data: %w", err)
 	}
 
-	_, err = r.cl.Set(ctx, KeyActiveVersion, verStandby, 0).Result()
-	if err != nil {
+	if err := r.switchVersion(ctx, verStandby); err != nil {
 		r.log.Error("Cannot switch to new version", slog.String("version", verStandby), slog.Any("error", err))
 
 		return fmt.Errorf("cannot switch to new version: %w", err)
 	}
 
-	r.ver.Store(verStandby)
+	if err := r.keepFailedFolders(ctx, verActive, failed); err != nil {
+		r.log.Error("Cannot keep files of failed folders", slog.String("version", verActive), slog.Any("error", err))
 
-	if err := r.clearDeletedFileCounters(ctx, downloads); err != nil {
+		return fmt.Errorf("cannot keep files of failed folders: %w", err)
+	}
+
+	// The previous version is kept until the next index for the rollback, so are the counters of its files
+	if err := r.clearDeletedFileCounters(ctx, downloads, failed, verActive); err != nil {
 		r.log.Error("Cannot delete deleted keys", slog.String("version", verStandby), slog.Any("error", err))
 
 		return fmt.Errorf("cannot delete deleted keys: %w", err)
@@ -136,72 +239,361 @@ func (r *downloadRepository) Save(ctx context.Context, downloads []*entity.Downl
 	return nil
 }
 
-func (r *downloadRepository) clearDeletedFileCounters(ctx context.Context, downloads []*entity.Download) error {
-	filesMap := make(map[string]struct{})
+/*
+keepFailedFolders records the folders of the files of the version ver that are in the failed folders,
+so their counters outlive the version even if the folders were indexed before the file folders were recorded.
+*/
+func (r *downloadRepository) keepFailedFolders(ctx context.Context, ver string, failed []string) error {
+	if len(failed) < 1 {
+		return nil
+	}
+
+	folders, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadMap, ver)).Result()
+	if err != nil {
+		return fmt.Errorf("cannot get downloads of version %s: %w", ver, err)
+	}
+
+	for downloadID, folder := range folders {
+		if !util.IsInFolders(folder, failed) {
+			continue
+		}
+
+		fileIDs, err := r.cl.HKeys(ctx, r.getKey(KeyDownloadFilesMap, ver, downloadID)).Result()
+		if err != nil {
+			return fmt.Errorf("cannot get files of download %s: %w", downloadID, err)
+		}
+
+		pipe := r.cl.Pipeline()
+		for _, fileID := range fileIDs {
+			pipe.HSet(ctx, r.getKey(KeyFileFolderMap), fileID, folder)
+		}
+
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("cannot save file folders: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (r *downloadRepository) clearDeletedFileCounters(ctx context.Context, downloads []*entity.Download, failed []string, keepVer string) error {
+	staleIDs, err := r.staleFileCounters(ctx, downloads, failed, keepVer)
+	if err != nil {
+		return err
+	}
+
+	for chunk := range slices.Chunk(staleIDs, ScanCount) {
+		if err := r.cl.HDel(ctx, r.getKey(KeyFileStats), chunk...).Err(); err != nil {
+			return fmt.Errorf("cannot delete counters: %w", err)
+		}
+
+		if err := r.cl.HDel(ctx, r.getKey(stats.KeyFiltered), chunk...).Err(); err != nil {
+			return fmt.Errorf("cannot delete filtered counters: %w", err)
+		}
+
+		if err := r.cl.HDel(ctx, r.getKey(KeyFileFolderMap), chunk...).Err(); err != nil {
+			return fmt.Errorf("cannot delete file folders: %w", err)
+		}
+
+		// The period uniques expire by themselves
+		uniqueKeys := make([]string, 0, 2*len(chunk))
+		for _, fileID := range chunk {
+			uniqueKeys = append(uniqueKeys, r.getKey(stats.UniquesKey(stats.KeyUniquesFile, fileID, "", "")...), r.getKey(KeyFileUsers, fileID))
+		}
+
+		if err := r.cl.Del(ctx, uniqueKeys...).Err(); err != nil {
+			return fmt.Errorf("cannot delete uniques: %w", err)
+		}
+	}
+
+	if len(staleIDs) > 0 {
+		r.log.Info("Delete counters of deleted files", slog.Int("count", len(staleIDs)))
+	}
+
+	return nil
+}
+
+/*
+staleFileCounters returns the IDs of the file counters that belong neither to the downloads nor to the version keepVer,
+nor to the files in the failed folders.
+*/
+func (r *downloadRepository) staleFileCounters(ctx context.Context, downloads []*entity.Download, failed []string, keepVer string) ([]string, error) {
+	keepIDs, err := r.cl.HKeys(ctx, r.getKey(KeyFilesMap, keepVer)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get files of version %s: %w", keepVer, err)
+	}
+
+	filesMap := make(map[string]struct{}, len(keepIDs))
+	for _, fileID := range keepIDs {
+		filesMap[fileID] = struct{}{}
+	}
+
 	for _, download := range downloads {
 		for _, file := range download.Files {
 			filesMap[file.ID] = struct{}{}
 		}
 	}
 
-	pattern := getKey(KeyFileStats, "*")
 	var (
-		cursor       uint64
-		deletedCount int64
+		staleIDs []string
+		staleMap = make(map[string]struct{})
 	)
 
-	pipe := r.cl.Pipeline()
+	// The folders of the files that have never been downloaded are deleted too
+	for _, key := range []string{KeyFileFolderMap, KeyFileStats} {
+		var cursor uint64
 
-	for {
-		keys, nextCursor, err := r.cl.Scan(ctx, cursor, pattern, ScanCount).Result()
+		for {
+			// The result is a list of field, value pairs
+			fields, nextCursor, err := r.cl.HScan(ctx, r.getKey(key), cursor, "", ScanCount).Result()
+			if err != nil {
+				return nil, fmt.Errorf("error scanning counters: %w", err)
+			}
+
+			for i := 0; i < len(fields); i += 2 {
+				fileID := fields[i]
+				if _, exists := filesMap[fileID]; exists {
+					continue
+				}
+
+				if key == KeyFileFolderMap && util.IsInFolders(fields[i+1], failed) {
+					filesMap[fileID] = struct{}{}
+
+					continue
+				}
+
+				if _, exists := staleMap[fileID]; !exists {
+					staleMap[fileID] = struct{}{}
+					staleIDs = append(staleIDs, fileID)
+				}
+			}
+
+			cursor = nextCursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	return staleIDs, nil
+}
+
+/*
+Diff compares the downloads with the active version without writing anything.
+The unchanged downloads are filled from the active version as Save does.
+*/
+func (r *downloadRepository) Diff(ctx context.Context, downloads []*entity.Download, failed []string) (*entity.IndexDiff, error) {
+	ver := r.getActiveVersion()
+
+	for _, download := range downloads {
+		if !download.Unchanged {
+			continue
+		}
+
+		if err := r.loadUnchanged(ctx, ver, download); err != nil {
+			return nil, fmt.Errorf("cannot load unchanged download %s: %w", download.SourcePath, err)
+		}
+	}
+
+	downloadMap, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadMap, ver)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get download map: %w", err)
+	}
+
+	states, err := r.FolderStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	getTitle := func(id string) string {
+		if state, exists := states[id]; exists {
+			return state.Title
+		}
+
+		return ""
+	}
+
+	diff := &entity.IndexDiff{}
+	downloadIDs := make(map[string]struct{}, len(downloads))
+	for _, download := range downloads {
+		downloadIDs[download.ID] = struct{}{}
+
+		if _, exists := downloadMap[download.ID]; !exists {
+			diff.Added = append(diff.Added, &entity.DiffShare{ID: download.ID, SourcePath: download.SourcePath, Title: download.Title})
+			for _, file := range download.Files {
+				diff.FilesAdded = append(diff.FilesAdded, &entity.DiffFile{ID: file.ID, DownloadID: download.ID, Path: file.URL})
+			}
+
+			continue
+		}
+
+		if oldTitle := getTitle(download.ID); oldTitle != "" && oldTitle != download.Title {
+			diff.Retitled = append(diff.Retitled, &entity.DiffShare{ID: download.ID, SourcePath: download.SourcePath, Title: download.Title, OldTitle: oldTitle})
+		}
+
+		oldFiles, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadFilesMap, ver, download.ID)).Result()
 		if err != nil {
-			return fmt.Errorf("error scanning keys: %w", err)
+			return nil, fmt.Errorf("cannot get download files: %w", err)
 		}
 
-		if len(keys) > 0 {
-			for _, key := range keys {
-				if _, exists := filesMap[key]; !exists {
-					pipe.Del(ctx, key)
-					deletedCount++
-				}
+		for _, file := range download.Files {
+			if _, exists := oldFiles[file.ID]; !exists {
+				diff.FilesAdded = append(diff.FilesAdded, &entity.DiffFile{ID: file.ID, DownloadID: download.ID, Path: file.URL})
 			}
+			delete(oldFiles, file.ID)
 		}
 
-		cursor = nextCursor
-		if cursor == 0 {
-			break
+		for fileID, path := range oldFiles {
+			diff.FilesRemoved = append(diff.FilesRemoved, &entity.DiffFile{ID: fileID, DownloadID: download.ID, Path: path})
 		}
 	}
 
-	if deletedCount > 0 {
-		_, err := pipe.Exec(ctx)
+	for id, path := range downloadMap {
+		if _, exists := downloadIDs[id]; exists {
+			continue
+		}
+
+		diff.Removed = append(diff.Removed, &entity.DiffShare{ID: id, SourcePath: path, Title: getTitle(id)})
+
+		oldFiles, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadFilesMap, ver, id)).Result()
 		if err != nil {
-			return fmt.Errorf("cannot delete keys: %w", err)
+			return nil, fmt.Errorf("cannot get download files: %w", err)
+		}
+
+		for fileID, path := range oldFiles {
+			diff.FilesRemoved = append(diff.FilesRemoved, &entity.DiffFile{ID: fileID, DownloadID: id, Path: path})
+		}
+	}
+
+	if err := r.fillCounters(ctx, diff.FilesRemoved); err != nil {
+		return nil, err
+	}
+
+	// The active version becomes the previous one, its counters are kept
+	staleIDs, err := r.staleFileCounters(ctx, downloads, failed, ver)
+	if err != nil {
+		return nil, err
+	}
+	diff.CountersDeleted = len(staleIDs)
+
+	slices.SortFunc(diff.Added, compareDiffShares)
+	slices.SortFunc(diff.Removed, compareDiffShares)
+	slices.SortFunc(diff.Retitled, compareDiffShares)
+	slices.SortFunc(diff.FilesAdded, compareDiffFiles)
+	slices.SortFunc(diff.FilesRemoved, compareDiffFiles)
+
+	return diff, nil
+}
+
+func (r *downloadRepository) fillCounters(ctx context.Context, files []*entity.DiffFile) error {
+	for chunk := range slices.Chunk(files, ScanCount) {
+		fileIDs := make([]string, 0, len(chunk))
+		for _, file := range chunk {
+			fileIDs = append(fileIDs, file.ID)
+		}
+
+		counters, err := r.cl.HMGet(ctx, r.getKey(KeyFileStats), fileIDs...).Result()
+		if err != nil {
+			return fmt.Errorf("cannot get counters: %w", err)
+		}
+
+		for i, counter := range counters {
+			if str, ok := counter.(string); ok {
+				chunk[i].Counter, _ = strconv.ParseInt(str, 10, 64)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (r *downloadRepository) saveNewData(ctx context.Context, ver string, downloads []*entity.Download) error {
+func (r *downloadRepository) saveNewData(ctx context.Context, ver string, downloads []*entity.Download, categories []*entity.Category) error {
 	log := r.log.With(slog.String("op", "saveNewData"), slog.String("version", ver))
 	log.Info("Save new data")
 
 	pipe := r.cl.Pipeline()
 	for _, download := range downloads {
-		// pipe.HSet(ctx, getKey(KeyDownloadMap, ver), download.ID, download.SourcePath)
-		pipe.HSet(ctx, getKey(KeyDownloadMap, ver), download.ID, download.SourcePath)
-		pipe.HSet(ctx, getKey(KeyPageContent, ver), download.ID, download.PageContent)
-		keyFileMap := getKey(KeyFilesMap, ver)
-		keyDownloadMap := getKey(KeyDownloadFilesMap, ver, download.ID)
+		// pipe.HSet(ctx, r.getKey(KeyDownloadMap, ver), download.ID, download.SourcePath)
+		pipe.HSet(ctx, r.getKey(KeyDownloadMap, ver), download.ID, download.SourcePath)
+		pipe.HSet(ctx, r.getKey(KeyPageContent, ver), download.ID, download.PageContent)
+		keyFileMap := r.getKey(KeyFilesMap, ver)
+		keyDownloadMap := r.getKey(KeyDownloadFilesMap, ver, download.ID)
 		for _, file := range download.Files {
 			// pipe.HSet(ctx, keyFileMap, file.ID, file.SourcePath)
 			// pipe.HSet(ctx, keyDownloadMap, file.ID, file.SourcePath)
 			pipe.HSet(ctx, keyFileMap, file.ID, file.URL)
 			pipe.HSet(ctx, keyDownloadMap, file.ID, file.URL)
+			pipe.HSet(ctx, r.getKey(KeyFileDownloadMap, ver), file.ID, download.ID)
+			pipe.HSet(ctx, r.getKey(KeyFileFolderMap), file.ID, download.SourcePath)
+			if file.MIMEType != "" {
+				pipe.HSet(ctx, r.getKey(KeyFileMIMEMap, ver), file.ID, file.MIMEType)
+			}
+		}
+
+		state, err := json.Marshal(&entity.FolderState{
+			Fingerprint: download.Fingerprint,
+			Title:       download.Title,
+			TotalFiles:  download.TotalFiles,
+			Counting:    download.Counting,
+			Access:      download.Access,
+			Hidden:      download.Hidden,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot marshal folder state: %w", err)
+		}
+
+		if download.Counting != nil {
+			policy, err := json.Marshal(download.Counting)
+			if err != nil {
+				return fmt.Errorf("cannot marshal counting policy: %w", err)
+			}
+
+			for _, file := range download.Files {
+				pipe.HSet(ctx, r.getKey(KeyFileCounting, ver), file.ID, policy)
+			}
+		}
+
+		pipe.HSet(ctx, r.getKey(KeyFolderState, ver), download.ID, state)
+
+		if len(download.Variants) > 0 {
+			variants, err := json.Marshal(download.Variants)
+			if err != nil {
+				return fmt.Errorf("cannot marshal page variants: %w", err)
+			}
+
+			pipe.HSet(ctx, r.getKey(KeyPageVariants, ver), download.ID, variants)
+		}
+
+		if download.PageSize > 0 {
+			pipe.HSet(ctx, r.getKey(KeyDownloadPageSize, ver), download.ID, download.PageSize)
+
+			fileIDs := make([]any, 0, len(download.Files))
+			for _, file := range download.Files {
+				fileIDs = append(fileIDs, file.ID)
+			}
+			pipe.RPush(ctx, r.getKey(KeyDownloadFilesList, ver, download.ID), fileIDs...)
+
+			// The first page is stored as PageContent
+			for i := 1; i < len(download.Pages); i++ {
+				pipe.HSet(ctx, r.getKey(KeyPageContent, ver), getPageField(download.ID, i+1), download.Pages[i])
+			}
+		}
+		// pipe.HSet(ctx, r.getKey(KeyDownloadVersion, ver), download.ID, download.PageHash)
+		// pipe.Set(ctx, r.getKey(KeyPageContent, ver, download.PageHash), download.PageContent, 0)
+	}
+
+	for _, category := range categories {
+		pipe.HSet(ctx, r.getKey(KeyCategoryMap, ver), category.ID, category.SourcePath)
+		pipe.HSet(ctx, r.getKey(KeyCategoryContent, ver), category.ID, category.PageContent)
+
+		if len(category.Pages) > 0 {
+			pages, err := json.Marshal(category.Pages)
+			if err != nil {
+				return fmt.Errorf("cannot marshal category pages: %w", err)
+			}
+
+			pipe.HSet(ctx, r.getKey(KeyCategoryPages, ver), category.ID, pages)
 		}
-		// pipe.HSet(ctx, getKey(KeyDownloadVersion, ver), download.ID, download.PageHash)
-		// pipe.Set(ctx, getKey(KeyPageContent, ver, download.PageHash), download.PageContent, 0)
 	}
 
 	_, err := pipe.Exec(ctx)
@@ -212,12 +604,101 @@ func (r *downloadRepository) saveNewData(ctx context.Context, ver string, downlo
 	return nil
 }
 
+/*
+loadUnchanged fills the unchanged download with the files and pages of the version ver,
+so it can be saved to the new version as is.
+*/
+func (r *downloadRepository) loadUnchanged(ctx context.Context, ver string, download *entity.Download) error {
+	pipe := r.cl.Pipeline()
+	pageCmd := pipe.HGet(ctx, r.getKey(KeyPageContent, ver), download.ID)
+	filesCmd := pipe.HGetAll(ctx, r.getKey(KeyDownloadFilesMap, ver, download.ID))
+	listCmd := pipe.LRange(ctx, r.getKey(KeyDownloadFilesList, ver, download.ID), 0, -1)
+	pageSizeCmd := pipe.HGet(ctx, r.getKey(KeyDownloadPageSize, ver), download.ID)
+	variantsCmd := pipe.HGet(ctx, r.getKey(KeyPageVariants, ver), download.ID)
+
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("cannot exec pipe: %w", err)
+	}
+
+	content, err := pageCmd.Result()
+	if err != nil {
+		return fmt.Errorf("cannot get page: %w", err)
+	}
+
+	if data, err := variantsCmd.Bytes(); err == nil {
+		if err := json.Unmarshal(data, &download.Variants); err != nil {
+			return fmt.Errorf("cannot unmarshal page variants: %w", err)
+		}
+	}
+
+	files := filesCmd.Val()
+	fileIDs := listCmd.Val()
+	if len(fileIDs) == 0 {
+		fileIDs = slices.Sorted(maps.Keys(files))
+	}
+
+	download.Files = make([]*entity.File, 0, len(fileIDs))
+	for _, fileID := range fileIDs {
+		download.Files = append(download.Files, &entity.File{ID: fileID, URL: files[fileID]})
+	}
+
+	if len(fileIDs) > 0 {
+		mimeTypes, err := r.cl.HMGet(ctx, r.getKey(KeyFileMIMEMap, ver), fileIDs...).Result()
+		if err != nil {
+			return fmt.Errorf("cannot get mime types: %w", err)
+		}
+
+		for i, mimeType := range mimeTypes {
+			if str, ok := mimeType.(string); ok {
+				download.Files[i].MIMEType = str
+			}
+		}
+	}
+
+	download.PageContent = content
+	download.PageHash = util.GetIDFromString(&content)
+
+	pageSize, err := pageSizeCmd.Int()
+	if err != nil || pageSize < 1 {
+		return nil
+	}
+
+	download.PageSize = pageSize
+	download.Pages = []string{content}
+
+	pageCount := entity.PageCount(pageSize, len(download.Files))
+	if pageCount < 2 {
+		return nil
+	}
+
+	fields := make([]string, 0, pageCount-1)
+	for page := 2; page <= pageCount; page++ {
+		fields = append(fields, getPageField(download.ID, page))
+	}
+
+	pages, err := r.cl.HMGet(ctx, r.getKey(KeyPageContent, ver), fields...).Result()
+	if err != nil {
+		return fmt.Errorf("cannot get pages: %w", err)
+	}
+
+	for i, page := range pages {
+		str, ok := page.(string)
+		if !ok {
+			return fmt.Errorf("cannot find page %d", i+2)
+		}
+
+		download.Pages = append(download.Pages, str)
+	}
+
+	return nil
+}
+
 func (r *downloadRepository) clearOldData(ctx context.Context, ver string) error {
 	log := r.log.With(slog.String("op", "clearOldData"), slog.String("version", ver))
 	log.Info("Clear old data")
 
 	for _, key := range ClearableKeys {
-		pattern := getKey(key, ver, "*")
+		pattern := r.getKey(key, ver, "*")
 
 		log.Info("Clear keys", slog.String("pattern", pattern))
 
@@ -248,7 +729,7 @@ func (r *downloadRepository) clearOldData(ctx context.Context, ver string) error
 			}
 		}
 
-		_, err := r.cl.Del(ctx, getKey(key, ver)).Result()
+		_, err := r.cl.Del(ctx, r.getKey(key, ver)).Result()
 		if err != nil {
 			return fmt.Errorf("error deleting keys: %w", err)
 		}
@@ -263,7 +744,7 @@ func (r *downloadRepository) clearOldData(ctx context.Context, ver string) error
 getVersions return active and standby versions
 */
 func (r *downloadRepository) getVersions(ctx context.Context) (string, string, error) {
-	ver, err := r.cl.Get(ctx, KeyActiveVersion).Result()
+	ver, err := r.cl.Get(ctx, r.getKey(KeyActiveVersion)).Result()
 	if err != nil && err != redis.Nil {
 		return KeyEmpty, KeyEmpty, fmt.Errorf("cannot get active version: %w", err)
 	}
@@ -277,15 +758,134 @@ func (r *downloadRepository) getVersions(ctx context.Context) (string, string, e
 
 	r.log.Info("Active version key is not found. Try to set new one", slog.String("version", KeyVersion1))
 
-	if _, err = r.cl.Set(ctx, KeyActiveVersion, KeyVersion1, 0).Result(); err != nil {
+	if _, err = r.cl.Set(ctx, r.getKey(KeyActiveVersion), KeyVersion1, 0).Result(); err != nil {
 		return KeyEmpty, KeyEmpty, fmt.Errorf("cannot set varsion key: %w", err)
 	}
 
 	return KeyVersion1, KeyVersion2, nil
 }
 
+/*
+Rollback makes the previous version active again. The previous version is kept intact until the next index.
+It returns the version that is active now.
+*/
+func (r *downloadRepository) Rollback(ctx context.Context) (string, error) {
+	verActive, verStandby, err := r.getVersions(ctx)
+	if err != nil {
+		return KeyEmpty, err
+	}
+
+	count, err := r.cl.HLen(ctx, r.getKey(KeyDownloadMap, verStandby)).Result()
+	if err != nil {
+		return KeyEmpty, fmt.Errorf("cannot get previous version: %w", err)
+	}
+
+	if count < 1 {
+		return KeyEmpty, common.ErrNoPreviousVersionError
+	}
+
+	if err := r.switchVersion(ctx, verStandby); err != nil {
+		return KeyEmpty, fmt.Errorf("cannot switch to previous version: %w", err)
+	}
+
+	r.log.Info("Rollback", slog.String("from_version", verActive), slog.String("to_version", verStandby))
+
+	return verStandby, nil
+}
+
+// switchVersion makes the version active and notifies the other app instances.
+func (r *downloadRepository) switchVersion(ctx context.Context, ver string) error {
+	if err := r.cl.Set(ctx, r.getKey(KeyActiveVersion), ver, 0).Err(); err != nil {
+		return err
+	}
+
+	r.ver.Store(ver)
+
+	if err := r.cl.Publish(ctx, r.getKey(KeyVersionChannel), ver).Err(); err != nil {
+		// The other instances will resync the version when they resubscribe
+		r.log.Error("Cannot publish version", slog.String("version", ver), slog.Any("error", err))
+	}
+
+	return nil
+}
+
+/*
+WatchVersion follows the version switches made by other app instances until ctx is done.
+The active version is reread on every (re)subscription, so switches missed while the connection was lost are not lost.
+*/
+func (r *downloadRepository) WatchVersion(ctx context.Context) {
+	pubsub := r.cl.Subscribe(ctx, r.getKey(KeyVersionChannel))
+	defer pubsub.Close()
+
+	r.log.Info("Watch version switches")
+
+	ch := pubsub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			switch m := msg.(type) {
+			case *redis.Subscription:
+				if m.Kind != "subscribe" {
+					continue
+				}
+
+				ver, _, err := r.getVersions(ctx)
+				if err != nil {
+					r.log.Error("Cannot resync version", slog.Any("error", err))
+
+					continue
+				}
+
+				r.setVersion(ver)
+			case *redis.Message:
+				if m.Payload != KeyVersion1 && m.Payload != KeyVersion2 {
+					r.log.Warn("Unknown version published", slog.String("version", m.Payload))
+
+					continue
+				}
+
+				r.setVersion(m.Payload)
+			}
+		}
+	}
+}
+
+func (r *downloadRepository) setVersion(ver string) {
+	if old := r.ver.Swap(ver); old != ver {
+		r.log.Info("Active version switched", slog.Any("from_version", old), slog.String("to_version", ver))
+	}
+}
+
+// FolderStates returns the folder states of the active version keyed by download ID.
+func (r *downloadRepository) FolderStates(ctx context.Context) (map[string]*entity.FolderState, error) {
+	data, err := r.cl.HGetAll(ctx, r.getKey(KeyFolderState, r.getActiveVersion())).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get folder states: %w", err)
+	}
+
+	states := make(map[string]*entity.FolderState, len(data))
+	for id, str := range data {
+		var state entity.FolderState
+		if err := json.Unmarshal([]byte(str), &state); err != nil {
+			r.log.Error("Cannot unmarshal folder state", slog.String("id", id), slog.Any("error", err))
+
+			continue
+		}
+
+		states[id] = &state
+	}
+
+	return states, nil
+}
+
 func (r *downloadRepository) GetFilePath(ctx context.Context, id string) (string, error) {
-	path, err := r.cl.HGet(ctx, getKey(KeyFilesMap, r.getActiveVersion()), id).Result()
+	path, err := r.cl.HGet(ctx, r.getKey(KeyFilesMap, r.getActiveVersion()), id).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return "", common.ErrFileNotFoundError
@@ -297,33 +897,167 @@ func (r *downloadRepository) GetFilePath(ctx context.Context, id string) (string
 	return path, nil
 }
 
-func (r *downloadRepository) UserExists(ctx context.Context, id string) (bool, error) {
-	res, err := r.cl.SetNX(ctx, getKey(KeyUniqueDownload, id), "1", defaultDownloadExpiration).Result()
+// GetFileMIMEType returns the MIME type of the file, an empty string if it is unknown.
+func (r *downloadRepository) GetFileMIMEType(ctx context.Context, id string) (string, error) {
+	mimeType, err := r.cl.HGet(ctx, r.getKey(KeyFileMIMEMap, r.getActiveVersion()), id).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return "", fmt.Errorf("cannot get file %s mime type: %w", id, err)
+	}
+
+	return mimeType, nil
+}
+
+// GetAccess returns the access restriction of the download, nil if it is public.
+func (r *downloadRepository) GetAccess(ctx context.Context, id string) (*entity.Access, error) {
+	return r.getAccess(ctx, r.getActiveVersion(), id)
+}
+
+// GetFileAccess returns the download of the file and its access restriction, nil if it is public.
+func (r *downloadRepository) GetFileAccess(ctx context.Context, fileID string) (string, *entity.Access, error) {
+	ver := r.getActiveVersion()
+
+	downloadID, err := r.cl.HGet(ctx, r.getKey(KeyFileDownloadMap, ver), fileID).Result()
 	if err != nil {
-		return false, fmt.Errorf("cannot check user exists")
+		if errors.Is(err, redis.Nil) {
+			// The file has been indexed before the map was added, before the access could be set
+			return "", nil, nil
+		}
+
+		return "", nil, fmt.Errorf("cannot get file %s download: %w", fileID, err)
 	}
 
-	return !res, nil
+	access, err := r.getAccess(ctx, ver, downloadID)
+
+	return downloadID, access, err
 }
 
-func (r *downloadRepository) IncFileCounter(ctx context.Context, id string) (int64, error) {
-	counter, err := r.cl.HIncrBy(ctx, KeyFileStats, id, 1).Result()
+func (r *downloadRepository) getAccess(ctx context.Context, ver, id string) (*entity.Access, error) {
+	data, err := r.cl.HGet(ctx, r.getKey(KeyFolderState, ver), id).Bytes()
 	if err != nil {
-		return 0, fmt.Errorf("cannot increment file %s counter: %w", id, err)
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot get download %s state: %w", id, err)
+	}
+
+	var state entity.FolderState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal download %s state: %w", id, err)
 	}
 
-	return counter, nil
+	return state.Access, nil
 }
 
-func (r *downloadRepository) GetDownloadCounters(ctx context.Context, id string) (map[string]int, error) {
-	files, err := r.cl.HGetAll(ctx, getKey(KeyDownloadFilesMap, r.getActiveVersion(), id)).Result()
+// GetCountingPolicy returns the counting policy of the file distribution, nil if it does not override the global one.
+func (r *downloadRepository) GetCountingPolicy(ctx context.Context, fileID string) (*entity.CountingPolicy, error) {
+	data, err := r.cl.HGet(ctx, r.getKey(KeyFileCounting, r.getActiveVersion()), fileID).Bytes()
 	if err != nil {
-		return nil, fmt.Errorf("cannot get download files: %w", err)
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("cannot get file %s counting policy: %w", fileID, err)
+	}
+
+	var policy entity.CountingPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal file %s counting policy: %w", fileID, err)
+	}
+
+	return &policy, nil
+}
+
+/*
+CountDownload counts the download of the file by the user if the resolved counting policy allows it.
+The dedup check, the counter and the history are updated by one script, so a count is never lost between them.
+It returns the current counter of the file and whether the download has been counted.
+*/
+func (r *downloadRepository) CountDownload(ctx context.Context, downloader *entity.Downloader, fileID string, policy *entity.CountingPolicy, t time.Time) (int64, bool, error) {
+	// The distribution is unknown for the files indexed before the map was added
+	downloadID, err := r.cl.HGet(ctx, r.getKey(KeyFileDownloadMap, r.getActiveVersion()), fileID).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, false, fmt.Errorf("cannot get file %s download: %w", fileID, err)
+	}
+
+	var (
+		window    int64
+		dedupKeys []string
+		members   []any
+	)
+
+	if policy.Mode != entity.CountingModeEvery {
+		for _, userID := range downloader.DedupIDs(policy.IsCookieOnly()) {
+			if policy.Mode == entity.CountingModeUnique {
+				dedupKeys = append(dedupKeys, r.getKey(KeyFileUsers, fileID))
+			} else {
+				dedupKeys = append(dedupKeys, r.getKey(KeyUniqueDownload, userID, fileID))
+			}
+			members = append(members, userID)
+		}
+
+		if policy.Mode == entity.CountingModeWindow {
+			window = max(int64(policy.Window.Seconds()), 1)
+		}
+	}
+
+	keys := append([]string{
+		r.getKey(KeyFileStats),
+		r.getKey(stats.KeyStatsHourly, entity.StatBucketKey(entity.StatPeriodHour, t, time.UTC)),
+	}, dedupKeys...)
+	args := append([]any{fileID, int64(r.stats.Retention.Hourly.Seconds()), window, len(dedupKeys), downloader.ID()}, members...)
+
+	ttls := map[string]time.Duration{
+		"":                     0,
+		entity.StatPeriodDay:   r.stats.Retention.Daily,
+		entity.StatPeriodMonth: r.stats.Retention.Monthly,
+	}
+
+	for period, ttl := range ttls {
+		if downloader.IsAnonymous() {
+			// The user has asked not to be tracked
+			break
+		}
+
+		bucketKey := ""
+		if period != "" {
+			bucketKey = entity.StatBucketKey(period, t, r.stats.Location)
+		}
+
+		keys = append(keys, r.getKey(stats.UniquesKey(stats.KeyUniquesFile, fileID, period, bucketKey)...))
+		args = append(args, int64(ttl.Seconds()))
+
+		if downloadID != "" {
+			keys = append(keys, r.getKey(stats.UniquesKey(stats.KeyUniquesDownload, downloadID, period, bucketKey)...))
+			args = append(args, int64(ttl.Seconds()))
+		}
+	}
+
+	res, err := countScript.Run(ctx, r.cl, keys, args...).Int64Slice()
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot count file %s download: %w", fileID, err)
+	}
+
+	if len(res) != 2 {
+		return 0, false, fmt.Errorf("cannot count file %s download: unexpected result %v", fileID, res)
+	}
+
+	return res[0], res[1] == 1, nil
+}
+
+/*
+GetDownloadCounters returns counters of the download files.
+If page > 0 and the download is paginated, then only the files of that page are returned.
+*/
+func (r *downloadRepository) GetDownloadCounters(ctx context.Context, id string, page int) (map[string]int, error) {
+	fileIDs, err := r.getDownloadFileIDs(ctx, r.getActiveVersion(), id, page)
+	if err != nil {
+		return nil, err
 	}
 
 	counters := make(map[string]int)
-	for fileID := range files {
-		counter, err := r.cl.HGet(ctx, KeyFileStats, fileID).Result()
+	for _, fileID := range fileIDs {
+		counter, err := r.cl.HGet(ctx, r.getKey(KeyFileStats), fileID).Result()
 		if err != nil {
 			if !errors.Is(err, redis.Nil) {
 				r.log.Error("cannot get counter for file", slog.String("file_id", fileID), slog.Any("error", err))
@@ -347,13 +1081,49 @@ func (r *downloadRepository) GetDownloadCounters(ctx context.Context, id string)
 	return counters, nil
 }
 
+func (r *downloadRepository) getDownloadFileIDs(ctx context.Context, ver, id string, page int) ([]string, error) {
+	if page > 0 {
+		pageSize, err := r.cl.HGet(ctx, r.getKey(KeyDownloadPageSize, ver), id).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("cannot get download page size: %w", err)
+		}
+
+		if pageSize > 0 {
+			start := int64(page-1) * pageSize
+			fileIDs, err := r.cl.LRange(ctx, r.getKey(KeyDownloadFilesList, ver, id), start, start+pageSize-1).Result()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get download page files: %w", err)
+			}
+
+			return fileIDs, nil
+		}
+	}
+
+	fileIDs, err := r.cl.HKeys(ctx, r.getKey(KeyDownloadFilesMap, ver, id)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get download files: %w", err)
+	}
+
+	return fileIDs, nil
+}
+
 func (r *downloadRepository) getActiveVersion() string {
 	return r.ver.Load().(string)
 }
 
-func (r *downloadRepository) GetPage(ctx context.Context, id string) (string, error) {
-	// str, err := r.cl.Get(ctx, getKey(KeyPageContent, r.getActiveVersion())).Result()
-	str, err := r.cl.HGet(ctx, getKey(KeyPageContent, r.getActiveVersion()), id).Result()
+// GetPage returns the page of the download at the request time, the files outside their windows are not listed on it.
+func (r *downloadRepository) GetPage(ctx context.Context, id string, page int) (string, error) {
+	ver := r.getActiveVersion()
+
+	// str, err := r.cl.Get(ctx, r.getKey(KeyPageContent, r.getActiveVersion())).Result()
+	pipe := r.cl.Pipeline()
+	contentCmd := pipe.HGet(ctx, r.getKey(KeyPageContent, ver), getPageField(id, page))
+	variantsCmd := pipe.HGet(ctx, r.getKey(KeyPageVariants, ver), id)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+
+	str, err := contentCmd.Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return "", common.ErrPageNotFoundError
@@ -362,12 +1132,61 @@ func (r *downloadRepository) GetPage(ctx context.Context, id string) (string, er
 		return "", err
 	}
 
+	if data, err := variantsCmd.Bytes(); err == nil {
+		var variants []*entity.PageVariant
+		if err := json.Unmarshal(data, &variants); err != nil {
+			return "", fmt.Errorf("cannot unmarshal page variants: %w", err)
+		}
+
+		if content, ok := entity.PageAt(variants, page, time.Now()); ok {
+			if content == "" {
+				return "", common.ErrPageNotFoundError
+			}
+
+			str = content
+		}
+	}
+
+	return str, nil
+}
+
+// GetCategory returns the listing page of the category at the request time, common.ErrPageNotFoundError if no item is listed now.
+func (r *downloadRepository) GetCategory(ctx context.Context, id string) (string, error) {
+	ver := r.getActiveVersion()
+
+	pipe := r.cl.Pipeline()
+	contentCmd := pipe.HGet(ctx, r.getKey(KeyCategoryContent, ver), id)
+	pagesCmd := pipe.HGet(ctx, r.getKey(KeyCategoryPages, ver), id)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+
+	str, err := contentCmd.Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", common.ErrPageNotFoundError
+		}
+
+		return "", err
+	}
+
+	var pages []*entity.CategoryPage
+	if data, err := pagesCmd.Bytes(); err == nil {
+		if err := json.Unmarshal(data, &pages); err != nil {
+			return "", fmt.Errorf("cannot unmarshal category pages: %w", err)
+		}
+	}
+
+	if str = entity.CategoryContentAt(str, pages, time.Now()); str == "" {
+		return "", common.ErrPageNotFoundError
+	}
+
 	return str, nil
 }
 
 func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.Seq2[*entity.DownloadCounters, error], error) {
 	ver := r.getActiveVersion()
-	folders, err := r.cl.HGetAll(ctx, getKey(KeyDownloadMap, ver)).Result()
+	folders, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadMap, ver)).Result()
 	if err != nil {
 		return nil, fmt.Errorf("cannot getfolder list: %w", err)
 	}
@@ -379,7 +1198,7 @@ func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.
 				SourcePath: folderPath,
 			}
 
-			filesMap, err := r.cl.HGetAll(ctx, getKey(KeyDownloadFilesMap, ver, folderID)).Result()
+			filesMap, err := r.cl.HGetAll(ctx, r.getKey(KeyDownloadFilesMap, ver, folderID)).Result()
 			if err != nil {
 				yield(nil, fmt.Errorf("cannot get folder files: %w", err))
 
@@ -397,6 +1216,9 @@ func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.
 			fileCounters := make([]entity.FileCounter, 0, len(filesMap))
 
 			pipe := r.cl.Pipeline()
+			counterCmds := make([]*redis.StringCmd, 0, len(filesMap))
+			uniqueCmds := make([]*redis.IntCmd, 0, len(filesMap))
+			filteredCmds := make([]*redis.StringCmd, 0, len(filesMap))
 			for fileID, filePath := range filesMap {
 				fileName := filepath.Base(filePath)
 				fileCounters = append(fileCounters, entity.FileCounter{
@@ -404,19 +1226,22 @@ func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.
 					Name:       fileName,
 					SourcePath: filepath.Join(folderPath, fileName),
 				})
-				pipe.HGet(ctx, KeyFileStats, fileID)
+				counterCmds = append(counterCmds, pipe.HGet(ctx, r.getKey(KeyFileStats), fileID))
+				uniqueCmds = append(uniqueCmds, pipe.PFCount(ctx, r.getKey(stats.UniquesKey(stats.KeyUniquesFile, fileID, "", "")...)))
+				filteredCmds = append(filteredCmds, pipe.HGet(ctx, r.getKey(stats.KeyFiltered), fileID))
 			}
+			downloadUniqueCmd := pipe.PFCount(ctx, r.getKey(stats.UniquesKey(stats.KeyUniquesDownload, folderID, "", "")...))
 
-			cmds, err := pipe.Exec(ctx)
-			if err != nil {
+			// A file without downloads has no counter, it is not an error
+			if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
 				yield(nil, fmt.Errorf("cannot exec pipe: %w", err))
 
 				return
 			}
 
-			for i, cmd := range cmds {
+			for i, cmd := range counterCmds {
 				var counter int64
-				val, err := cmd.(*redis.StringCmd).Result()
+				val, err := cmd.Result()
 				if err != nil {
 					if err != redis.Nil {
 						r.log.Error("cannot get file counter", slog.Any("error", err))
@@ -430,9 +1255,11 @@ func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.
 				}
 
 				fileCounters[i].Counter = counter
-
+				fileCounters[i].Uniques = uniqueCmds[i].Val()
+				fileCounters[i].Filtered, _ = filteredCmds[i].Int64()
 			}
 
+			dc.Uniques = downloadUniqueCmd.Val()
 			dc.Files = fileCounters
 
 			if !yield(dc, nil) {
@@ -442,6 +1269,31 @@ func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.
 	}, nil
 }
 
-func getKey(keys ...string) string {
+func compareDiffShares(a, b *entity.DiffShare) int {
+	return strings.Compare(a.SourcePath, b.SourcePath)
+}
+
+func compareDiffFiles(a, b *entity.DiffFile) int {
+	return strings.Compare(a.Path, b.Path)
+}
+
+/*
+getKey joins the key parts with the separator.
+The key prefix is added in front, so several apps can share one Redis.
+*/
+func (r *downloadRepository) getKey(keys ...string) string {
+	if r.prefix != KeyEmpty {
+		keys = append([]string{r.prefix}, keys...)
+	}
+
 	return strings.Join(keys, KeySeparator)
 }
+
+// getPageField returns the page content field. The first page is stored under the download ID.
+func getPageField(id string, page int) string {
+	if page < 2 {
+		return id
+	}
+
+	return strings.Join([]string{id, strconv.Itoa(page)}, KeySeparator)
+}
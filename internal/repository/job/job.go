@@ -0,0 +1,96 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	KeyIndexJobs = "ij" // LIST. JSON of the finished index jobs, the newest first
+)
+
+type jobRepository struct {
+	cl   *redis.Client
+	key  string
+	size int
+	log  *slog.Logger
+}
+
+/*
+NewJobRepository creates the repository of the index job history. size is the number of jobs to keep.
+prefix is added to the key, it can be empty.
+*/
+func NewJobRepository(cl *redis.Client, prefix string, size int, log *slog.Logger) *jobRepository {
+	key := KeyIndexJobs
+	if prefix != "" {
+		key = prefix + ":" + key
+	}
+
+	return &jobRepository{
+		cl:   cl,
+		key:  key,
+		size: size,
+		log:  log.With(slog.String("item", "JobRepository")),
+	}
+}
+
+// SaveJob adds the finished job to the history and drops the oldest jobs.
+func (r *jobRepository) SaveJob(ctx context.Context, job *entity.IndexJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("cannot marshal job: %w", err)
+	}
+
+	pipe := r.cl.TxPipeline()
+	pipe.LPush(ctx, r.key, data)
+	pipe.LTrim(ctx, r.key, 0, int64(r.size-1))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("cannot save job: %w", err)
+	}
+
+	return nil
+}
+
+// Jobs returns the job history, the newest first.
+func (r *jobRepository) Jobs(ctx context.Context) ([]*entity.IndexJob, error) {
+	data, err := r.cl.LRange(ctx, r.key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get jobs: %w", err)
+	}
+
+	jobs := make([]*entity.IndexJob, 0, len(data))
+	for _, str := range data {
+		var job entity.IndexJob
+		if err := json.Unmarshal([]byte(str), &job); err != nil {
+			r.log.Error("Cannot unmarshal job", slog.Any("error", err))
+
+			continue
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	return jobs, nil
+}
+
+func (r *jobRepository) Job(ctx context.Context, id string) (*entity.IndexJob, error) {
+	jobs, err := r.Jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+
+	return nil, common.ErrJobNotFoundError
+}
@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltOpenTimeout = 5 * time.Second
+
+// boltStore keeps the data in a single bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database %s: %w", path, err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Get(bucket, key string) []byte {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Get([]byte(key))
+}
+
+func (t *boltTx) Put(bucket, key string, value []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return fmt.Errorf("cannot create bucket %s: %w", bucket, err)
+	}
+
+	return b.Put([]byte(key), value)
+}
+
+func (t *boltTx) Delete(bucket, key string) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.Delete([]byte(key))
+}
+
+func (t *boltTx) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+func (t *boltTx) DeleteBucket(bucket string) error {
+	if err := t.tx.DeleteBucket([]byte(bucket)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return fmt.Errorf("cannot delete bucket %s: %w", bucket, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,1025 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/jgivc/fetchtracker/internal/util"
+)
+
+/*
+The buckets mirror the Redis keys. Versioned buckets are named ver:bucket, e.g. v1:d.
+Every download is stored as a single record, so there are no per-download buckets.
+*/
+const (
+	KeyVersion1         = "v1"
+	KeyVersion2         = "v2"
+	BucketMeta          = "meta" // av: active version, jobs: job history, lock:name: lock
+	KeyActiveVersion    = "av"
+	BucketDownloads     = "d"   // download_id: JSON of downloadRecord
+	BucketFilesMap      = "fm"  // file_id: file_path
+	BucketFileDownloads = "fd"  // file_id: download_id
+	BucketFileMIMEMap   = "fmm" // file_id: mime_type. Used by the direct serve mode
+	BucketPageContent   = "pc"  // download_id or download_id:page: HTML
+	BucketCategories    = "c"   // category_id: JSON of categoryRecord
+	BucketPageVariants  = "pv"  // download_id: JSON of []entity.PageVariant. Only for the distributions whose files have publish windows
+	BucketFileStats     = "fs"  // file_id: counter
+	BucketUniqueUsers   = "dl"  // user_id:file_id: expiration time in unix seconds. The window mode dedup
+	BucketFileUsers     = "du"  // file_id:user_id: 1. The unique mode dedup, kept while the file counter exists
+	BucketFileFolders   = "ffm" // file_id: folder_path. Not versioned, the counters of the files in the folders that failed to scan are kept by it
+
+	KeySeparator = ":"
+)
+
+// ClearableBuckets are cleared in the standby version before saving the new data.
+var ClearableBuckets = []string{BucketDownloads, BucketFilesMap, BucketFileDownloads, BucketFileMIMEMap, BucketPageContent, BucketPageVariants, BucketCategories}
+
+type fileRecord struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	MIMEType string `json:"mime_type,omitempty"`
+}
+
+type downloadRecord struct {
+	SourcePath string             `json:"path"`
+	State      entity.FolderState `json:"state"`
+	PageSize   int                `json:"page_size,omitempty"`
+	Files      []fileRecord       `json:"files"` // In the page order
+}
+
+type categoryRecord struct {
+	SourcePath string                 `json:"path"`
+	Content    string                 `json:"content"`
+	Pages      []*entity.CategoryPage `json:"pages,omitempty"` // Only for the categories whose items have publish windows
+}
+
+type downloadRepository struct {
+	store Store
+	stats *config.StatsConfig
+	log   *slog.Logger
+	now   func() time.Time
+}
+
+// NewDownloadRepository creates the download repository on the embedded store. It works the same way as the Redis one.
+func NewDownloadRepository(store Store, stats *config.StatsConfig, log *slog.Logger) *downloadRepository {
+	return &downloadRepository{
+		store: store,
+		stats: stats,
+		log:   log.With(slog.String("item", "KVDownloadRepository")),
+		now:   time.Now,
+	}
+}
+
+func (r *downloadRepository) Info(ctx context.Context) ([]*entity.ShareInfo, error) {
+	var infos []*entity.ShareInfo
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		err := forEachRecord(tx, getKey(ver, BucketDownloads), func(id string, rec *downloadRecord) error {
+			infos = append(infos, &entity.ShareInfo{
+				ID:         id,
+				Kind:       entity.ShareKindDownload,
+				SourcePath: rec.SourcePath,
+				FileCount:  len(rec.Files),
+			})
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(infos) < 1 {
+			return common.ErrNoDownloadsFoundError
+		}
+
+		return forEachRecord(tx, getKey(ver, BucketCategories), func(id string, rec *categoryRecord) error {
+			infos = append(infos, &entity.ShareInfo{
+				ID:         id,
+				Kind:       entity.ShareKindCategory,
+				SourcePath: rec.SourcePath,
+			})
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(infos, func(a, b *entity.ShareInfo) int {
+		return strings.Compare(a.SourcePath, b.SourcePath)
+	})
+
+	return infos, nil
+}
+
+/*
+Save writes the downloads to the standby version and makes it active in a single transaction.
+The previous version is kept until the next index for the rollback, so are the counters of its files.
+The counters of the files in the failed folders are kept too: they are missing from the scan, not deleted.
+*/
+func (r *downloadRepository) Save(ctx context.Context, downloads []*entity.Download, categories []*entity.Category, failed []string) error {
+	return r.store.Update(func(tx Tx) error {
+		verActive, verStandby := getVersions(tx)
+		r.log.Info("Save new data", slog.String("active_version", verActive), slog.String("standby_version", verStandby))
+
+		for _, download := range downloads {
+			if !download.Unchanged {
+				continue
+			}
+
+			if err := loadUnchanged(tx, verActive, download); err != nil {
+				return fmt.Errorf("cannot load unchanged download %s: %w", download.SourcePath, err)
+			}
+		}
+
+		for _, bucket := range ClearableBuckets {
+			if err := tx.DeleteBucket(getKey(verStandby, bucket)); err != nil {
+				return fmt.Errorf("cannot clear old data: %w", err)
+			}
+		}
+
+		if err := saveNewData(tx, verStandby, downloads, categories); err != nil {
+			return fmt.Errorf("cannot save new data: %w", err)
+		}
+
+		if err := tx.Put(BucketMeta, KeyActiveVersion, []byte(verStandby)); err != nil {
+			return fmt.Errorf("cannot switch to new version: %w", err)
+		}
+
+		if err := keepFailedFolders(tx, verActive, failed); err != nil {
+			return fmt.Errorf("cannot keep files of failed folders: %w", err)
+		}
+
+		staleIDs, err := staleFileCounters(tx, downloads, failed, verActive)
+		if err != nil {
+			return err
+		}
+
+		for _, fileID := range staleIDs {
+			if err := tx.Delete(BucketFileStats, fileID); err != nil {
+				return fmt.Errorf("cannot delete counter: %w", err)
+			}
+
+			if err := tx.Delete(BucketFileFolders, fileID); err != nil {
+				return fmt.Errorf("cannot delete file folder: %w", err)
+			}
+
+			if err := tx.Delete(BucketFiltered, fileID); err != nil {
+				return fmt.Errorf("cannot delete filtered counter: %w", err)
+			}
+
+			// The period uniques are deleted by the rollup
+			if err := tx.Delete(BucketUniques, getKey(uniquesKey(KeyUniquesFile, fileID, "", "")...)); err != nil {
+				return fmt.Errorf("cannot delete uniques: %w", err)
+			}
+		}
+
+		if err := deleteFileUsers(tx, staleIDs); err != nil {
+			return fmt.Errorf("cannot delete file users: %w", err)
+		}
+
+		if len(staleIDs) > 0 {
+			r.log.Info("Delete counters of deleted files", slog.Int("count", len(staleIDs)))
+		}
+
+		return nil
+	})
+}
+
+func saveNewData(tx Tx, ver string, downloads []*entity.Download, categories []*entity.Category) error {
+	for _, download := range downloads {
+		rec := &downloadRecord{
+			SourcePath: download.SourcePath,
+			State: entity.FolderState{
+				Fingerprint: download.Fingerprint,
+				Title:       download.Title,
+				TotalFiles:  download.TotalFiles,
+				Counting:    download.Counting,
+				Access:      download.Access,
+				Hidden:      download.Hidden,
+			},
+			PageSize: download.PageSize,
+			Files:    make([]fileRecord, 0, len(download.Files)),
+		}
+
+		for _, file := range download.Files {
+			rec.Files = append(rec.Files, fileRecord{ID: file.ID, URL: file.URL, MIMEType: file.MIMEType})
+
+			if err := tx.Put(getKey(ver, BucketFilesMap), file.ID, []byte(file.URL)); err != nil {
+				return err
+			}
+
+			if err := tx.Put(getKey(ver, BucketFileDownloads), file.ID, []byte(download.ID)); err != nil {
+				return err
+			}
+
+			if err := tx.Put(BucketFileFolders, file.ID, []byte(download.SourcePath)); err != nil {
+				return err
+			}
+
+			if file.MIMEType != "" {
+				if err := tx.Put(getKey(ver, BucketFileMIMEMap), file.ID, []byte(file.MIMEType)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := putRecord(tx, getKey(ver, BucketDownloads), download.ID, rec); err != nil {
+			return err
+		}
+
+		if err := tx.Put(getKey(ver, BucketPageContent), download.ID, []byte(download.PageContent)); err != nil {
+			return err
+		}
+
+		// The first page is stored as PageContent
+		for i := 1; i < len(download.Pages); i++ {
+			if err := tx.Put(getKey(ver, BucketPageContent), getPageField(download.ID, i+1), []byte(download.Pages[i])); err != nil {
+				return err
+			}
+		}
+
+		if len(download.Variants) > 0 {
+			if err := putRecord(tx, getKey(ver, BucketPageVariants), download.ID, download.Variants); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, category := range categories {
+		rec := &categoryRecord{SourcePath: category.SourcePath, Content: category.PageContent, Pages: category.Pages}
+		if err := putRecord(tx, getKey(ver, BucketCategories), category.ID, rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadUnchanged fills the unchanged download with the files and pages of the version ver.
+func loadUnchanged(tx Tx, ver string, download *entity.Download) error {
+	rec, err := getRecord[downloadRecord](tx, getKey(ver, BucketDownloads), download.ID)
+	if err != nil {
+		return err
+	}
+
+	content := tx.Get(getKey(ver, BucketPageContent), download.ID)
+	if content == nil {
+		return fmt.Errorf("cannot get page")
+	}
+
+	download.Files = make([]*entity.File, 0, len(rec.Files))
+	for _, file := range rec.Files {
+		download.Files = append(download.Files, &entity.File{ID: file.ID, URL: file.URL, MIMEType: file.MIMEType})
+	}
+
+	download.PageContent = string(content)
+	download.PageHash = util.GetIDFromString(&download.PageContent)
+
+	if data := tx.Get(getKey(ver, BucketPageVariants), download.ID); data != nil {
+		if err := json.Unmarshal(data, &download.Variants); err != nil {
+			return fmt.Errorf("cannot unmarshal page variants: %w", err)
+		}
+	}
+
+	if rec.PageSize < 1 {
+		return nil
+	}
+
+	download.PageSize = rec.PageSize
+	download.Pages = []string{download.PageContent}
+
+	pageCount := entity.PageCount(rec.PageSize, len(download.Files))
+	for page := 2; page <= pageCount; page++ {
+		content := tx.Get(getKey(ver, BucketPageContent), getPageField(download.ID, page))
+		if content == nil {
+			return fmt.Errorf("cannot find page %d", page)
+		}
+
+		download.Pages = append(download.Pages, string(content))
+	}
+
+	return nil
+}
+
+/*
+keepFailedFolders records the folders of the files of the version ver that are in the failed folders,
+so their counters outlive the version even if the folders were indexed before the file folders were recorded.
+*/
+func keepFailedFolders(tx Tx, ver string, failed []string) error {
+	if len(failed) < 1 {
+		return nil
+	}
+
+	return forEachRecord(tx, getKey(ver, BucketDownloads), func(_ string, rec *downloadRecord) error {
+		if !util.IsInFolders(rec.SourcePath, failed) {
+			return nil
+		}
+
+		for _, file := range rec.Files {
+			if err := tx.Put(BucketFileFolders, file.ID, []byte(rec.SourcePath)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+/*
+staleFileCounters returns the IDs of the file counters that belong neither to the downloads nor to the version keepVer,
+nor to the files in the failed folders. The folders of the files that have never been downloaded are returned too.
+*/
+func staleFileCounters(tx Tx, downloads []*entity.Download, failed []string, keepVer string) ([]string, error) {
+	filesMap := make(map[string]struct{})
+	err := tx.ForEach(getKey(keepVer, BucketFilesMap), func(fileID string, _ []byte) error {
+		filesMap[fileID] = struct{}{}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get files of version %s: %w", keepVer, err)
+	}
+
+	for _, download := range downloads {
+		for _, file := range download.Files {
+			filesMap[file.ID] = struct{}{}
+		}
+	}
+
+	var staleIDs []string
+	staleMap := make(map[string]struct{})
+
+	err = tx.ForEach(BucketFileFolders, func(fileID string, folder []byte) error {
+		if _, exists := filesMap[fileID]; exists {
+			return nil
+		}
+
+		if util.IsInFolders(string(folder), failed) {
+			filesMap[fileID] = struct{}{}
+		} else {
+			staleMap[fileID] = struct{}{}
+			staleIDs = append(staleIDs, fileID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning file folders: %w", err)
+	}
+
+	err = tx.ForEach(BucketFileStats, func(fileID string, _ []byte) error {
+		_, kept := filesMap[fileID]
+		_, stale := staleMap[fileID]
+		if !kept && !stale {
+			staleIDs = append(staleIDs, fileID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning counters: %w", err)
+	}
+
+	return staleIDs, nil
+}
+
+// deleteFileUsers deletes the unique mode dedup marks of the files.
+func deleteFileUsers(tx Tx, fileIDs []string) error {
+	if len(fileIDs) < 1 {
+		return nil
+	}
+
+	files := make(map[string]struct{}, len(fileIDs))
+	for _, fileID := range fileIDs {
+		files[fileID] = struct{}{}
+	}
+
+	var stale []string
+	err := tx.ForEach(BucketFileUsers, func(key string, _ []byte) error {
+		fileID, _, _ := strings.Cut(key, KeySeparator)
+		if _, exists := files[fileID]; exists {
+			stale = append(stale, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range stale {
+		if err := tx.Delete(BucketFileUsers, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clearExpiredUsers deletes the unique download marks expired at now, Redis does it with TTL. It is run by the periodic rollup.
+func clearExpiredUsers(tx Tx, now time.Time) error {
+	var expired []string
+	err := tx.ForEach(BucketUniqueUsers, func(userID string, value []byte) error {
+		if expiresAt, _ := strconv.ParseInt(string(value), 10, 64); expiresAt <= now.Unix() {
+			expired = append(expired, userID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range expired {
+		if err := tx.Delete(BucketUniqueUsers, userID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Diff compares the downloads with the active version without writing anything.
+func (r *downloadRepository) Diff(ctx context.Context, downloads []*entity.Download, failed []string) (*entity.IndexDiff, error) {
+	diff := &entity.IndexDiff{}
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		for _, download := range downloads {
+			if !download.Unchanged {
+				continue
+			}
+
+			if err := loadUnchanged(tx, ver, download); err != nil {
+				return fmt.Errorf("cannot load unchanged download %s: %w", download.SourcePath, err)
+			}
+		}
+
+		records := make(map[string]*downloadRecord)
+		err := forEachRecord(tx, getKey(ver, BucketDownloads), func(id string, rec *downloadRecord) error {
+			records[id] = rec
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, download := range downloads {
+			rec, exists := records[download.ID]
+			if !exists {
+				diff.Added = append(diff.Added, &entity.DiffShare{ID: download.ID, SourcePath: download.SourcePath, Title: download.Title})
+				for _, file := range download.Files {
+					diff.FilesAdded = append(diff.FilesAdded, &entity.DiffFile{ID: file.ID, DownloadID: download.ID, Path: file.URL})
+				}
+
+				continue
+			}
+			delete(records, download.ID)
+
+			if rec.State.Title != "" && rec.State.Title != download.Title {
+				diff.Retitled = append(diff.Retitled, &entity.DiffShare{ID: download.ID, SourcePath: download.SourcePath, Title: download.Title, OldTitle: rec.State.Title})
+			}
+
+			oldFiles := make(map[string]string, len(rec.Files))
+			for _, file := range rec.Files {
+				oldFiles[file.ID] = file.URL
+			}
+
+			for _, file := range download.Files {
+				if _, exists := oldFiles[file.ID]; !exists {
+					diff.FilesAdded = append(diff.FilesAdded, &entity.DiffFile{ID: file.ID, DownloadID: download.ID, Path: file.URL})
+				}
+				delete(oldFiles, file.ID)
+			}
+
+			for fileID, path := range oldFiles {
+				diff.FilesRemoved = append(diff.FilesRemoved, &entity.DiffFile{ID: fileID, DownloadID: download.ID, Path: path})
+			}
+		}
+
+		for id, rec := range records {
+			diff.Removed = append(diff.Removed, &entity.DiffShare{ID: id, SourcePath: rec.SourcePath, Title: rec.State.Title})
+			for _, file := range rec.Files {
+				diff.FilesRemoved = append(diff.FilesRemoved, &entity.DiffFile{ID: file.ID, DownloadID: id, Path: file.URL})
+			}
+		}
+
+		for _, file := range diff.FilesRemoved {
+			file.Counter = getCounter(tx, file.ID)
+		}
+
+		// The active version becomes the previous one, its counters are kept
+		staleIDs, err := staleFileCounters(tx, downloads, failed, ver)
+		if err != nil {
+			return err
+		}
+		diff.CountersDeleted = len(staleIDs)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(diff.Added, compareDiffShares)
+	slices.SortFunc(diff.Removed, compareDiffShares)
+	slices.SortFunc(diff.Retitled, compareDiffShares)
+	slices.SortFunc(diff.FilesAdded, compareDiffFiles)
+	slices.SortFunc(diff.FilesRemoved, compareDiffFiles)
+
+	return diff, nil
+}
+
+/*
+Rollback makes the previous version active again. The previous version is kept intact until the next index.
+It returns the version that is active now.
+*/
+func (r *downloadRepository) Rollback(ctx context.Context) (string, error) {
+	var ver string
+
+	err := r.store.Update(func(tx Tx) error {
+		verActive, verStandby := getVersions(tx)
+
+		var count int
+		err := tx.ForEach(getKey(verStandby, BucketDownloads), func(string, []byte) error {
+			count++
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot get previous version: %w", err)
+		}
+
+		if count < 1 {
+			return common.ErrNoPreviousVersionError
+		}
+
+		if err := tx.Put(BucketMeta, KeyActiveVersion, []byte(verStandby)); err != nil {
+			return fmt.Errorf("cannot switch to previous version: %w", err)
+		}
+
+		r.log.Info("Rollback", slog.String("from_version", verActive), slog.String("to_version", verStandby))
+		ver = verStandby
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ver, nil
+}
+
+// WatchVersion does nothing: the embedded store is used by a single instance and the version is read on every request.
+func (r *downloadRepository) WatchVersion(ctx context.Context) {}
+
+// FolderStates returns the folder states of the active version keyed by download ID.
+func (r *downloadRepository) FolderStates(ctx context.Context) (map[string]*entity.FolderState, error) {
+	states := make(map[string]*entity.FolderState)
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		return forEachRecord(tx, getKey(ver, BucketDownloads), func(id string, rec *downloadRecord) error {
+			states[id] = &rec.State
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get folder states: %w", err)
+	}
+
+	return states, nil
+}
+
+func (r *downloadRepository) GetFilePath(ctx context.Context, id string) (string, error) {
+	var path string
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		value := tx.Get(getKey(ver, BucketFilesMap), id)
+		if value == nil {
+			return common.ErrFileNotFoundError
+		}
+		path = string(value)
+
+		return nil
+	})
+
+	return path, err
+}
+
+// GetFileMIMEType returns the MIME type of the file, an empty string if it is unknown.
+func (r *downloadRepository) GetFileMIMEType(ctx context.Context, id string) (string, error) {
+	var mimeType string
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+		mimeType = string(tx.Get(getKey(ver, BucketFileMIMEMap), id))
+
+		return nil
+	})
+
+	return mimeType, err
+}
+
+// GetAccess returns the access restriction of the download, nil if it is public.
+func (r *downloadRepository) GetAccess(ctx context.Context, id string) (*entity.Access, error) {
+	var access *entity.Access
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		var err error
+		access, err = getAccess(tx, ver, id)
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get download %s access: %w", id, err)
+	}
+
+	return access, nil
+}
+
+// GetFileAccess returns the download of the file and its access restriction, nil if it is public.
+func (r *downloadRepository) GetFileAccess(ctx context.Context, fileID string) (string, *entity.Access, error) {
+	var (
+		downloadID string
+		access     *entity.Access
+	)
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		downloadID = string(tx.Get(getKey(ver, BucketFileDownloads), fileID))
+		if downloadID == "" {
+			return nil
+		}
+
+		var err error
+		access, err = getAccess(tx, ver, downloadID)
+
+		return err
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot get file %s access: %w", fileID, err)
+	}
+
+	return downloadID, access, nil
+}
+
+func getAccess(tx Tx, ver, id string) (*entity.Access, error) {
+	if tx.Get(getKey(ver, BucketDownloads), id) == nil {
+		return nil, nil
+	}
+
+	rec, err := getRecord[downloadRecord](tx, getKey(ver, BucketDownloads), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec.State.Access, nil
+}
+
+// GetCountingPolicy returns the counting policy of the file distribution, nil if it does not override the global one.
+func (r *downloadRepository) GetCountingPolicy(ctx context.Context, fileID string) (*entity.CountingPolicy, error) {
+	var policy *entity.CountingPolicy
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		downloadID := tx.Get(getKey(ver, BucketFileDownloads), fileID)
+		if downloadID == nil {
+			return nil
+		}
+
+		rec, err := getRecord[downloadRecord](tx, getKey(ver, BucketDownloads), string(downloadID))
+		if err != nil {
+			return err
+		}
+		policy = rec.State.Counting
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get file %s counting policy: %w", fileID, err)
+	}
+
+	return policy, nil
+}
+
+/*
+CountDownload counts the download of the file by the user if the resolved counting policy allows it.
+The dedup check, the counter and the history are updated in one transaction.
+It returns the current counter of the file and whether the download has been counted.
+*/
+func (r *downloadRepository) CountDownload(ctx context.Context, downloader *entity.Downloader, fileID string, policy *entity.CountingPolicy, t time.Time) (int64, bool, error) {
+	var (
+		counter int64
+		counted bool
+	)
+
+	err := r.store.Update(func(tx Tx) error {
+		counter = getCounter(tx, fileID)
+
+		// The user is added to the unique downloaders also on a repeat, the day may have changed since the first download
+		ver, _ := getVersions(tx)
+		if !downloader.IsAnonymous() {
+			if err := addUniques(tx, fileID, string(tx.Get(getKey(ver, BucketFileDownloads), fileID)), downloader.ID(), t, r.stats.Location); err != nil {
+				return err
+			}
+		}
+
+		isNew, err := markDownloader(tx, downloader, fileID, policy, t)
+		if err != nil || !isNew {
+			return err
+		}
+
+		counter++
+		counted = true
+		if err := tx.Put(BucketFileStats, fileID, []byte(strconv.FormatInt(counter, 10))); err != nil {
+			return err
+		}
+
+		return incrCounter(tx, BucketStatsHourly, getKey(entity.StatBucketKey(entity.StatPeriodHour, t, time.UTC), fileID), 1)
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot count file %s download: %w", fileID, err)
+	}
+
+	return counter, counted, nil
+}
+
+/*
+markDownloader marks every dedup ID of the downloader as seen by the policy mode.
+It returns false if any of them has been seen before, so the download is a repeat.
+*/
+func markDownloader(tx Tx, downloader *entity.Downloader, fileID string, policy *entity.CountingPolicy, t time.Time) (bool, error) {
+	if policy.Mode == entity.CountingModeEvery {
+		return true, nil
+	}
+
+	isNew := true
+	for _, userID := range downloader.DedupIDs(policy.IsCookieOnly()) {
+		if policy.Mode == entity.CountingModeUnique {
+			key := getKey(fileID, userID)
+			if tx.Get(BucketFileUsers, key) != nil {
+				isNew = false
+
+				continue
+			}
+
+			if err := tx.Put(BucketFileUsers, key, []byte("1")); err != nil {
+				return false, err
+			}
+
+			continue
+		}
+
+		key := getKey(userID, fileID)
+		if value := tx.Get(BucketUniqueUsers, key); value != nil {
+			if expiresAt, _ := strconv.ParseInt(string(value), 10, 64); expiresAt > t.Unix() {
+				isNew = false
+
+				continue
+			}
+		}
+
+		expiresAt := t.Add(policy.Window).Unix()
+		if err := tx.Put(BucketUniqueUsers, key, []byte(strconv.FormatInt(expiresAt, 10))); err != nil {
+			return false, err
+		}
+	}
+
+	return isNew, nil
+}
+
+/*
+GetDownloadCounters returns counters of the download files.
+If page > 0 and the download is paginated, then only the files of that page are returned.
+*/
+func (r *downloadRepository) GetDownloadCounters(ctx context.Context, id string, page int) (map[string]int, error) {
+	counters := make(map[string]int)
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		rec, err := getRecord[downloadRecord](tx, getKey(ver, BucketDownloads), id)
+		if err != nil {
+			// The Redis repository returns no counters for an unknown download as well
+			return nil
+		}
+
+		files := rec.Files
+		if page > 0 && rec.PageSize > 0 {
+			start, end := entity.NewPager(page, rec.PageSize, len(files)).Bounds()
+			files = files[start:end]
+		}
+
+		for _, file := range files {
+			counters[file.ID] = int(getCounter(tx, file.ID))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counters, nil
+}
+
+// GetPage returns the page of the download at the request time, the files outside their windows are not listed on it.
+func (r *downloadRepository) GetPage(ctx context.Context, id string, page int) (string, error) {
+	return r.getContent(func(tx Tx, ver string) []byte {
+		content := tx.Get(getKey(ver, BucketPageContent), getPageField(id, page))
+		if content == nil {
+			return nil
+		}
+
+		// Only the distributions whose files have publish windows have the variants
+		variants, err := getRecord[[]*entity.PageVariant](tx, getKey(ver, BucketPageVariants), id)
+		if err != nil {
+			return content
+		}
+
+		if str, ok := entity.PageAt(*variants, page, r.now()); ok {
+			if str == "" {
+				return nil
+			}
+
+			return []byte(str)
+		}
+
+		return content
+	})
+}
+
+// GetCategory returns the listing page of the category at the request time, common.ErrPageNotFoundError if no item is listed now.
+func (r *downloadRepository) GetCategory(ctx context.Context, id string) (string, error) {
+	return r.getContent(func(tx Tx, ver string) []byte {
+		rec, err := getRecord[categoryRecord](tx, getKey(ver, BucketCategories), id)
+		if err != nil {
+			return nil
+		}
+
+		content := entity.CategoryContentAt(rec.Content, rec.Pages, r.now())
+		if content == "" {
+			return nil
+		}
+
+		return []byte(content)
+	})
+}
+
+// getContent returns the content of the active version or common.ErrPageNotFoundError.
+func (r *downloadRepository) getContent(get func(tx Tx, ver string) []byte) (string, error) {
+	var content string
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		value := get(tx, ver)
+		if value == nil {
+			return common.ErrPageNotFoundError
+		}
+		content = string(value)
+
+		return nil
+	})
+
+	return content, err
+}
+
+func (r *downloadRepository) DownloadCounterIterator(ctx context.Context) (iter.Seq2[*entity.DownloadCounters, error], error) {
+	var counters []*entity.DownloadCounters
+
+	err := r.store.View(func(tx Tx) error {
+		ver, _ := getVersions(tx)
+
+		return forEachRecord(tx, getKey(ver, BucketDownloads), func(id string, rec *downloadRecord) error {
+			dc := &entity.DownloadCounters{
+				ID:         id,
+				SourcePath: rec.SourcePath,
+			}
+
+			for _, file := range rec.Files {
+				fileName := filepath.Base(file.URL)
+				dc.Files = append(dc.Files, entity.FileCounter{
+					ID:         file.ID,
+					Name:       fileName,
+					SourcePath: filepath.Join(rec.SourcePath, fileName),
+					Counter:    getCounter(tx, file.ID),
+					Uniques:    countUniques(tx, uniquesKey(KeyUniquesFile, file.ID, "", "")),
+					Filtered:   getStatCounter(tx, BucketFiltered, file.ID),
+				})
+			}
+			dc.Uniques = countUniques(tx, uniquesKey(KeyUniquesDownload, id, "", ""))
+
+			counters = append(counters, dc)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot getfolder list: %w", err)
+	}
+
+	return func(yield func(*entity.DownloadCounters, error) bool) {
+		for _, dc := range counters {
+			if !yield(dc, nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// getVersions returns the active and the standby versions. The first version is active by default.
+func getVersions(tx Tx) (string, string) {
+	if string(tx.Get(BucketMeta, KeyActiveVersion)) == KeyVersion2 {
+		return KeyVersion2, KeyVersion1
+	}
+
+	return KeyVersion1, KeyVersion2
+}
+
+func getCounter(tx Tx, fileID string) int64 {
+	counter, _ := strconv.ParseInt(string(tx.Get(BucketFileStats, fileID)), 10, 64)
+
+	return counter
+}
+
+func getRecord[T any](tx Tx, bucket, key string) (*T, error) {
+	value := tx.Get(bucket, key)
+	if value == nil {
+		return nil, fmt.Errorf("cannot find %s in %s", key, bucket)
+	}
+
+	var rec T
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal %s: %w", key, err)
+	}
+
+	return &rec, nil
+}
+
+func putRecord(tx Tx, bucket, key string, rec any) error {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %s: %w", key, err)
+	}
+
+	return tx.Put(bucket, key, value)
+}
+
+func forEachRecord[T any](tx Tx, bucket string, fn func(key string, rec *T) error) error {
+	return tx.ForEach(bucket, func(key string, value []byte) error {
+		var rec T
+		if err := json.Unmarshal(value, &rec); err != nil {
+			return fmt.Errorf("cannot unmarshal %s: %w", key, err)
+		}
+
+		return fn(key, &rec)
+	})
+}
+
+func compareDiffShares(a, b *entity.DiffShare) int {
+	return strings.Compare(a.SourcePath, b.SourcePath)
+}
+
+func compareDiffFiles(a, b *entity.DiffFile) int {
+	return strings.Compare(a.Path, b.Path)
+}
+
+func getKey(keys ...string) string {
+	return strings.Join(keys, KeySeparator)
+}
+
+// getPageField returns the page content field. The first page is stored under the download ID.
+func getPageField(id string, page int) string {
+	if page < 2 {
+		return id
+	}
+
+	return getKey(id, strconv.Itoa(page))
+}
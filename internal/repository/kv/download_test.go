@@ -0,0 +1,489 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/stretchr/testify/require"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { bs.Close() })
+
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"bolt":   bs,
+	}
+}
+
+func testDownload(id, title string, files ...string) *entity.Download {
+	download := &entity.Download{ID: id, Title: title, SourcePath: "/data/" + id, PageContent: "page " + id, Fingerprint: "fp " + id}
+	for _, file := range files {
+		download.Files = append(download.Files, &entity.File{ID: file, URL: "/data/" + id + "/" + file})
+	}
+	download.TotalFiles = len(download.Files)
+
+	return download
+}
+
+func testPolicy(mode string, cookieOnly bool) *entity.CountingPolicy {
+	return &entity.CountingPolicy{Mode: mode, Window: 24 * time.Hour, CookieOnly: &cookieOnly}
+}
+
+func TestDownloadRepository(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewDownloadRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+
+			// First version: a paginated download, a plain one and a category
+			one := testDownload("one", "One", "f1", "f2")
+			one.PageSize = 1
+			one.Pages = []string{one.PageContent, "page one:2"}
+			two := testDownload("two", "Two", "f3")
+			category := &entity.Category{ID: "cat", SourcePath: "/data", PageContent: "category"}
+
+			require.NoError(t, repo.Save(ctx, []*entity.Download{one, two}, []*entity.Category{category}, nil))
+
+			page, err := repo.GetPage(ctx, "one", 2)
+			require.NoError(t, err)
+			require.Equal(t, "page one:2", page)
+
+			content, err := repo.GetCategory(ctx, "cat")
+			require.NoError(t, err)
+			require.Equal(t, "category", content)
+
+			path, err := repo.GetFilePath(ctx, "f3")
+			require.NoError(t, err)
+			require.Equal(t, "/data/two/f3", path)
+
+			infos, err := repo.Info(ctx)
+			require.NoError(t, err)
+			require.Len(t, infos, 3)
+
+			// Counters and unique downloads
+			now := time.Now()
+			policy := testPolicy(entity.CountingModeWindow, false)
+			for _, d := range []struct {
+				userID, fileID string
+				counter        int64
+				counted        bool
+			}{
+				{"user1", "f1", 1, true},
+				{"user1", "f1", 1, false},
+				{"user2", "f1", 2, true},
+				{"user1", "f3", 1, true},
+			} {
+				counter, counted, err := repo.CountDownload(ctx, &entity.Downloader{Fingerprint: d.userID}, d.fileID, policy, now)
+				require.NoError(t, err)
+				require.Equal(t, d.counter, counter, "the current counter is returned also for a repeat")
+				require.Equal(t, d.counted, counted)
+			}
+
+			_, counted, err := repo.CountDownload(ctx, &entity.Downloader{Fingerprint: "user1"}, "f1", policy, now.Add(policy.Window+time.Second))
+			require.NoError(t, err)
+			require.True(t, counted, "dedup expires")
+
+			srepo := NewStatsRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+			uniques, fileUniques, err := srepo.Uniques(ctx, "one", []string{"f1", "f2"})
+			require.NoError(t, err)
+			require.Equal(t, int64(2), uniques)
+			require.Equal(t, map[string]int64{"f1": 2, "f2": 0}, fileUniques)
+
+			// Filtered downloads are counted apart from the counters
+			require.NoError(t, srepo.CountFiltered(ctx, "f1", "user_agent"))
+			require.NoError(t, srepo.CountFiltered(ctx, "f3", "user_agent"))
+			require.NoError(t, srepo.CountFiltered(ctx, "f3", "missing_header"))
+
+			filtered, err := srepo.Filtered(ctx, []string{"f1", "f2"})
+			require.NoError(t, err)
+			require.Equal(t, map[string]int64{"f1": 1, "f2": 0}, filtered)
+
+			reasons, err := srepo.FilteredReasons(ctx)
+			require.NoError(t, err)
+			require.Equal(t, map[string]int64{"user_agent": 2, "missing_header": 1}, reasons)
+
+			counters, err := repo.GetDownloadCounters(ctx, "one", 2)
+			require.NoError(t, err)
+			require.Equal(t, map[string]int{"f2": 0}, counters)
+
+			// Second version: "one" is unchanged, "two" is removed
+			states, err := repo.FolderStates(ctx)
+			require.NoError(t, err)
+			require.Equal(t, "fp one", states["one"].Fingerprint)
+
+			unchanged := &entity.Download{ID: "one", Title: "One", SourcePath: "/data/one", Fingerprint: "fp one", Unchanged: true}
+
+			diff, err := repo.Diff(ctx, []*entity.Download{unchanged, testDownload("three", "Three", "f4")}, nil)
+			require.NoError(t, err)
+			require.Len(t, diff.Added, 1)
+			require.Len(t, diff.Removed, 1)
+			require.Len(t, diff.FilesRemoved, 1)
+			require.Equal(t, int64(1), diff.FilesRemoved[0].Counter)
+			require.Zero(t, diff.CountersDeleted, "counters of the active version are kept")
+
+			unchanged = &entity.Download{ID: "one", Title: "One", SourcePath: "/data/one", Fingerprint: "fp one", Unchanged: true}
+			require.NoError(t, repo.Save(ctx, []*entity.Download{unchanged}, nil, nil))
+
+			page, err = repo.GetPage(ctx, "one", 2)
+			require.NoError(t, err)
+			require.Equal(t, "page one:2", page, "unchanged pages are copied")
+
+			_, err = repo.GetPage(ctx, "two", 1)
+			require.ErrorIs(t, err, common.ErrPageNotFoundError)
+
+			// Rollback brings "two" back with its counter
+			ver, err := repo.Rollback(ctx)
+			require.NoError(t, err)
+			require.Equal(t, KeyVersion2, ver)
+
+			counters, err = repo.GetDownloadCounters(ctx, "two", 0)
+			require.NoError(t, err)
+			require.Equal(t, map[string]int{"f3": 1}, counters)
+
+			ver, err = repo.Rollback(ctx)
+			require.NoError(t, err)
+			require.Equal(t, KeyVersion1, ver)
+
+			// The next index drops the counters of the files that are in neither version
+			require.NoError(t, repo.Save(ctx, []*entity.Download{testDownload("one", "One", "f1", "f2")}, nil, nil))
+
+			counters, err = repo.GetDownloadCounters(ctx, "one", 0)
+			require.NoError(t, err)
+			require.Equal(t, map[string]int{"f1": 3, "f2": 0}, counters)
+
+			require.NoError(t, store.View(func(tx Tx) error {
+				require.Nil(t, tx.Get(BucketFileStats, "f3"))
+				require.Nil(t, tx.Get(BucketFiltered, "f3"))
+
+				return nil
+			}))
+		})
+	}
+}
+
+func TestFailedFolders(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	failed := []string{"/data/two"}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewDownloadRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+
+			require.NoError(t, repo.Save(ctx, []*entity.Download{testDownload("one", "One", "f1"), testDownload("two", "Two", "f2")}, nil, nil))
+
+			for _, fileID := range []string{"f1", "f2"} {
+				_, _, err := repo.CountDownload(ctx, &entity.Downloader{Fingerprint: "user1"}, fileID, testPolicy(entity.CountingModeEvery, false), time.Now())
+				require.NoError(t, err)
+			}
+
+			hasCounter := func(fileID string) bool {
+				var exists bool
+				require.NoError(t, store.View(func(tx Tx) error {
+					exists = tx.Get(BucketFileStats, fileID) != nil
+
+					return nil
+				}))
+
+				return exists
+			}
+
+			// "two" fails to scan in two index runs, its counter outlives both versions
+			for range 2 {
+				diff, err := repo.Diff(ctx, []*entity.Download{testDownload("one", "One", "f1")}, failed)
+				require.NoError(t, err)
+				require.Zero(t, diff.CountersDeleted)
+
+				require.NoError(t, repo.Save(ctx, []*entity.Download{testDownload("one", "One", "f1")}, nil, failed))
+				require.True(t, hasCounter("f2"))
+			}
+
+			// The folder is scanned and the file is gone
+			diff, err := repo.Diff(ctx, []*entity.Download{testDownload("one", "One", "f1"), testDownload("two", "Two", "f3")}, nil)
+			require.NoError(t, err)
+			require.Equal(t, 1, diff.CountersDeleted)
+
+			require.NoError(t, repo.Save(ctx, []*entity.Download{testDownload("one", "One", "f1"), testDownload("two", "Two", "f3")}, nil, nil))
+			require.False(t, hasCounter("f2"))
+			require.True(t, hasCounter("f1"))
+		})
+	}
+}
+
+func TestCategoryPages(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	now := time.Now()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewDownloadRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+
+			categories := []*entity.Category{
+				{ID: "listed", SourcePath: "/data/listed", PageContent: "before", Pages: []*entity.CategoryPage{
+					{From: now.Add(-time.Hour), Content: "now"},
+					{From: now.Add(time.Hour), Content: "later"},
+				}},
+				{ID: "pending", SourcePath: "/data/pending", Pages: []*entity.CategoryPage{{From: now.Add(time.Hour), Content: "later"}}},
+			}
+			require.NoError(t, repo.Save(ctx, []*entity.Download{testDownload("one", "One", "f1")}, categories, nil))
+
+			content, err := repo.GetCategory(ctx, "listed")
+			require.NoError(t, err)
+			require.Equal(t, "now", content)
+
+			_, err = repo.GetCategory(ctx, "pending")
+			require.ErrorIs(t, err, common.ErrPageNotFoundError, "no item is listed yet")
+		})
+	}
+}
+
+func TestPageVariants(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	now := time.Now()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewDownloadRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+			repo.now = func() time.Time { return now }
+
+			// A file is published in an hour and another one expires in two hours
+			download := testDownload("one", "One", "f1")
+			download.Variants = []*entity.PageVariant{
+				{From: now.Add(time.Hour), Pages: []string{"published"}},
+				{From: now.Add(2 * time.Hour), Pages: []string{"expired"}},
+			}
+			require.NoError(t, repo.Save(ctx, []*entity.Download{download, testDownload("two", "Two", "f2")}, nil, nil))
+
+			// The unchanged download keeps its variants
+			unchanged := &entity.Download{ID: "one", Title: "One", SourcePath: "/data/one", Fingerprint: "fp one", Unchanged: true}
+			require.NoError(t, repo.Save(ctx, []*entity.Download{unchanged, testDownload("two", "Two", "f2")}, nil, nil))
+
+			for _, c := range []struct {
+				at      time.Duration
+				id      string
+				content string
+			}{
+				{0, "one", "page one"},
+				{90 * time.Minute, "one", "published"},
+				{2 * time.Hour, "one", "expired"},
+				{3 * time.Hour, "one", "expired"},
+				{3 * time.Hour, "two", "page two"},
+			} {
+				repo.now = func() time.Time { return now.Add(c.at) }
+
+				content, err := repo.GetPage(ctx, c.id, 0)
+				require.NoError(t, err)
+				require.Equal(t, c.content, content, "%s at %s", c.id, c.at)
+			}
+		})
+	}
+}
+
+func TestCountingPolicy(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	now := time.Now()
+	later := now.Add(48 * time.Hour)
+
+	// Two users behind one address and browser, the second one has lost the cookie
+	first := &entity.Downloader{CookieID: "c:1", Fingerprint: "f:1"}
+	second := &entity.Downloader{CookieID: "c:2", Fingerprint: "f:1"}
+	lost := &entity.Downloader{Fingerprint: "f:1"}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewDownloadRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+
+			download := testDownload("one", "One", "every", "window", "unique", "cookie")
+			download.Counting = &entity.CountingPolicy{Mode: entity.CountingModeUnique}
+			require.NoError(t, repo.Save(ctx, []*entity.Download{download, testDownload("two", "Two", "other")}, nil, nil))
+
+			policy, err := repo.GetCountingPolicy(ctx, "unique")
+			require.NoError(t, err)
+			require.Equal(t, download.Counting, policy)
+
+			policy, err = repo.GetCountingPolicy(ctx, "other")
+			require.NoError(t, err)
+			require.Nil(t, policy, "the global policy is used")
+
+			for _, c := range []struct {
+				fileID     string
+				policy     *entity.CountingPolicy
+				downloader *entity.Downloader
+				t          time.Time
+				counted    bool
+			}{
+				{"every", testPolicy(entity.CountingModeEvery, false), first, now, true},
+				{"every", testPolicy(entity.CountingModeEvery, false), first, now, true},
+				{"window", testPolicy(entity.CountingModeWindow, false), first, now, true},
+				{"window", testPolicy(entity.CountingModeWindow, false), second, now, false},
+				{"window", testPolicy(entity.CountingModeWindow, false), lost, later, true},
+				{"window", testPolicy(entity.CountingModeWindow, false), first, later, false},
+				{"window", testPolicy(entity.CountingModeWindow, false), &entity.Downloader{}, later, true},
+				{"window", testPolicy(entity.CountingModeWindow, false), &entity.Downloader{}, later, true},
+				{"unique", testPolicy(entity.CountingModeUnique, false), first, now, true},
+				{"unique", testPolicy(entity.CountingModeUnique, false), lost, later, false},
+				{"cookie", testPolicy(entity.CountingModeUnique, true), first, now, true},
+				{"cookie", testPolicy(entity.CountingModeUnique, true), second, now, true},
+				{"cookie", testPolicy(entity.CountingModeUnique, true), first, later, false},
+				{"cookie", testPolicy(entity.CountingModeUnique, true), lost, later, true},
+				{"cookie", testPolicy(entity.CountingModeUnique, true), lost, later, false},
+			} {
+				_, counted, err := repo.CountDownload(ctx, c.downloader, c.fileID, c.policy, c.t)
+				require.NoError(t, err)
+				require.Equal(t, c.counted, counted, "%s %+v", c.fileID, c.downloader)
+			}
+
+			counters, err := repo.GetDownloadCounters(ctx, "one", 0)
+			require.NoError(t, err)
+			require.Equal(t, map[string]int{"every": 2, "window": 4, "unique": 1, "cookie": 3}, counters)
+
+			srepo := NewStatsRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+			_, fileUniques, err := srepo.Uniques(ctx, "one", []string{"window"})
+			require.NoError(t, err)
+			require.Equal(t, map[string]int64{"window": 3}, fileUniques, "anonymous downloads are not unique downloaders")
+
+			// The rollup deletes the expired window marks, as Redis does by TTL
+			marks := func() int {
+				var count int
+				require.NoError(t, store.View(func(tx Tx) error {
+					return tx.ForEach(BucketUniqueUsers, func(string, []byte) error {
+						count++
+
+						return nil
+					})
+				}))
+
+				return count
+			}
+
+			require.Positive(t, marks())
+			require.NoError(t, srepo.Rollup(ctx, later))
+			require.Positive(t, marks(), "the marks of the window are kept")
+			require.NoError(t, srepo.Rollup(ctx, later.Add(48*time.Hour)))
+			require.Zero(t, marks())
+		})
+	}
+}
+
+func TestLockRepository(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			locker := NewLockRepository(store, log)
+
+			token, err := locker.Acquire(ctx, "index", time.Minute)
+			require.NoError(t, err)
+
+			_, err = locker.Acquire(ctx, "index", time.Minute)
+			require.ErrorIs(t, err, common.ErrLockIsHeldError)
+
+			require.NoError(t, locker.Release(ctx, "index", token))
+
+			_, err = locker.Acquire(ctx, "index", -time.Second)
+			require.NoError(t, err)
+
+			_, err = locker.Acquire(ctx, "index", time.Minute)
+			require.NoError(t, err, "expired lock can be taken")
+		})
+	}
+}
+
+func TestSaltRepository(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewSaltRepository(store, log)
+
+			salt, err := repo.DailySalt(ctx, "2025-03-01", "first", -time.Second)
+			require.NoError(t, err)
+			require.Equal(t, "first", salt)
+
+			salt, err = repo.DailySalt(ctx, "2025-03-01", "second", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, "second", salt, "expired salt is replaced")
+
+			salt, err = repo.DailySalt(ctx, "2025-03-01", "third", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, "second", salt, "the first stored salt wins")
+		})
+	}
+}
+
+func TestMemoryStoreRollback(t *testing.T) {
+	store := NewMemoryStore()
+	require.NoError(t, store.Update(func(tx Tx) error {
+		return tx.Put("b", "k", []byte("v1"))
+	}))
+
+	errTest := errors.New("test")
+	err := store.Update(func(tx Tx) error {
+		require.NoError(t, tx.Put("b", "k", []byte("v2")))
+		require.NoError(t, tx.Put("b", "new", []byte("v")))
+		require.NoError(t, tx.DeleteBucket("b"))
+
+		return errTest
+	})
+	require.ErrorIs(t, err, errTest)
+
+	require.NoError(t, store.View(func(tx Tx) error {
+		require.Equal(t, []byte("v1"), tx.Get("b", "k"))
+		require.Nil(t, tx.Get("b", "new"))
+
+		return nil
+	}))
+}
+
+func TestAccess(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewDownloadRepository(store, &config.StatsConfig{Location: time.UTC}, log)
+
+			protected := testDownload("one", "One", "f1")
+			protected.Access = &entity.Access{Tokens: []string{"token"}, AddressRules: entity.AddressRules{Allow: []string{"10.0.0.0/8"}}}
+			protected.Access.Files = map[string]entity.Schedule{"f1": {PublishAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}}
+			require.NoError(t, repo.Save(ctx, []*entity.Download{protected, testDownload("two", "Two", "f2")}, nil, nil))
+
+			access, err := repo.GetAccess(ctx, "one")
+			require.NoError(t, err)
+			require.Equal(t, protected.Access, access)
+
+			access, err = repo.GetAccess(ctx, "two")
+			require.NoError(t, err)
+			require.Nil(t, access, "the download is public")
+
+			downloadID, access, err := repo.GetFileAccess(ctx, "f1")
+			require.NoError(t, err)
+			require.Equal(t, "one", downloadID)
+			require.Equal(t, protected.Access, access)
+
+			downloadID, access, err = repo.GetFileAccess(ctx, "f2")
+			require.NoError(t, err)
+			require.Equal(t, "two", downloadID)
+			require.Nil(t, access)
+		})
+	}
+}
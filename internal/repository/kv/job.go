@@ -0,0 +1,103 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+const (
+	KeyIndexJobs = "jobs" // JSON list of the finished index jobs in BucketMeta, the newest first
+)
+
+type jobRepository struct {
+	store Store
+	size  int
+	log   *slog.Logger
+}
+
+// NewJobRepository creates the repository of the index job history. size is the number of jobs to keep.
+func NewJobRepository(store Store, size int, log *slog.Logger) *jobRepository {
+	return &jobRepository{
+		store: store,
+		size:  size,
+		log:   log.With(slog.String("item", "KVJobRepository")),
+	}
+}
+
+// SaveJob adds the finished job to the history and drops the oldest jobs.
+func (r *jobRepository) SaveJob(ctx context.Context, job *entity.IndexJob) error {
+	err := r.store.Update(func(tx Tx) error {
+		jobs, err := getJobs(tx)
+		if err != nil {
+			return err
+		}
+
+		jobs = append([]*entity.IndexJob{job}, jobs...)
+		if len(jobs) > r.size {
+			jobs = jobs[:r.size]
+		}
+
+		data, err := json.Marshal(jobs)
+		if err != nil {
+			return fmt.Errorf("cannot marshal jobs: %w", err)
+		}
+
+		return tx.Put(BucketMeta, KeyIndexJobs, data)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save job: %w", err)
+	}
+
+	return nil
+}
+
+// Jobs returns the job history, the newest first.
+func (r *jobRepository) Jobs(ctx context.Context) ([]*entity.IndexJob, error) {
+	var jobs []*entity.IndexJob
+
+	err := r.store.View(func(tx Tx) error {
+		var err error
+		jobs, err = getJobs(tx)
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get jobs: %w", err)
+	}
+
+	return jobs, nil
+}
+
+func (r *jobRepository) Job(ctx context.Context, id string) (*entity.IndexJob, error) {
+	jobs, err := r.Jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		if job.ID == id {
+			return job, nil
+		}
+	}
+
+	return nil, common.ErrJobNotFoundError
+}
+
+func getJobs(tx Tx) ([]*entity.IndexJob, error) {
+	data := tx.Get(BucketMeta, KeyIndexJobs)
+	if data == nil {
+		return nil, nil
+	}
+
+	var jobs []*entity.IndexJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal jobs: %w", err)
+	}
+
+	return jobs, nil
+}
@@ -0,0 +1,88 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jgivc/fetchtracker/internal/common"
+)
+
+const (
+	KeyLock = "lock" // lock:name in BucketMeta: JSON of lockRecord
+)
+
+type lockRecord struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type lockRepository struct {
+	store Store
+	log   *slog.Logger
+}
+
+// NewLockRepository creates the lock stored in the embedded store, it works the same way as the Redis one.
+func NewLockRepository(store Store, log *slog.Logger) *lockRepository {
+	return &lockRepository{
+		store: store,
+		log:   log.With(slog.String("item", "KVLockRepository")),
+	}
+}
+
+/*
+Acquire takes the lock name for ttl and returns the token to release it.
+It returns common.ErrLockIsHeldError if the lock is held by someone else.
+*/
+func (r *lockRepository) Acquire(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	token := uuid.New().String()
+
+	err := r.store.Update(func(tx Tx) error {
+		if rec, err := getLock(tx, name); err == nil && rec.ExpiresAt.After(time.Now()) {
+			return common.ErrLockIsHeldError
+		}
+
+		return putRecord(tx, BucketMeta, getKey(KeyLock, name), &lockRecord{Token: token, ExpiresAt: time.Now().Add(ttl)})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Release releases the lock if it is still held by the token.
+func (r *lockRepository) Release(ctx context.Context, name, token string) error {
+	err := r.store.Update(func(tx Tx) error {
+		rec, err := getLock(tx, name)
+		if err != nil || rec.Token != token {
+			r.log.Warn("Lock has expired before release", slog.String("name", name))
+
+			return nil
+		}
+
+		return tx.Delete(BucketMeta, getKey(KeyLock, name))
+	})
+	if err != nil {
+		return fmt.Errorf("cannot release lock %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func getLock(tx Tx, name string) (*lockRecord, error) {
+	data := tx.Get(BucketMeta, getKey(KeyLock, name))
+	if data == nil {
+		return nil, fmt.Errorf("lock %s is not found", name)
+	}
+
+	var rec lockRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal lock: %w", err)
+	}
+
+	return &rec, nil
+}
@@ -0,0 +1,146 @@
+package kv
+
+import (
+	"errors"
+	"sync"
+)
+
+var errReadOnlyTx = errors.New("read-only transaction")
+
+// memoryStore keeps the data in memory. The data is lost on restart, it is meant for tests and trials.
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{store: s})
+}
+
+func (s *memoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{store: s, writable: true}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// undo restores a bucket or a single key changed by the transaction.
+type undo struct {
+	bucket string
+	key    string
+	value  []byte
+	exists bool
+	whole  map[string][]byte // The deleted bucket, if the whole bucket was deleted
+}
+
+type memoryTx struct {
+	store    *memoryStore
+	writable bool
+	undo     []undo
+}
+
+func (t *memoryTx) Get(bucket, key string) []byte {
+	return t.store.buckets[bucket][key]
+}
+
+func (t *memoryTx) Put(bucket, key string, value []byte) error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+
+	b, exists := t.store.buckets[bucket]
+	if !exists {
+		b = make(map[string][]byte)
+		t.store.buckets[bucket] = b
+	}
+
+	old, exists := b[key]
+	t.undo = append(t.undo, undo{bucket: bucket, key: key, value: old, exists: exists})
+	b[key] = append([]byte(nil), value...)
+
+	return nil
+}
+
+func (t *memoryTx) Delete(bucket, key string) error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+
+	old, exists := t.store.buckets[bucket][key]
+	if !exists {
+		return nil
+	}
+
+	t.undo = append(t.undo, undo{bucket: bucket, key: key, value: old, exists: true})
+	delete(t.store.buckets[bucket], key)
+
+	return nil
+}
+
+func (t *memoryTx) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	for key, value := range t.store.buckets[bucket] {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTx) DeleteBucket(bucket string) error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+
+	b, exists := t.store.buckets[bucket]
+	if !exists {
+		return nil
+	}
+
+	t.undo = append(t.undo, undo{bucket: bucket, whole: b})
+	delete(t.store.buckets, bucket)
+
+	return nil
+}
+
+// rollback reverts the changes in the reverse order.
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		u := t.undo[i]
+		if u.whole != nil {
+			t.store.buckets[u.bucket] = u.whole
+
+			continue
+		}
+
+		b, exists := t.store.buckets[u.bucket]
+		if !exists {
+			b = make(map[string][]byte)
+			t.store.buckets[u.bucket] = b
+		}
+
+		if u.exists {
+			b[u.key] = u.value
+		} else {
+			delete(b, u.key)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	BucketSalts = "ps" // day: JSON of saltRecord
+)
+
+type saltRecord struct {
+	Salt      string    `json:"salt"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type saltRepository struct {
+	store Store
+	log   *slog.Logger
+}
+
+// NewSaltRepository creates the repository of the daily salts stored in the embedded store.
+func NewSaltRepository(store Store, log *slog.Logger) *saltRepository {
+	return &saltRepository{
+		store: store,
+		log:   log.With(slog.String("item", "KVSaltRepository")),
+	}
+}
+
+/*
+DailySalt returns the salt of the day. If the day has no salt yet, salt is stored for ttl and returned.
+The expired salts are deleted here, Redis does it with TTL.
+*/
+func (r *saltRepository) DailySalt(ctx context.Context, day, salt string, ttl time.Duration) (string, error) {
+	now := time.Now()
+
+	err := r.store.Update(func(tx Tx) error {
+		var expired []string
+		err := forEachRecord(tx, BucketSalts, func(key string, rec *saltRecord) error {
+			if !rec.ExpiresAt.After(now) {
+				expired = append(expired, key)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := tx.Delete(BucketSalts, key); err != nil {
+				return err
+			}
+		}
+
+		if rec, err := getRecord[saltRecord](tx, BucketSalts, day); err == nil {
+			salt = rec.Salt
+
+			return nil
+		}
+
+		return putRecord(tx, BucketSalts, day, &saltRecord{Salt: salt, ExpiresAt: now.Add(ttl)})
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot get salt: %w", err)
+	}
+
+	return salt, nil
+}
@@ -0,0 +1,429 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axiomhq/hyperloglog"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+const (
+	BucketStatsHourly  = "sh" // hour:file_id: counter. hour is a UTC hour
+	BucketStatsDaily   = "sd" // day:file_id: counter. Filled by the rollup of the finished hours
+	BucketStatsMonthly = "sm" // month:file_id: counter. Filled by the rollup of the finished days
+	BucketUniques      = "u"  // uniques_key: binary HyperLogLog sketch of the user IDs
+	BucketFiltered     = "ff" // file_id: counter. Downloads excluded from the count by the filter
+	BucketReasons      = "fr" // reason: counter of the filtered downloads
+
+	KeyUniquesFile     = "uf" // uf[:period:bucket]:file_id
+	KeyUniquesDownload = "ud" // ud[:period:bucket]:download_id
+
+	KeyStatsRollup = "sr" // Start of the last rolled up hour in unix seconds in BucketMeta
+)
+
+var periodBuckets = map[string]string{
+	entity.StatPeriodHour:  BucketStatsHourly,
+	entity.StatPeriodDay:   BucketStatsDaily,
+	entity.StatPeriodMonth: BucketStatsMonthly,
+}
+
+type statsRepository struct {
+	store Store
+	cfg   *config.StatsConfig
+	log   *slog.Logger
+}
+
+// NewStatsRepository creates the repository of the download history.
+func NewStatsRepository(store Store, cfg *config.StatsConfig, log *slog.Logger) *statsRepository {
+	return &statsRepository{
+		store: store,
+		cfg:   cfg,
+		log:   log.With(slog.String("item", "KVStatsRepository")),
+	}
+}
+
+// History returns the download series of the files, one value for every bucket.
+func (r *statsRepository) History(ctx context.Context, period string, buckets []*entity.StatBucket, fileIDs []string) (map[string][]int64, error) {
+	bucket, ok := periodBuckets[period]
+	if !ok {
+		return nil, fmt.Errorf("unknown period: %s", period)
+	}
+
+	history := make(map[string][]int64, len(fileIDs))
+
+	err := r.store.View(func(tx Tx) error {
+		for _, fileID := range fileIDs {
+			series := make([]int64, len(buckets))
+			for i, b := range buckets {
+				series[i] = getStatCounter(tx, bucket, getKey(b.Key, fileID))
+			}
+
+			history[fileID] = series
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get history: %w", err)
+	}
+
+	return history, nil
+}
+
+// Uniques returns the estimated numbers of distinct downloaders of the distribution and of its files over all time.
+func (r *statsRepository) Uniques(ctx context.Context, downloadID string, fileIDs []string) (int64, map[string]int64, error) {
+	var (
+		uniques int64
+		files   = make(map[string]int64, len(fileIDs))
+	)
+
+	err := r.store.View(func(tx Tx) error {
+		uniques = countUniques(tx, uniquesKey(KeyUniquesDownload, downloadID, "", ""))
+		for _, fileID := range fileIDs {
+			files[fileID] = countUniques(tx, uniquesKey(KeyUniquesFile, fileID, "", ""))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot get uniques: %w", err)
+	}
+
+	return uniques, files, nil
+}
+
+// UniqueHistory returns the series of the distinct downloaders of the distribution and of its files. Only days and months have them.
+func (r *statsRepository) UniqueHistory(ctx context.Context, period string, buckets []*entity.StatBucket, downloadID string, fileIDs []string) (*entity.UniqueHistory, error) {
+	history := &entity.UniqueHistory{
+		Download: make([]int64, len(buckets)),
+		Files:    make(map[string][]int64, len(fileIDs)),
+	}
+
+	err := r.store.View(func(tx Tx) error {
+		for i, b := range buckets {
+			history.Download[i] = countUniques(tx, uniquesKey(KeyUniquesDownload, downloadID, period, b.Key))
+		}
+
+		for _, fileID := range fileIDs {
+			series := make([]int64, len(buckets))
+			for i, b := range buckets {
+				series[i] = countUniques(tx, uniquesKey(KeyUniquesFile, fileID, period, b.Key))
+			}
+
+			history.Files[fileID] = series
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get unique history: %w", err)
+	}
+
+	return history, nil
+}
+
+// CountFiltered counts the download of the file excluded from the count by the filter for the reason.
+func (r *statsRepository) CountFiltered(ctx context.Context, fileID, reason string) error {
+	err := r.store.Update(func(tx Tx) error {
+		if err := incrCounter(tx, BucketFiltered, fileID, 1); err != nil {
+			return err
+		}
+
+		return incrCounter(tx, BucketReasons, reason, 1)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot count filtered download: %w", err)
+	}
+
+	return nil
+}
+
+// Filtered returns the numbers of the filtered downloads of the files.
+func (r *statsRepository) Filtered(ctx context.Context, fileIDs []string) (map[string]int64, error) {
+	filtered := make(map[string]int64, len(fileIDs))
+
+	err := r.store.View(func(tx Tx) error {
+		for _, fileID := range fileIDs {
+			filtered[fileID] = getStatCounter(tx, BucketFiltered, fileID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get filtered downloads: %w", err)
+	}
+
+	return filtered, nil
+}
+
+// FilteredReasons returns the numbers of the filtered downloads of all files by the reason.
+func (r *statsRepository) FilteredReasons(ctx context.Context) (map[string]int64, error) {
+	reasons := make(map[string]int64)
+
+	err := r.store.View(func(tx Tx) error {
+		return tx.ForEach(BucketReasons, func(reason string, value []byte) error {
+			reasons[reason], _ = strconv.ParseInt(string(value), 10, 64)
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get filtered reasons: %w", err)
+	}
+
+	return reasons, nil
+}
+
+/*
+Rollup adds the finished hours to the days, and the finished days to the months.
+The buckets older than the retention and the expired window dedup marks are deleted.
+*/
+func (r *statsRepository) Rollup(ctx context.Context, now time.Time) error {
+	loc := r.cfg.Location
+	current := now.Truncate(time.Hour)
+
+	err := r.store.Update(func(tx Tx) error {
+		// The marks are deleted on every run, not only when an hour has finished
+		if err := clearExpiredUsers(tx, now); err != nil {
+			return fmt.Errorf("cannot clear expired users: %w", err)
+		}
+
+		oldest := current.Add(-r.cfg.Retention.Hourly)
+		hour := oldest
+
+		if last, err := strconv.ParseInt(string(tx.Get(BucketMeta, KeyStatsRollup)), 10, 64); err == nil {
+			hour = time.Unix(last, 0).Add(time.Hour)
+			if hour.Before(oldest) {
+				hour = oldest
+			}
+		}
+
+		if !hour.Before(current) {
+			return nil
+		}
+
+		hourly, err := groupCounters(tx, BucketStatsHourly)
+		if err != nil {
+			return err
+		}
+
+		for ; hour.Before(current); hour = hour.Add(time.Hour) {
+			dayKey := entity.StatBucketKey(entity.StatPeriodDay, hour, loc)
+			for fileID, counter := range hourly[entity.StatBucketKey(entity.StatPeriodHour, hour, loc)] {
+				if err := incrCounter(tx, BucketStatsDaily, getKey(dayKey, fileID), counter); err != nil {
+					return err
+				}
+			}
+
+			if !entity.StatDayEnds(hour, loc) {
+				continue
+			}
+
+			daily, err := groupCounters(tx, BucketStatsDaily)
+			if err != nil {
+				return err
+			}
+
+			monthKey := entity.StatBucketKey(entity.StatPeriodMonth, hour, loc)
+			for fileID, counter := range daily[dayKey] {
+				if err := incrCounter(tx, BucketStatsMonthly, getKey(monthKey, fileID), counter); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Put(BucketMeta, KeyStatsRollup, []byte(strconv.FormatInt(current.Add(-time.Hour).Unix(), 10))); err != nil {
+			return err
+		}
+
+		return r.deleteExpired(tx, now)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot roll up stats: %w", err)
+	}
+
+	return nil
+}
+
+// deleteExpired deletes the buckets that are older than the retention.
+func (r *statsRepository) deleteExpired(tx Tx, now time.Time) error {
+	retention := map[string]time.Duration{
+		entity.StatPeriodHour:  r.cfg.Retention.Hourly,
+		entity.StatPeriodDay:   r.cfg.Retention.Daily,
+		entity.StatPeriodMonth: r.cfg.Retention.Monthly,
+	}
+
+	for period, ttl := range retention {
+		if ttl <= 0 {
+			continue
+		}
+
+		var expired []string
+
+		bucket := periodBuckets[period]
+		err := tx.ForEach(bucket, func(key string, value []byte) error {
+			bucketKey, _, _ := strings.Cut(key, KeySeparator)
+
+			start, err := entity.ParseStatBucketKey(period, bucketKey, r.cfg.Location)
+			if err != nil || start.Add(ttl).Before(now) {
+				expired = append(expired, key)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := tx.Delete(bucket, key); err != nil {
+				return err
+			}
+		}
+
+		if len(expired) > 0 {
+			r.log.Info("Delete expired stats", slog.String("period", period), slog.Int("key_count", len(expired)))
+		}
+	}
+
+	// The unique keys of a period are scope:period:bucket:id
+	var expired []string
+	err := tx.ForEach(BucketUniques, func(key string, value []byte) error {
+		parts := strings.Split(key, KeySeparator)
+		if len(parts) != 4 {
+			return nil
+		}
+
+		ttl := retention[parts[1]]
+		if ttl <= 0 {
+			return nil
+		}
+
+		start, err := entity.ParseStatBucketKey(parts[1], parts[2], r.cfg.Location)
+		if err != nil || start.Add(ttl).Before(now) {
+			expired = append(expired, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		if err := tx.Delete(BucketUniques, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupCounters returns the counters of the bucket grouped by the time bucket key and the file ID.
+func groupCounters(tx Tx, bucket string) (map[string]map[string]int64, error) {
+	groups := make(map[string]map[string]int64)
+
+	err := tx.ForEach(bucket, func(key string, value []byte) error {
+		bucketKey, fileID, ok := strings.Cut(key, KeySeparator)
+		if !ok {
+			return nil
+		}
+
+		counter, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil
+		}
+
+		if groups[bucketKey] == nil {
+			groups[bucketKey] = make(map[string]int64)
+		}
+		groups[bucketKey][fileID] = counter
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+func getStatCounter(tx Tx, bucket, key string) int64 {
+	counter, _ := strconv.ParseInt(string(tx.Get(bucket, key)), 10, 64)
+
+	return counter
+}
+
+func incrCounter(tx Tx, bucket, key string, n int64) error {
+	return tx.Put(bucket, key, []byte(strconv.FormatInt(getStatCounter(tx, bucket, key)+n, 10)))
+}
+
+// uniquesKey returns the parts of the key of the distinct downloaders, the same as in Redis.
+func uniquesKey(scope, id, period, bucketKey string) []string {
+	if period == "" {
+		return []string{scope, id}
+	}
+
+	return []string{scope, period, bucketKey, id}
+}
+
+// addUniques adds the user to the distinct downloaders of the file and of its distribution, over all time and in the day and the month of t.
+func addUniques(tx Tx, fileID, downloadID, userID string, t time.Time, loc *time.Location) error {
+	for _, period := range []string{"", entity.StatPeriodDay, entity.StatPeriodMonth} {
+		bucketKey := ""
+		if period != "" {
+			bucketKey = entity.StatBucketKey(period, t, loc)
+		}
+
+		keys := [][]string{uniquesKey(KeyUniquesFile, fileID, period, bucketKey)}
+		if downloadID != "" {
+			keys = append(keys, uniquesKey(KeyUniquesDownload, downloadID, period, bucketKey))
+		}
+
+		for _, key := range keys {
+			if err := addUnique(tx, getKey(key...), userID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func addUnique(tx Tx, key, userID string) error {
+	sketch := hyperloglog.New()
+	if data := tx.Get(BucketUniques, key); data != nil {
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("cannot unmarshal uniques %s: %w", key, err)
+		}
+	}
+
+	sketch.Insert([]byte(userID))
+
+	data, err := sketch.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("cannot marshal uniques %s: %w", key, err)
+	}
+
+	return tx.Put(BucketUniques, key, data)
+}
+
+func countUniques(tx Tx, key []string) int64 {
+	data := tx.Get(BucketUniques, getKey(key...))
+	if data == nil {
+		return 0
+	}
+
+	sketch := hyperloglog.New()
+	if err := sketch.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+
+	return int64(sketch.Estimate())
+}
@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsRepository(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	loc := time.FixedZone("MSK", 3*60*60)
+	cfg := &config.StatsConfig{
+		Location:  loc,
+		Retention: config.StatsRetention{Hourly: 48 * time.Hour, Daily: 90 * 24 * time.Hour},
+	}
+
+	downloads := []struct {
+		fileID string
+		t      time.Time
+	}{
+		{"f1", time.Date(2026, 1, 31, 22, 30, 0, 0, loc)},
+		{"f1", time.Date(2026, 1, 31, 22, 40, 0, 0, loc)},
+		{"f2", time.Date(2026, 1, 31, 22, 50, 0, 0, loc)},
+		{"f1", time.Date(2026, 1, 31, 23, 10, 0, 0, loc)},
+		{"f1", time.Date(2026, 2, 1, 0, 20, 0, 0, loc)},
+		{"f2", time.Date(2026, 2, 1, 1, 1, 0, 0, loc)}, // The current hour is not rolled up
+	}
+	now := time.Date(2026, 2, 1, 1, 5, 0, 0, loc)
+	fileIDs := []string{"f1", "f2"}
+	policy := &entity.CountingPolicy{Mode: entity.CountingModeEvery}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			repo := NewStatsRepository(store, cfg, log)
+			drepo := NewDownloadRepository(store, cfg, log)
+
+			for i, d := range downloads {
+				_, counted, err := drepo.CountDownload(ctx, &entity.Downloader{Fingerprint: strconv.Itoa(i)}, d.fileID, policy, d.t)
+				require.NoError(t, err)
+				require.True(t, counted)
+			}
+
+			history := func(period string, count int, at time.Time) map[string][]int64 {
+				h, err := repo.History(ctx, period, entity.StatBuckets(period, at, count, loc), fileIDs)
+				require.NoError(t, err)
+
+				return h
+			}
+
+			require.Equal(t, map[string][]int64{"f1": {2, 1, 1, 0}, "f2": {1, 0, 0, 1}}, history(entity.StatPeriodHour, 4, now))
+			require.Equal(t, map[string][]int64{"f1": {0, 0}, "f2": {0, 0}}, history(entity.StatPeriodDay, 2, now), "days are filled by the rollup")
+
+			// Unique downloaders are counted right away
+			uniques, err := repo.UniqueHistory(ctx, entity.StatPeriodDay, entity.StatBuckets(entity.StatPeriodDay, now, 2, loc), "", fileIDs)
+			require.NoError(t, err)
+			require.Equal(t, map[string][]int64{"f1": {3, 1}, "f2": {1, 1}}, uniques.Files)
+
+			// The rollup is idempotent
+			for range 2 {
+				require.NoError(t, repo.Rollup(ctx, now))
+			}
+
+			require.Equal(t, map[string][]int64{"f1": {3, 1}, "f2": {1, 0}}, history(entity.StatPeriodDay, 2, now))
+			require.Equal(t, map[string][]int64{"f1": {3, 0}, "f2": {1, 0}}, history(entity.StatPeriodMonth, 2, now))
+
+			// The finished hour is added to the day by the next rollup
+			later := now.Add(time.Hour)
+			require.NoError(t, repo.Rollup(ctx, later))
+			require.Equal(t, map[string][]int64{"f1": {3, 1}, "f2": {1, 1}}, history(entity.StatPeriodDay, 2, later))
+
+			// The finished day is added to the month
+			require.NoError(t, repo.Rollup(ctx, time.Date(2026, 2, 2, 0, 30, 0, 0, loc)))
+			require.Equal(t, map[string][]int64{"f1": {3, 1}, "f2": {1, 1}}, history(entity.StatPeriodMonth, 2, now))
+
+			// Hours and days older than the retention are deleted, months are kept
+			require.NoError(t, repo.Rollup(ctx, now.Add(100*24*time.Hour)))
+			require.Equal(t, map[string][]int64{"f1": {0, 0, 0, 0}, "f2": {0, 0, 0, 0}}, history(entity.StatPeriodHour, 4, now))
+			require.Equal(t, map[string][]int64{"f1": {0, 0}, "f2": {0, 0}}, history(entity.StatPeriodDay, 2, later))
+			require.Equal(t, map[string][]int64{"f1": {3, 1}, "f2": {1, 1}}, history(entity.StatPeriodMonth, 2, now))
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package kv
+
+/*
+Store is an embedded key-value database with buckets. Buckets are created on the first write.
+Update runs the function in a read-write transaction, the changes are discarded if it returns an error.
+*/
+type Store interface {
+	View(fn func(tx Tx) error) error
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Tx is a store transaction. Values returned by Get and passed to ForEach are valid only inside the transaction.
+type Tx interface {
+	Get(bucket, key string) []byte
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	DeleteBucket(bucket string) error
+}
@@ -0,0 +1,83 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	KeyLock = "lock" // STRING. lock:name token. Set with NX and PX, so only one instance holds the lock
+)
+
+// releaseScript deletes the lock only if it is still held by the token, so an expired lock taken by another instance is not released.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type lockRepository struct {
+	cl     *redis.Client
+	prefix string
+	log    *slog.Logger
+}
+
+/*
+NewLockRepository creates the distributed lock shared by all app instances using the same Redis.
+prefix is added to the lock keys, it can be empty.
+*/
+func NewLockRepository(cl *redis.Client, prefix string, log *slog.Logger) *lockRepository {
+	return &lockRepository{
+		cl:     cl,
+		prefix: prefix,
+		log:    log.With(slog.String("item", "LockRepository")),
+	}
+}
+
+/*
+Acquire takes the lock name for ttl and returns the token to release it.
+It returns common.ErrLockIsHeldError if the lock is held by someone else.
+*/
+func (r *lockRepository) Acquire(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	token := uuid.New().String()
+
+	ok, err := r.cl.SetNX(ctx, r.getKey(name), token, ttl).Result()
+	if err != nil {
+		return "", fmt.Errorf("cannot acquire lock %s: %w", name, err)
+	}
+
+	if !ok {
+		return "", common.ErrLockIsHeldError
+	}
+
+	return token, nil
+}
+
+// Release releases the lock if it is still held by the token.
+func (r *lockRepository) Release(ctx context.Context, name, token string) error {
+	released, err := releaseScript.Run(ctx, r.cl, []string{r.getKey(name)}, token).Int()
+	if err != nil {
+		return fmt.Errorf("cannot release lock %s: %w", name, err)
+	}
+
+	if released == 0 {
+		r.log.Warn("Lock has expired before release", slog.String("name", name))
+	}
+
+	return nil
+}
+
+func (r *lockRepository) getKey(name string) string {
+	if r.prefix != "" {
+		return r.prefix + ":" + KeyLock + ":" + name
+	}
+
+	return KeyLock + ":" + name
+}
@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jgivc/fetchtracker/internal/repository/download"
+	"github.com/jgivc/fetchtracker/internal/repository/job"
+	"github.com/jgivc/fetchtracker/internal/repository/salt"
+	"github.com/jgivc/fetchtracker/internal/repository/stats"
+	"github.com/redis/go-redis/v9"
+)
+
+type keyMigrator struct {
+	cl     *redis.Client
+	prefix string
+	log    *slog.Logger
+}
+
+// NewKeyMigrator creates the migration of the unprefixed keys under prefix.
+func NewKeyMigrator(cl *redis.Client, prefix string, log *slog.Logger) *keyMigrator {
+	return &keyMigrator{
+		cl:     cl,
+		prefix: prefix,
+		log:    log.With(slog.String("item", "KeyMigrator")),
+	}
+}
+
+/*
+Migrate renames the keys written without a prefix to the prefixed keys and returns the number of the moved keys.
+A key is not moved if the prefixed key already exists. The locks are not moved, they expire by themselves.
+The app must be stopped while the keys are moved.
+*/
+func (m *keyMigrator) Migrate(ctx context.Context) (int, error) {
+	if m.prefix == "" {
+		return 0, fmt.Errorf("key prefix is not set")
+	}
+
+	var moved int
+
+	for _, key := range []string{download.KeyActiveVersion, download.KeyFileStats, job.KeyIndexJobs, stats.KeyStatsRollup, stats.KeyFiltered, stats.KeyFilteredReasons} {
+		n, err := m.rename(ctx, key)
+		if err != nil {
+			return moved, err
+		}
+		moved += n
+	}
+
+	for _, key := range slices.Concat(download.ClearableKeys, []string{download.KeyUniqueDownload, download.KeyFileUsers, stats.KeyStatsHourly, stats.KeyStatsDaily, stats.KeyStatsMonthly, stats.KeyUniquesFile, stats.KeyUniquesDownload, salt.KeySalt}) {
+		n, err := m.renameAll(ctx, key+download.KeySeparator+"*")
+		if err != nil {
+			return moved, err
+		}
+		moved += n
+	}
+
+	return moved, nil
+}
+
+func (m *keyMigrator) renameAll(ctx context.Context, pattern string) (int, error) {
+	var (
+		cursor uint64
+		moved  int
+	)
+
+	for {
+		keys, nextCursor, err := m.cl.Scan(ctx, cursor, pattern, download.ScanCount).Result()
+		if err != nil {
+			return moved, fmt.Errorf("error scanning keys: %w", err)
+		}
+
+		for _, key := range keys {
+			// The prefix may look like one of the keys
+			if strings.HasPrefix(key, m.prefix+download.KeySeparator) {
+				continue
+			}
+
+			n, err := m.rename(ctx, key)
+			if err != nil {
+				return moved, err
+			}
+			moved += n
+		}
+
+		cursor = nextCursor
+		if cursor == 0 {
+			break
+		}
+	}
+
+	m.log.Info("Keys moved", slog.String("pattern", pattern), slog.Int("key_count", moved))
+
+	return moved, nil
+}
+
+// rename moves the key under the prefix. The TTL of the key is kept.
+func (m *keyMigrator) rename(ctx context.Context, key string) (int, error) {
+	newKey := m.prefix + download.KeySeparator + key
+
+	ok, err := m.cl.RenameNX(ctx, key, newKey).Result()
+	if err != nil {
+		// The key has expired or does not exist
+		if strings.Contains(err.Error(), "no such key") {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("cannot rename key %s: %w", key, err)
+	}
+
+	if !ok {
+		m.log.Warn("Key already exists, skip", slog.String("key", newKey))
+
+		return 0, nil
+	}
+
+	return 1, nil
+}
@@ -0,0 +1,59 @@
+package salt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	KeySalt = "ps" // STRING. privacy_salt:day salt. Expires after the day is over, so the fingerprints of the past days cannot be recomputed
+
+	KeySeparator = ":"
+)
+
+type saltRepository struct {
+	cl     *redis.Client
+	prefix string
+	log    *slog.Logger
+}
+
+// NewSaltRepository creates the repository of the daily salts shared by all app instances. prefix is added to all keys, it can be empty.
+func NewSaltRepository(cl *redis.Client, prefix string, log *slog.Logger) *saltRepository {
+	return &saltRepository{
+		cl:     cl,
+		prefix: prefix,
+		log:    log.With(slog.String("item", "SaltRepository")),
+	}
+}
+
+/*
+DailySalt returns the salt of the day. If the day has no salt yet, salt is stored for ttl and returned.
+The salt stored first wins, so all instances use the same one.
+*/
+func (r *saltRepository) DailySalt(ctx context.Context, day, salt string, ttl time.Duration) (string, error) {
+	key := r.getKey(KeySalt, day)
+
+	if err := r.cl.SetNX(ctx, key, salt, ttl).Err(); err != nil {
+		return "", fmt.Errorf("cannot set salt: %w", err)
+	}
+
+	stored, err := r.cl.Get(ctx, key).Result()
+	if err != nil {
+		return "", fmt.Errorf("cannot get salt: %w", err)
+	}
+
+	return stored, nil
+}
+
+func (r *saltRepository) getKey(keys ...string) string {
+	if r.prefix != "" {
+		keys = append([]string{r.prefix}, keys...)
+	}
+
+	return strings.Join(keys, KeySeparator)
+}
@@ -0,0 +1,351 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	KeyStatsHourly  = "sh" // HASH. stats_hourly:hour file_id: counter. hour is a UTC hour, the key expires after the hourly retention
+	KeyStatsDaily   = "sd" // HASH. stats_daily:day file_id: counter. Filled by the rollup of the finished hours
+	KeyStatsMonthly = "sm" // HASH. stats_monthly:month file_id: counter. Filled by the rollup of the finished days
+	KeyStatsRollup  = "sr" // STRING. Start of the last rolled up hour in unix seconds
+
+	KeyUniquesFile     = "uf" // HyperLogLog. uniques_file[:period:bucket]:file_id user_id. The period keys expire with the daily and monthly retention
+	KeyUniquesDownload = "ud" // HyperLogLog. uniques_download[:period:bucket]:download_id user_id
+
+	KeyFiltered        = "ff" // HASH. filtered file_id: counter. Downloads excluded from the count by the filter
+	KeyFilteredReasons = "fr" // HASH. filtered_reasons reason: counter
+
+	KeySeparator = ":"
+)
+
+var periodKeys = map[string]string{
+	entity.StatPeriodHour:  KeyStatsHourly,
+	entity.StatPeriodDay:   KeyStatsDaily,
+	entity.StatPeriodMonth: KeyStatsMonthly,
+}
+
+type statsRepository struct {
+	cl     *redis.Client
+	prefix string
+	cfg    *config.StatsConfig
+	log    *slog.Logger
+}
+
+// NewStatsRepository creates the repository of the download history. prefix is added to all keys, it can be empty.
+func NewStatsRepository(cl *redis.Client, prefix string, cfg *config.StatsConfig, log *slog.Logger) *statsRepository {
+	return &statsRepository{
+		cl:     cl,
+		prefix: prefix,
+		cfg:    cfg,
+		log:    log.With(slog.String("item", "StatsRepository")),
+	}
+}
+
+// History returns the download series of the files, one value for every bucket.
+func (r *statsRepository) History(ctx context.Context, period string, buckets []*entity.StatBucket, fileIDs []string) (map[string][]int64, error) {
+	periodKey, ok := periodKeys[period]
+	if !ok {
+		return nil, fmt.Errorf("unknown period: %s", period)
+	}
+
+	history := make(map[string][]int64, len(fileIDs))
+	for _, fileID := range fileIDs {
+		history[fileID] = make([]int64, len(buckets))
+	}
+
+	if len(fileIDs) < 1 {
+		return history, nil
+	}
+
+	pipe := r.cl.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(buckets))
+	for i, bucket := range buckets {
+		cmds[i] = pipe.HMGet(ctx, r.getKey(periodKey, bucket.Key), fileIDs...)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("cannot get history: %w", err)
+	}
+
+	for i, cmd := range cmds {
+		for j, value := range cmd.Val() {
+			str, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			counter, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				r.log.Error("Cannot convert counter to int", slog.String("file_id", fileIDs[j]), slog.Any("error", err))
+
+				continue
+			}
+
+			history[fileIDs[j]][i] = counter
+		}
+	}
+
+	return history, nil
+}
+
+// Uniques returns the estimated numbers of distinct downloaders of the distribution and of its files over all time.
+func (r *statsRepository) Uniques(ctx context.Context, downloadID string, fileIDs []string) (int64, map[string]int64, error) {
+	pipe := r.cl.Pipeline()
+	downloadCmd := pipe.PFCount(ctx, r.getKey(UniquesKey(KeyUniquesDownload, downloadID, "", "")...))
+	fileCmds := make([]*redis.IntCmd, len(fileIDs))
+	for i, fileID := range fileIDs {
+		fileCmds[i] = pipe.PFCount(ctx, r.getKey(UniquesKey(KeyUniquesFile, fileID, "", "")...))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, nil, fmt.Errorf("cannot get uniques: %w", err)
+	}
+
+	files := make(map[string]int64, len(fileIDs))
+	for i, fileID := range fileIDs {
+		files[fileID] = fileCmds[i].Val()
+	}
+
+	return downloadCmd.Val(), files, nil
+}
+
+// UniqueHistory returns the series of the distinct downloaders of the distribution and of its files. Only days and months have them.
+func (r *statsRepository) UniqueHistory(ctx context.Context, period string, buckets []*entity.StatBucket, downloadID string, fileIDs []string) (*entity.UniqueHistory, error) {
+	pipe := r.cl.Pipeline()
+	downloadCmds := make([]*redis.IntCmd, len(buckets))
+	fileCmds := make(map[string][]*redis.IntCmd, len(fileIDs))
+	for i, bucket := range buckets {
+		downloadCmds[i] = pipe.PFCount(ctx, r.getKey(UniquesKey(KeyUniquesDownload, downloadID, period, bucket.Key)...))
+		for _, fileID := range fileIDs {
+			fileCmds[fileID] = append(fileCmds[fileID], pipe.PFCount(ctx, r.getKey(UniquesKey(KeyUniquesFile, fileID, period, bucket.Key)...)))
+		}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("cannot get unique history: %w", err)
+	}
+
+	history := &entity.UniqueHistory{
+		Download: make([]int64, len(buckets)),
+		Files:    make(map[string][]int64, len(fileIDs)),
+	}
+
+	for i, cmd := range downloadCmds {
+		history.Download[i] = cmd.Val()
+	}
+
+	for fileID, cmds := range fileCmds {
+		series := make([]int64, len(cmds))
+		for i, cmd := range cmds {
+			series[i] = cmd.Val()
+		}
+
+		history.Files[fileID] = series
+	}
+
+	return history, nil
+}
+
+// CountFiltered counts the download of the file excluded from the count by the filter for the reason.
+func (r *statsRepository) CountFiltered(ctx context.Context, fileID, reason string) error {
+	pipe := r.cl.Pipeline()
+	pipe.HIncrBy(ctx, r.getKey(KeyFiltered), fileID, 1)
+	pipe.HIncrBy(ctx, r.getKey(KeyFilteredReasons), reason, 1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("cannot count filtered download: %w", err)
+	}
+
+	return nil
+}
+
+// Filtered returns the numbers of the filtered downloads of the files.
+func (r *statsRepository) Filtered(ctx context.Context, fileIDs []string) (map[string]int64, error) {
+	filtered := make(map[string]int64, len(fileIDs))
+	if len(fileIDs) < 1 {
+		return filtered, nil
+	}
+
+	values, err := r.cl.HMGet(ctx, r.getKey(KeyFiltered), fileIDs...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get filtered downloads: %w", err)
+	}
+
+	for i, value := range values {
+		str, _ := value.(string)
+		filtered[fileIDs[i]], _ = strconv.ParseInt(str, 10, 64)
+	}
+
+	return filtered, nil
+}
+
+// FilteredReasons returns the numbers of the filtered downloads of all files by the reason.
+func (r *statsRepository) FilteredReasons(ctx context.Context) (map[string]int64, error) {
+	values, err := r.cl.HGetAll(ctx, r.getKey(KeyFilteredReasons)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get filtered reasons: %w", err)
+	}
+
+	reasons := make(map[string]int64, len(values))
+	for reason, value := range values {
+		reasons[reason], _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	return reasons, nil
+}
+
+/*
+Rollup adds the finished hours to the days, and the finished days to the months.
+The hours are rolled up one by one from the last rolled up hour, so a missed rollup is caught up within the hourly retention.
+It is safe to run by several app instances at once.
+*/
+func (r *statsRepository) Rollup(ctx context.Context, now time.Time) error {
+	current := now.Truncate(time.Hour)
+
+	for {
+		done, err := r.rollupHour(ctx, current)
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// rollupHour rolls up the hour after the last rolled up one. It returns true if there are no finished hours left.
+func (r *statsRepository) rollupHour(ctx context.Context, current time.Time) (bool, error) {
+	var (
+		done bool
+		loc  = r.cfg.Location
+		key  = r.getKey(KeyStatsRollup)
+	)
+
+	err := r.cl.Watch(ctx, func(tx *redis.Tx) error {
+		oldest := current.Add(-r.cfg.Retention.Hourly)
+		hour := oldest
+
+		last, err := tx.Get(ctx, key).Int64()
+		switch {
+		case err == nil:
+			hour = time.Unix(last, 0).Add(time.Hour)
+			if hour.Before(oldest) {
+				hour = oldest
+			}
+		case !errors.Is(err, redis.Nil):
+			return fmt.Errorf("cannot get last rolled up hour: %w", err)
+		}
+
+		if !hour.Before(current) {
+			done = true
+
+			return nil
+		}
+
+		hourly, err := getCounters(ctx, tx, r.getKey(KeyStatsHourly, entity.StatBucketKey(entity.StatPeriodHour, hour, loc)))
+		if err != nil {
+			return err
+		}
+
+		dayKey := r.getKey(KeyStatsDaily, entity.StatBucketKey(entity.StatPeriodDay, hour, loc))
+
+		var daily map[string]int64
+		if entity.StatDayEnds(hour, loc) {
+			daily, err = getCounters(ctx, tx, dayKey)
+			if err != nil {
+				return err
+			}
+
+			for fileID, counter := range hourly {
+				daily[fileID] += counter
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incrCounters(ctx, pipe, dayKey, hourly, r.cfg.Retention.Daily)
+			incrCounters(ctx, pipe, r.getKey(KeyStatsMonthly, entity.StatBucketKey(entity.StatPeriodMonth, hour, loc)), daily, r.cfg.Retention.Monthly)
+			pipe.Set(ctx, key, hour.Unix(), 0)
+
+			return nil
+		})
+
+		return err
+	}, key)
+
+	if errors.Is(err, redis.TxFailedErr) {
+		// The hour has been rolled up by another instance
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("cannot roll up hour: %w", err)
+	}
+
+	return done, nil
+}
+
+func (r *statsRepository) getKey(keys ...string) string {
+	if r.prefix != "" {
+		keys = append([]string{r.prefix}, keys...)
+	}
+
+	return strings.Join(keys, KeySeparator)
+}
+
+/*
+UniquesKey returns the parts of the key of the distinct downloaders of id, the file or the distribution by scope.
+Without period the key is for all time, otherwise for the bucket of the period.
+*/
+func UniquesKey(scope, id, period, bucketKey string) []string {
+	if period == "" {
+		return []string{scope, id}
+	}
+
+	return []string{scope, period, bucketKey, id}
+}
+
+func getCounters(ctx context.Context, tx *redis.Tx, key string) (map[string]int64, error) {
+	values, err := tx.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get counters %s: %w", key, err)
+	}
+
+	counters := make(map[string]int64, len(values))
+	for fileID, value := range values {
+		counter, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		counters[fileID] = counter
+	}
+
+	return counters, nil
+}
+
+// incrCounters adds the counters to the hash. ttl 0 means the hash does not expire.
+func incrCounters(ctx context.Context, pipe redis.Pipeliner, key string, counters map[string]int64, ttl time.Duration) {
+	if len(counters) < 1 {
+		return
+	}
+
+	for fileID, counter := range counters {
+		pipe.HIncrBy(ctx, key, fileID, counter)
+	}
+
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+}
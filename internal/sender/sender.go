@@ -0,0 +1,179 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+const (
+	hdrContentDisposition = "Content-Disposition"
+	hdrContentType        = "Content-Type"
+	hdrAccelBuffering     = "X-Accel-Buffering"
+	hdrAccelLimitRate     = "X-Accel-Limit-Rate"
+	hdrAccelCharset       = "X-Accel-Charset"
+)
+
+/*
+sender sends the file to the client. In the redirect mode the web server in front sends it by the redirect header
+built by the offload profile, in the direct mode the app sends it from work_dir itself.
+*/
+type sender struct {
+	cfg     *config.HandlerConfig
+	workDir string
+	prefix  string // The location of work_dir in the file URLs saved by the index
+	log     *slog.Logger
+}
+
+func NewSender(cfg *config.HandlerConfig, workDir string, log *slog.Logger) *sender {
+	return &sender{
+		cfg:     cfg,
+		workDir: workDir,
+		prefix:  path.Join("/", filepath.Base(workDir)) + "/",
+		log:     log.With(slog.String("item", "Sender")),
+	}
+}
+
+/*
+Send sends the file. It returns an error only if nothing has been written, so the caller can respond with the error.
+It returns common.ErrFileNotFoundError if the file is not found in work_dir.
+*/
+func (s *sender) Send(w http.ResponseWriter, r *http.Request, file *entity.File) error {
+	name, ok := strings.CutPrefix(file.URL, s.prefix)
+	if !ok || !filepath.IsLocal(name) {
+		return fmt.Errorf("file %s is not in work dir: %w", file.URL, common.ErrFileNotFoundError)
+	}
+
+	if s.cfg.ServeMode != config.ServeModeDirect {
+		s.offload(w, name, file)
+
+		return nil
+	}
+
+	// The file is opened inside work_dir only, a symlink or .. cannot lead out of it
+	f, err := os.OpenInRoot(s.workDir, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("cannot open file %s: %w: %w", name, common.ErrFileNotFoundError, err)
+		}
+
+		return fmt.Errorf("cannot open file %s: %w", name, err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat file %s: %w", name, err)
+	}
+
+	if stat.IsDir() {
+		return fmt.Errorf("file %s is a directory: %w", name, common.ErrFileNotFoundError)
+	}
+
+	w.Header().Set(hdrContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": stat.Name()}))
+	if file.MIMEType != "" {
+		// ServeContent does not sniff the type if it is set
+		w.Header().Set(hdrContentType, file.MIMEType)
+	}
+
+	var content io.ReadSeeker = f
+	if s.cfg.RateLimit > 0 {
+		content = &throttledReader{ReadSeeker: f, ctx: r.Context(), rate: s.cfg.RateLimit}
+	}
+
+	// Range, If-Range and If-Modified-Since are handled by ServeContent
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), content)
+
+	return nil
+}
+
+// offload asks the web server to send the file name relative to work_dir.
+func (s *sender) offload(w http.ResponseWriter, name string, file *entity.File) {
+	cfg := &s.cfg.Offload
+	header := w.Header()
+
+	header.Set(hdrContentDisposition, "attachment") // Download instead view (for .pdf, etc)
+	header.Set(s.cfg.RedirectHeader, cfg.Prefix+name)
+
+	if cfg.Profile != config.OffloadNginx {
+		// The other servers keep the Content-Type of the app response
+		if file.MIMEType != "" {
+			header.Set(hdrContentType, withCharset(file.MIMEType, cfg.Charset))
+		}
+
+		return
+	}
+
+	if cfg.Buffering != "" {
+		header.Set(hdrAccelBuffering, cfg.Buffering)
+	}
+
+	if cfg.LimitRate > 0 {
+		header.Set(hdrAccelLimitRate, strconv.FormatInt(cfg.LimitRate, 10))
+	}
+
+	if cfg.Charset != "" {
+		header.Set(hdrAccelCharset, cfg.Charset)
+	}
+}
+
+// withCharset adds the charset to a text MIME type without one.
+func withCharset(mimeType, charset string) string {
+	if charset == "" || !strings.HasPrefix(mimeType, "text/") || strings.Contains(mimeType, "charset=") {
+		return mimeType
+	}
+
+	return mimeType + "; charset=" + charset
+}
+
+// throttledReader reads at most rate bytes per second since the first read. The seeks are not throttled.
+type throttledReader struct {
+	io.ReadSeeker
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+
+	// A single read takes no more than a second of the limit, so the rate is smooth
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+
+	n, err := t.ReadSeeker.Read(p)
+	t.read += int64(n)
+
+	wait := time.Duration(float64(t.read)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return n, err
+}
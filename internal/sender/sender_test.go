@@ -0,0 +1,109 @@
+package sender
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSender(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	workDir := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.MkdirAll(filepath.Join(workDir, "one"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(workDir, "one", "file.pdf"), []byte("0123456789"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(workDir, "..", "secret"), []byte("secret"), 0o644))
+
+	file := &entity.File{ID: "f1", URL: "/data/one/file.pdf", MIMEType: "application/pdf"}
+
+	send := func(s *sender, file *entity.File, header http.Header) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, "/file/f1/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		w := httptest.NewRecorder()
+
+		return w, s.Send(w, req, file)
+	}
+
+	// The redirect mode leaves the file to the web server
+	for _, c := range []struct {
+		header  string
+		offload config.OffloadConfig
+		want    http.Header
+	}{
+		{"X-Accel-Redirect", config.OffloadConfig{Profile: config.OffloadNginx, Prefix: "/data/"}, http.Header{
+			"X-Accel-Redirect":    {"/data/one/file.pdf"},
+			"Content-Disposition": {"attachment"},
+		}},
+		{"X-Accel-Redirect", config.OffloadConfig{Profile: config.OffloadNginx, Prefix: "/protected/", Buffering: "no", LimitRate: 1024, Charset: "utf-8"}, http.Header{
+			"X-Accel-Redirect":    {"/protected/one/file.pdf"},
+			"Content-Disposition": {"attachment"},
+			"X-Accel-Buffering":   {"no"},
+			"X-Accel-Limit-Rate":  {"1024"},
+			"X-Accel-Charset":     {"utf-8"},
+		}},
+		{"X-Sendfile", config.OffloadConfig{Profile: config.OffloadSendfile, Prefix: "/srv/files/", Charset: "utf-8"}, http.Header{
+			"X-Sendfile":          {"/srv/files/one/file.pdf"},
+			"Content-Disposition": {"attachment"},
+			"Content-Type":        {"application/pdf"},
+		}},
+		{"X-Accel-Redirect", config.OffloadConfig{Profile: config.OffloadCaddy, Prefix: "/"}, http.Header{
+			"X-Accel-Redirect":    {"/one/file.pdf"},
+			"Content-Disposition": {"attachment"},
+			"Content-Type":        {"application/pdf"},
+		}},
+	} {
+		s := NewSender(&config.HandlerConfig{ServeMode: config.ServeModeRedirect, RedirectHeader: c.header, Offload: c.offload}, workDir, log)
+		w, err := send(s, file, nil)
+		require.NoError(t, err)
+		require.Equal(t, c.want, w.Header(), c.offload.Profile)
+		require.Empty(t, w.Body.String())
+	}
+
+	require.Equal(t, "text/plain; charset=utf-8", withCharset("text/plain", "utf-8"))
+	require.Equal(t, "text/plain; charset=cp1251", withCharset("text/plain; charset=cp1251", "utf-8"))
+
+	cfg := &config.HandlerConfig{ServeMode: config.ServeModeDirect}
+	s := NewSender(cfg, workDir, log)
+
+	w, err := send(s, file, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "0123456789", w.Body.String())
+	require.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+	require.Equal(t, `attachment; filename=file.pdf`, w.Header().Get("Content-Disposition"))
+
+	w, err = send(s, file, http.Header{"Range": {"bytes=2-4"}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	require.Equal(t, "234", w.Body.String())
+
+	w, err = send(s, file, http.Header{"If-Modified-Since": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotModified, w.Code)
+
+	for _, url := range []string{"/data/one/missing", "/data/../secret", "/other/one/file.pdf", "/data/one"} {
+		_, err = send(s, &entity.File{URL: url}, nil)
+		require.ErrorIs(t, err, common.ErrFileNotFoundError, url)
+	}
+
+	// 10 bytes at 20 bytes per second take half a second
+	cfg.RateLimit = 20
+	start := time.Now()
+	w, err = send(s, file, nil)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", w.Body.String())
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
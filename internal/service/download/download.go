@@ -4,6 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
 )
 
 const (
@@ -12,63 +20,146 @@ const (
 
 type DownloadRepository interface {
 	GetFilePath(ctx context.Context, id string) (string, error)
-	UserExists(ctx context.Context, id string) (bool, error)
-	IncFileCounter(ctx context.Context, id string) (int64, error)
-	GetPage(ctx context.Context, id string) (string, error)
-	GetDownloadCounters(ctx context.Context, id string) (map[string]int, error)
+	GetFileMIMEType(ctx context.Context, id string) (string, error)
+	GetCountingPolicy(ctx context.Context, fileID string) (*entity.CountingPolicy, error)
+	GetAccess(ctx context.Context, id string) (*entity.Access, error)
+	GetFileAccess(ctx context.Context, fileID string) (string, *entity.Access, error)
+	CountDownload(ctx context.Context, downloader *entity.Downloader, fileID string, policy *entity.CountingPolicy, t time.Time) (int64, bool, error)
+	GetPage(ctx context.Context, id string, page int) (string, error)
+	GetCategory(ctx context.Context, id string) (string, error)
+	GetDownloadCounters(ctx context.Context, id string, page int) (map[string]int, error)
+}
+
+type StatsRepository interface {
+	History(ctx context.Context, period string, buckets []*entity.StatBucket, fileIDs []string) (map[string][]int64, error)
+	Uniques(ctx context.Context, downloadID string, fileIDs []string) (int64, map[string]int64, error)
+	UniqueHistory(ctx context.Context, period string, buckets []*entity.StatBucket, downloadID string, fileIDs []string) (*entity.UniqueHistory, error)
+	Rollup(ctx context.Context, now time.Time) error
+	CountFiltered(ctx context.Context, fileID, reason string) error
+	Filtered(ctx context.Context, fileIDs []string) (map[string]int64, error)
+	FilteredReasons(ctx context.Context) (map[string]int64, error)
 }
 
 type downloadService struct {
-	repo DownloadRepository
-	log  *slog.Logger
+	repo     DownloadRepository
+	stats    StatsRepository
+	cfg      *config.StatsConfig
+	counting *entity.CountingPolicy
+	log      *slog.Logger
 }
 
-func NewDownloadService(repo DownloadRepository, log *slog.Logger) *downloadService {
+// NewDownloadService creates the download service. counting is the global counting policy with all fields set.
+func NewDownloadService(repo DownloadRepository, stats StatsRepository, cfg *config.StatsConfig, counting *entity.CountingPolicy, log *slog.Logger) *downloadService {
 	return &downloadService{
-		repo: repo,
-		log:  log.With(slog.String("service", serviceName)),
+		repo:     repo,
+		stats:    stats,
+		cfg:      cfg,
+		counting: counting,
+		log:      log.With(slog.String("service", serviceName)),
 	}
 }
 
-func (d *downloadService) Download(ctx context.Context, id string) (string, error) {
+// Download returns the file to send: its URL under the web server location of work_dir and its MIME type.
+func (d *downloadService) Download(ctx context.Context, id string) (*entity.File, error) {
 	filePath, err := d.repo.GetFilePath(ctx, id)
 	if err != nil {
 		d.log.Error("Cannot get file path", slog.String("file_id", id), slog.Any("error", err))
 
-		return "", fmt.Errorf("cannot get file path: %w", err)
+		return nil, fmt.Errorf("cannot get file path: %w", err)
+	}
+
+	// The file is sent without the type rather than not sent at all
+	mimeType, err := d.repo.GetFileMIMEType(ctx, id)
+	if err != nil {
+		d.log.Error("Cannot get file mime type", slog.String("file_id", id), slog.Any("error", err))
 	}
 
-	return filePath, nil
+	return &entity.File{ID: id, Name: path.Base(filePath), URL: filePath, MIMEType: mimeType}, nil
 }
 
-func (d *downloadService) IncFileCounter(ctx context.Context, userID, fileID string) (int64, error) {
+/*
+IncFileCounter counts the download of the file by the user and returns the current counter, also for a repeated download.
+Whether the download is counted is decided by the counting policy of the file distribution resolved with the global one.
+The user is counted among the distinct downloaders of the file and its distribution in any case.
+An anonymous download is always counted, it cannot be deduplicated.
+*/
+func (d *downloadService) IncFileCounter(ctx context.Context, downloader *entity.Downloader, fileID string) (int64, error) {
+	override, err := d.repo.GetCountingPolicy(ctx, fileID)
+	if err != nil {
+		// The file is counted by the global policy rather than not counted at all
+		d.log.Error("Cannot get counting policy", slog.String("file_id", fileID), slog.Any("error", err))
+	}
 
-	exists, err := d.repo.UserExists(ctx, userID)
+	policy := override.Resolve(d.counting)
+	if downloader.IsAnonymous() {
+		policy.Mode = entity.CountingModeEvery
+	}
+
+	counter, counted, err := d.repo.CountDownload(ctx, downloader, fileID, policy, time.Now())
 	if err != nil {
-		d.log.Error("Cannot check user exists", slog.String("user_id", userID), slog.String("file_id", fileID), slog.Any("error", err))
+		d.log.Error("Cannot count download", slog.String("user_id", downloader.ID()), slog.String("file_id", fileID), slog.Any("error", err))
 
-		return 0, fmt.Errorf("cannot check user exists: %w", err)
+		return 0, fmt.Errorf("cannot count download: %w", err)
 	}
 
-	if !exists {
-		counter, err := d.repo.IncFileCounter(ctx, fileID)
-		if err != nil {
-			d.log.Error("Cannot increment file counter", slog.String("user_id", userID), slog.String("file_id", fileID), slog.Any("error", err))
+	if !counted {
+		d.log.Debug("Repeated download is not counted", slog.String("user_id", downloader.ID()), slog.String("file_id", fileID), slog.String("mode", policy.Mode))
+	}
 
-			return 0, fmt.Errorf("cannot increment file counter: %w", err)
-		}
+	return counter, nil
+}
+
+// GetAccess returns the access restriction of the download, nil if it is public.
+func (d *downloadService) GetAccess(ctx context.Context, id string) (*entity.Access, error) {
+	access, err := d.repo.GetAccess(ctx, id)
+	if err != nil {
+		d.log.Error("Cannot get access", slog.String("download_id", id), slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get download %s access: %w", id, err)
+	}
+
+	return access, nil
+}
+
+// GetFileAccess returns the download of the file and its access restriction, nil if it is public.
+func (d *downloadService) GetFileAccess(ctx context.Context, fileID string) (string, *entity.Access, error) {
+	downloadID, access, err := d.repo.GetFileAccess(ctx, fileID)
+	if err != nil {
+		d.log.Error("Cannot get file access", slog.String("file_id", fileID), slog.Any("error", err))
 
-		return counter, nil
+		return "", nil, fmt.Errorf("cannot get file %s access: %w", fileID, err)
 	}
 
-	//FIXME: If the user exists, then the counter is incorrect.
-	return 0, nil
+	return downloadID, access, nil
 }
 
-func (d *downloadService) GetPage(ctx context.Context, id string) (string, error) {
-	content, err := d.repo.GetPage(ctx, id)
+// CountFiltered counts the download of the file excluded from the count by the filter for the reason.
+func (d *downloadService) CountFiltered(ctx context.Context, fileID, reason string) error {
+	if err := d.stats.CountFiltered(ctx, fileID, reason); err != nil {
+		d.log.Error("Cannot count filtered download", slog.String("file_id", fileID), slog.String("reason", reason), slog.Any("error", err))
+
+		return fmt.Errorf("cannot count filtered download: %w", err)
+	}
+
+	return nil
+}
+
+// GetFilteredReasons returns the numbers of the filtered downloads of all files by the reason.
+func (d *downloadService) GetFilteredReasons(ctx context.Context) (map[string]int64, error) {
+	reasons, err := d.stats.FilteredReasons(ctx)
+	if err != nil {
+		d.log.Error("Cannot get filtered reasons", slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get filtered reasons: %w", err)
+	}
+
+	return reasons, nil
+}
+
+func (d *downloadService) GetPage(ctx context.Context, id string, page int) (string, error) {
+	content, err := d.repo.GetPage(ctx, id, page)
 	if err != nil {
-		d.log.Error("Cannot get page content", slog.String("page_id", id), slog.Any("error", err))
+		d.log.Error("Cannot get page content", slog.String("page_id", id), slog.Int("page", page), slog.Any("error", err))
 
 		return "", fmt.Errorf("cannot get page %s content: %w", id, err)
 	}
@@ -76,8 +167,19 @@ func (d *downloadService) GetPage(ctx context.Context, id string) (string, error
 	return content, nil
 }
 
-func (d *downloadService) GetDownloadCounters(ctx context.Context, id string) (map[string]int, error) {
-	counters, err := d.repo.GetDownloadCounters(ctx, id)
+func (d *downloadService) GetCategory(ctx context.Context, id string) (string, error) {
+	content, err := d.repo.GetCategory(ctx, id)
+	if err != nil {
+		d.log.Error("Cannot get category content", slog.String("category_id", id), slog.Any("error", err))
+
+		return "", fmt.Errorf("cannot get category %s content: %w", id, err)
+	}
+
+	return content, nil
+}
+
+func (d *downloadService) GetDownloadCounters(ctx context.Context, id string, page int) (map[string]int, error) {
+	counters, err := d.repo.GetDownloadCounters(ctx, id, page)
 	if err != nil {
 		d.log.Error("Cannot get download counters", slog.String("id", id), slog.Any("error", err))
 
@@ -86,3 +188,112 @@ func (d *downloadService) GetDownloadCounters(ctx context.Context, id string) (m
 
 	return counters, nil
 }
+
+// GetDownloadStats returns the counters of the download files with the estimated numbers of distinct downloaders and the filtered downloads.
+func (d *downloadService) GetDownloadStats(ctx context.Context, id string, page int) (*entity.DownloadStats, error) {
+	counters, err := d.GetDownloadCounters(ctx, id, page)
+	if err != nil {
+		return nil, err
+	}
+
+	fileIDs := slices.Sorted(maps.Keys(counters))
+
+	uniques, fileUniques, err := d.stats.Uniques(ctx, id, fileIDs)
+	if err != nil {
+		d.log.Error("Cannot get download uniques", slog.String("id", id), slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get download %s uniques: %w", id, err)
+	}
+
+	filtered, err := d.stats.Filtered(ctx, fileIDs)
+	if err != nil {
+		d.log.Error("Cannot get filtered downloads", slog.String("id", id), slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get download %s filtered downloads: %w", id, err)
+	}
+
+	return &entity.DownloadStats{
+		Counters:    counters,
+		Uniques:     uniques,
+		FileUniques: fileUniques,
+		Filtered:    filtered,
+	}, nil
+}
+
+/*
+GetDownloadHistory returns the download series of the distribution files for the last count buckets of the period.
+It returns common.ErrPageNotFoundError if there is no such distribution.
+*/
+func (d *downloadService) GetDownloadHistory(ctx context.Context, id, period string, count int) (*entity.StatHistory, error) {
+	counters, err := d.repo.GetDownloadCounters(ctx, id, 0)
+	if err != nil {
+		d.log.Error("Cannot get download counters", slog.String("id", id), slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get download %s files: %w", id, err)
+	}
+
+	if len(counters) < 1 {
+		return nil, common.ErrPageNotFoundError
+	}
+
+	buckets := entity.StatBuckets(period, time.Now(), count, d.cfg.Location)
+	fileIDs := slices.Sorted(maps.Keys(counters))
+
+	files, err := d.stats.History(ctx, period, buckets, fileIDs)
+	if err != nil {
+		d.log.Error("Cannot get download history", slog.String("id", id), slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get download %s history: %w", id, err)
+	}
+
+	history := &entity.StatHistory{
+		ID:       id,
+		Period:   period,
+		Timezone: d.cfg.Location.String(),
+		Points:   make([]time.Time, len(buckets)),
+		Total:    make([]int64, len(buckets)),
+		Files:    files,
+	}
+
+	for i, bucket := range buckets {
+		history.Points[i] = bucket.Start
+	}
+
+	for _, series := range files {
+		for i, counter := range series {
+			history.Total[i] += counter
+		}
+	}
+
+	if slices.Contains(entity.UniquePeriods, period) {
+		uniques, err := d.stats.UniqueHistory(ctx, period, buckets, id, fileIDs)
+		if err != nil {
+			d.log.Error("Cannot get unique history", slog.String("id", id), slog.Any("error", err))
+
+			return nil, fmt.Errorf("cannot get download %s unique history: %w", id, err)
+		}
+
+		history.Uniques = uniques.Download
+		history.FileUniques = uniques.Files
+	}
+
+	return history, nil
+}
+
+// RunRollup rolls up the download history every rollup interval until ctx is done.
+func (d *downloadService) RunRollup(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.RollupInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.stats.Rollup(ctx, time.Now()); err != nil {
+			d.log.Error("Cannot roll up download history", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,46 +3,93 @@ package index
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"iter"
 	"log/slog"
 	"os"
-	"sync/atomic"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jgivc/fetchtracker/internal/common"
 	"github.com/jgivc/fetchtracker/internal/entity"
 )
 
+const (
+	lockName   = "index"
+	lockMargin = time.Minute
+)
+
 type DownloadStorage interface {
-	Scan(ctx context.Context) ([]*entity.Download, error)
+	Scan(ctx context.Context, states map[string]*entity.FolderState, progress *entity.IndexProgress) (*entity.ScanResult, error)
 }
 
 type DownloadRepository interface {
-	Save(ctx context.Context, downloads []*entity.Download) error
+	Save(ctx context.Context, downloads []*entity.Download, categories []*entity.Category, failed []string) error
 	Info(ctx context.Context) ([]*entity.ShareInfo, error)
+	FolderStates(ctx context.Context) (map[string]*entity.FolderState, error)
+	Diff(ctx context.Context, downloads []*entity.Download, failed []string) (*entity.IndexDiff, error)
+	Rollback(ctx context.Context) (string, error)
 	DownloadCounterIterator(ctx context.Context) (iter.Seq2[*entity.DownloadCounters, error], error)
 }
 
+type Locker interface {
+	Acquire(ctx context.Context, name string, ttl time.Duration) (string, error)
+	Release(ctx context.Context, name, token string) error
+}
+
+type JobRepository interface {
+	SaveJob(ctx context.Context, job *entity.IndexJob) error
+	Jobs(ctx context.Context) ([]*entity.IndexJob, error)
+	Job(ctx context.Context, id string) (*entity.IndexJob, error)
+}
+
+// indexJob is the job of the running instance. job fields are guarded by IndexerService.mu.
+type indexJob struct {
+	job      *entity.IndexJob
+	opts     entity.IndexOptions
+	progress *entity.IndexProgress
+	done     chan struct{}
+}
+
 type IndexerService struct {
-	running atomic.Bool
 	store   DownloadStorage
 	repo    DownloadRepository
-	log     *slog.Logger
+	jobs    JobRepository
+	locker  Locker
+	timeout time.Duration
+
+	mu      sync.Mutex
+	lastJob *indexJob
+
+	log *slog.Logger
 }
 
-func NewIndexService(store DownloadStorage, repo DownloadRepository, log *slog.Logger) *IndexerService {
+/*
+NewIndexService creates the service. timeout limits the duration of a single index job.
+The index, the dump and the rollback are guarded by the locker, so only one of them runs across all app instances.
+*/
+func NewIndexService(store DownloadStorage, repo DownloadRepository, jobs JobRepository, locker Locker, timeout time.Duration, log *slog.Logger) *IndexerService {
 	return &IndexerService{
-		store: store,
-		repo:  repo,
-		log:   log.With(slog.String("item", "IndexService")),
+		store:   store,
+		repo:    repo,
+		jobs:    jobs,
+		locker:  locker,
+		timeout: timeout,
+		log:     log.With(slog.String("item", "IndexService")),
 	}
 }
 
 func (i *IndexerService) DumpCounters(ctx context.Context, path string) error {
-	if !i.running.CompareAndSwap(false, true) {
-		return common.ErrIndexingProcessHasAlreadyStarted
+	unlock, err := i.lock(ctx)
+	if err != nil {
+		return err
 	}
-	defer i.running.Store(false)
+	defer unlock()
 
 	i.log.Info("Dump counters")
 
@@ -83,30 +130,298 @@ func (i *IndexerService) DumpCounters(ctx context.Context, path string) error {
 	return nil
 }
 
-func (i *IndexerService) Index(ctx context.Context) ([]*entity.ShareInfo, error) {
-	if !i.running.CompareAndSwap(false, true) {
-		return nil, common.ErrIndexingProcessHasAlreadyStarted
+// Rollback makes the previous version active again and returns the version that is active now.
+func (i *IndexerService) Rollback(ctx context.Context) (string, error) {
+	unlock, err := i.lock(ctx)
+	if err != nil {
+		return "", err
 	}
-	defer i.running.Store(false)
+	defer unlock()
 
-	i.log.Info("Start index process")
+	ver, err := i.repo.Rollback(ctx)
+	if err != nil {
+		i.log.Error("Cannot rollback", slog.Any("error", err))
+
+		return "", fmt.Errorf("cannot rollback: %w", err)
+	}
 
-	downloads, err := i.store.Scan(ctx)
+	i.log.Info("Rollback done", slog.String("active_version", ver))
+
+	return ver, nil
+}
+
+/*
+StartJob starts the index process in background and returns the new job.
+It returns common.ErrIndexingProcessHasAlreadyStarted if the index or the dump is running.
+*/
+func (i *IndexerService) StartJob(trigger string, opts entity.IndexOptions) (*entity.IndexJob, error) {
+	unlock, err := i.lock(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	j := &indexJob{
+		job: &entity.IndexJob{
+			ID:        uuid.New().String(),
+			Trigger:   trigger,
+			Status:    entity.JobStatusRunning,
+			DryRun:    opts.DryRun,
+			StartedAt: time.Now(),
+		},
+		opts:     opts,
+		progress: &entity.IndexProgress{},
+		done:     make(chan struct{}),
+	}
+
+	i.mu.Lock()
+	i.lastJob = j
+	snapshot := i.snapshot(j)
+	i.mu.Unlock()
+
+	go i.runJob(j, unlock)
+
+	return snapshot, nil
+}
+
+// WaitJob waits until the job is finished and returns it.
+func (i *IndexerService) WaitJob(ctx context.Context, id string) (*entity.IndexJob, error) {
+	i.mu.Lock()
+	j := i.lastJob
+	i.mu.Unlock()
+
+	if j == nil || j.job.ID != id {
+		return i.jobs.Job(ctx, id)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-j.done:
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.snapshot(j), nil
+}
+
+// Job returns the job with the current progress if it is running, or from the history.
+func (i *IndexerService) Job(ctx context.Context, id string) (*entity.IndexJob, error) {
+	i.mu.Lock()
+	if j := i.lastJob; j != nil && j.job.ID == id {
+		defer i.mu.Unlock()
+
+		return i.snapshot(j), nil
+	}
+	i.mu.Unlock()
+
+	job, err := i.jobs.Job(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get job: %w", err)
+	}
+
+	return job, nil
+}
+
+// Jobs returns the job history, the newest first. The running job goes first.
+func (i *IndexerService) Jobs(ctx context.Context) ([]*entity.IndexJob, error) {
+	jobs, err := i.jobs.Jobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get jobs: %w", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if j := i.lastJob; j != nil && j.job.Status == entity.JobStatusRunning {
+		jobs = append([]*entity.IndexJob{i.snapshot(j)}, jobs...)
+	}
+
+	return jobs, nil
+}
+
+/*
+lock acquires the index lock. It returns common.ErrIndexingProcessHasAlreadyStarted if the lock is held by this
+or another app instance. The lock expires after the job timeout and lockMargin, so a crashed instance does not block the index forever.
+*/
+func (i *IndexerService) lock(ctx context.Context) (func(), error) {
+	token, err := i.locker.Acquire(ctx, lockName, i.timeout+lockMargin)
+	if err != nil {
+		if errors.Is(err, common.ErrLockIsHeldError) {
+			return nil, common.ErrIndexingProcessHasAlreadyStarted
+		}
+
+		return nil, fmt.Errorf("cannot acquire index lock: %w", err)
+	}
+
+	return func() {
+		if err := i.locker.Release(context.Background(), lockName, token); err != nil {
+			i.log.Error("Cannot release index lock", slog.Any("error", err))
+		}
+	}, nil
+}
+
+// snapshot returns a copy of the job with the current progress. It must be called with mu held.
+func (i *IndexerService) snapshot(j *indexJob) *entity.IndexJob {
+	job := *j.job
+	if job.Status == entity.JobStatusRunning {
+		job.Scanned = int(j.progress.Scanned.Load())
+		job.Failed = int(j.progress.Failed.Load())
+		job.Rendered = int(j.progress.Rendered.Load())
+	}
+
+	return &job
+}
+
+func (i *IndexerService) runJob(j *indexJob, unlock func()) {
+	defer unlock()
+	defer close(j.done)
+
+	log := i.log.With(slog.String("job_id", j.job.ID), slog.String("trigger", j.job.Trigger))
+
+	ctx, cancel := context.WithTimeout(context.Background(), i.timeout)
+	defer cancel()
+
+	indexReport, err := i.index(ctx, j.opts, j.progress)
+	finishedAt := time.Now()
+
+	i.mu.Lock()
+	job := j.job
+	job.FinishedAt = &finishedAt
+	job.Duration = finishedAt.Sub(job.StartedAt).Round(time.Millisecond).String()
+	job.Scanned = int(j.progress.Scanned.Load())
+	job.Failed = int(j.progress.Failed.Load())
+	job.Rendered = int(j.progress.Rendered.Load())
+
+	if err != nil {
+		job.Status = entity.JobStatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = entity.JobStatusDone
+		job.Unchanged = indexReport.Unchanged
+		job.Shares = len(indexReport.Shares)
+		job.Errors = indexReport.Errors
+		job.Scheduled = indexReport.Scheduled
+		job.Drafts = indexReport.Drafts
+		job.Diff = indexReport.Diff
+		job.Report = indexReport
+	}
+	snapshot := i.snapshot(j)
+	i.mu.Unlock()
+
+	log.Info("Index job finished", slog.String("status", snapshot.Status), slog.String("duration", snapshot.Duration))
+
+	if err := i.jobs.SaveJob(context.Background(), snapshot); err != nil {
+		log.Error("Cannot save job", slog.Any("error", err))
+	}
+}
+
+// scheduledItems returns the downloads and files that are not published yet or have expired at now, sorted by the path.
+func scheduledItems(downloads []*entity.Download, now time.Time) []*entity.ScheduledItem {
+	var items []*entity.ScheduledItem
+
+	add := func(sourcePath string, schedule *entity.Schedule) {
+		switch schedule.Status(now) {
+		case entity.ScheduleStatusPending:
+			items = append(items, &entity.ScheduledItem{SourcePath: sourcePath, Status: entity.ScheduleStatusPending, At: schedule.PublishAt})
+		case entity.ScheduleStatusExpired:
+			items = append(items, &entity.ScheduledItem{SourcePath: sourcePath, Status: entity.ScheduleStatusExpired, At: schedule.ExpiresAt})
+		}
+	}
+
+	for _, download := range downloads {
+		if download.Access == nil {
+			continue
+		}
+
+		add(download.SourcePath, &download.Access.Schedule)
+
+		for name, schedule := range download.Access.Files {
+			add(filepath.Join(download.SourcePath, name), &schedule)
+		}
+	}
+
+	slices.SortFunc(items, func(a, b *entity.ScheduledItem) int {
+		return strings.Compare(a.SourcePath, b.SourcePath)
+	})
+
+	return items
+}
+
+/*
+index scans work_dir and saves the result as the new version. In the dry run the result is only compared
+with the active version, nothing is saved.
+*/
+func (i *IndexerService) index(ctx context.Context, opts entity.IndexOptions, progress *entity.IndexProgress) (*entity.IndexReport, error) {
+	i.log.Info("Start index process", slog.Bool("dry_run", opts.DryRun))
+
+	states, err := i.repo.FolderStates(ctx)
+	if err != nil {
+		i.log.Error("Cannot get folder states", slog.Any("error", err))
+
+		return nil, fmt.Errorf("cannot get folder states: %w", err)
+	}
+
+	result, err := i.store.Scan(ctx, states, progress)
 	if err != nil {
 		i.log.Error("Cannot scan", slog.Any("error", err))
 
 		return nil, fmt.Errorf("cannot scan download store: %w", err)
 	}
 
-	if len(downloads) < 1 {
+	if len(result.Downloads) < 1 {
 		i.log.Error("Cannot find dirs")
 
 		return nil, fmt.Errorf("cannot find dirs")
 	}
 
-	i.log.Info("Scan storage dirs", slog.Int("count", len(downloads)))
+	i.log.Info("Scan storage dirs", slog.Int("count", len(result.Downloads)), slog.Int("categories", len(result.Categories)), slog.Int("errors", len(result.Errors)))
+
+	indexReport := &entity.IndexReport{
+		Truncated: result.Truncated,
+		Errors:    result.Errors,
+	}
+
+	for _, download := range result.Downloads {
+		if download.Unchanged {
+			indexReport.Unchanged++
+		} else {
+			indexReport.Rendered++
+		}
+	}
+
+	indexReport.Scheduled = scheduledItems(result.Downloads, time.Now())
 
-	if err := i.repo.Save(ctx, downloads); err != nil {
+	for _, download := range result.Downloads {
+		if download.Access.IsDraft() {
+			indexReport.Drafts = append(indexReport.Drafts, &entity.DraftInfo{ID: download.ID, SourcePath: download.SourcePath, Preview: download.Access.Preview})
+		}
+	}
+
+	slices.SortFunc(indexReport.Drafts, func(a, b *entity.DraftInfo) int {
+		return strings.Compare(a.SourcePath, b.SourcePath)
+	})
+
+	// The files of the failed folders are missing from the scan, their counters are kept until the folders are fixed
+	failed := make([]string, 0, len(result.Errors))
+	for _, folderErr := range result.Errors {
+		failed = append(failed, folderErr.SourcePath)
+	}
+
+	if opts.DryRun {
+		diff, err := i.repo.Diff(ctx, result.Downloads, failed)
+		if err != nil {
+			i.log.Error("Cannot compute diff", slog.Any("error", err))
+
+			return nil, fmt.Errorf("cannot compute diff: %w", err)
+		}
+
+		indexReport.Diff = diff
+
+		return indexReport, nil
+	}
+
+	if err := i.repo.Save(ctx, result.Downloads, result.Categories, failed); err != nil {
 		i.log.Error("Cannot save scan content", slog.Any("error", err))
 
 		return nil, fmt.Errorf("cannot save scan content: %w", err)
@@ -119,5 +434,12 @@ func (i *IndexerService) Index(ctx context.Context) ([]*entity.ShareInfo, error)
 		return nil, fmt.Errorf("cannot get download info: %w", err)
 	}
 
-	return infos, nil
+	// The drafts are listed with their preview links only, their public links answer 404
+	indexReport.Shares = slices.DeleteFunc(infos, func(info *entity.ShareInfo) bool {
+		return slices.ContainsFunc(indexReport.Drafts, func(draft *entity.DraftInfo) bool {
+			return draft.ID == info.ID
+		})
+	})
+
+	return indexReport, nil
 }
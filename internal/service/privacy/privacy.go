@@ -0,0 +1,105 @@
+package privacy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/util"
+)
+
+const (
+	serviceName = "privacy"
+
+	saltDayLayout = "2006-01-02"
+	saltTTL       = 48 * time.Hour // The salt outlives its UTC day in every time zone
+	saltSize      = 32
+)
+
+// SaltRepository keeps the salt of the day shared by all app instances.
+type SaltRepository interface {
+	DailySalt(ctx context.Context, day, salt string, ttl time.Duration) (string, error)
+}
+
+type privacyService struct {
+	repo SaltRepository
+	cfg  *config.PrivacyConfig
+	mu   sync.Mutex
+	day  string
+	salt []byte
+	now  func() time.Time
+	log  *slog.Logger
+}
+
+func NewPrivacyService(repo SaltRepository, cfg *config.PrivacyConfig, log *slog.Logger) *privacyService {
+	return &privacyService{
+		repo: repo,
+		cfg:  cfg,
+		now:  time.Now,
+		log:  log.With(slog.String("service", serviceName)),
+	}
+}
+
+/*
+Fingerprint returns the ID of the user by the address and the User-Agent.
+With the daily salt the same user gets another ID every day, and the IDs of the past days cannot be recomputed once their salt has expired.
+*/
+func (s *privacyService) Fingerprint(ctx context.Context, ip netip.Addr, userAgent string) (string, error) {
+	fp := fmt.Sprintf("%s:%s", ip, userAgent)
+	if !s.cfg.DailySalt {
+		return util.GetIDFromString(&fp), nil
+	}
+
+	salt, err := s.dailySalt(ctx)
+	if err != nil {
+		s.log.Error("Cannot get daily salt", slog.Any("error", err))
+
+		return "", fmt.Errorf("cannot get daily salt: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(fp))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// dailySalt returns the salt of the current UTC day. It is asked from the repository once a day.
+func (s *privacyService) dailySalt(ctx context.Context) ([]byte, error) {
+	day := s.now().UTC().Format(saltDayLayout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.day == day {
+		return s.salt, nil
+	}
+
+	candidate := make([]byte, saltSize)
+	if _, err := rand.Read(candidate); err != nil {
+		return nil, fmt.Errorf("cannot generate salt: %w", err)
+	}
+
+	// Another instance may have stored its salt first, it wins
+	stored, err := s.repo.DailySalt(ctx, day, hex.EncodeToString(candidate), saltTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := hex.DecodeString(stored)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt of %s: %w", day, err)
+	}
+
+	s.day = day
+	s.salt = salt
+
+	return salt, nil
+}
@@ -0,0 +1,53 @@
+package privacy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/repository/kv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprint(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	ip := netip.MustParseAddr("192.0.2.1")
+	const ua = "Mozilla/5.0"
+
+	static := NewPrivacyService(nil, &config.PrivacyConfig{}, log)
+	fp, err := static.Fingerprint(ctx, ip, ua)
+	require.NoError(t, err)
+	require.Equal(t, "5bae81c2607e8241678bdb865db526c480d91431", fp)
+
+	// Two instances share the salt of the day
+	repo := kv.NewSaltRepository(kv.NewMemoryStore(), log)
+	cfg := &config.PrivacyConfig{DailySalt: true}
+	first := NewPrivacyService(repo, cfg, log)
+	second := NewPrivacyService(repo, cfg, log)
+
+	day := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	first.now = func() time.Time { return day }
+	second.now = func() time.Time { return day.Add(15 * time.Hour) }
+
+	fp1, err := first.Fingerprint(ctx, ip, ua)
+	require.NoError(t, err)
+	require.NotEqual(t, fp, fp1)
+
+	fp2, err := second.Fingerprint(ctx, ip, ua)
+	require.NoError(t, err)
+	require.NotEqual(t, fp1, fp2, "the next day has another salt")
+
+	second.now = func() time.Time { return day.Add(time.Hour) }
+	fp2, err = second.Fingerprint(ctx, ip, ua)
+	require.NoError(t, err)
+	require.Equal(t, fp1, fp2)
+
+	other, err := first.Fingerprint(ctx, netip.MustParseAddr("192.0.2.2"), ua)
+	require.NoError(t, err)
+	require.NotEqual(t, fp1, other)
+}
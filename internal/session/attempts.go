@@ -0,0 +1,60 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+type attempt struct {
+	start time.Time
+	count int
+}
+
+// attempts counts the login attempts by the key in fixed windows. The expired windows are swept once per window.
+type attempts struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*attempt
+	swept   time.Time
+}
+
+func newAttempts(window time.Duration) *attempts {
+	return &attempts{
+		window:  window,
+		entries: make(map[string]*attempt),
+	}
+}
+
+// allow reports whether the key has made less than limit attempts in the current window.
+func (a *attempts) allow(now time.Time, key string, limit int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.entries[key]
+
+	return !ok || now.Sub(entry.start) >= a.window || entry.count < limit
+}
+
+// add counts an attempt of the key.
+func (a *attempts) add(now time.Time, key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.swept) >= a.window {
+		for k, entry := range a.entries {
+			if now.Sub(entry.start) >= a.window {
+				delete(a.entries, k)
+			}
+		}
+
+		a.swept = now
+	}
+
+	entry, ok := a.entries[key]
+	if !ok || now.Sub(entry.start) >= a.window {
+		entry = &attempt{start: now}
+		a.entries[key] = entry
+	}
+
+	entry.count++
+}
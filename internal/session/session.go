@@ -0,0 +1,152 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+const (
+	cookiePrefix   = "access_"
+	valueSeparator = "."
+	secretSize     = 32
+	addressKey     = "a:"
+	downloadKey    = "d:"
+)
+
+/*
+sessions keeps the users of the protected distributions logged in by a signed cookie per distribution.
+The cookie is <expires>.<signature>, the signature covers the distribution access, so a changed password ends the sessions.
+*/
+type sessions struct {
+	cfg      *config.AccessConfig
+	cookie   *config.CookieConfig
+	secret   []byte
+	attempts *attempts
+	now      func() time.Time
+}
+
+func NewSessions(cfg *config.AccessConfig, cookie *config.CookieConfig) (*sessions, error) {
+	s := &sessions{
+		cfg:      cfg,
+		cookie:   cookie,
+		secret:   []byte(cfg.Secret),
+		attempts: newAttempts(cfg.LoginLimit.Window),
+		now:      time.Now,
+	}
+
+	if len(s.secret) < 1 {
+		s.secret = make([]byte, secretSize)
+		if _, err := rand.Read(s.secret); err != nil {
+			return nil, fmt.Errorf("cannot generate session secret: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Check reports whether the request has a valid session of the download.
+func (s *sessions) Check(r *http.Request, downloadID string, access *entity.Access) bool {
+	cookie, err := r.Cookie(cookiePrefix + downloadID)
+	if err != nil {
+		return false
+	}
+
+	expires, signature, ok := strings.Cut(cookie.Value, valueSeparator)
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.signature(downloadID, expires, access))) {
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+
+	return err == nil && s.now().Unix() <= expiresAt
+}
+
+/*
+GrantToken starts the session of the download if token is one of its tokens, the password is never checked here.
+The failed attempts are counted, ErrTooManyAttemptsError is returned when the address is over its limit or over its limit on the download.
+*/
+func (s *sessions) GrantToken(w http.ResponseWriter, ip netip.Addr, downloadID string, access *entity.Access, token string) (bool, error) {
+	now := s.now()
+	if !s.allowAttempt(now, ip, downloadID) {
+		return false, common.ErrTooManyAttemptsError
+	}
+
+	if !access.CheckToken(token) {
+		s.addAttempt(now, ip, downloadID)
+
+		return false, nil
+	}
+
+	s.setCookie(w, downloadID, access)
+
+	return true, nil
+}
+
+/*
+Grant starts the session of the download if secret is its password or one of its tokens.
+Every password check is counted as it runs the slow hash,
+ErrTooManyAttemptsError is returned when the address is over its limit or over its limit on the download.
+*/
+func (s *sessions) Grant(w http.ResponseWriter, ip netip.Addr, downloadID string, access *entity.Access, secret string) (bool, error) {
+	now := s.now()
+	if !s.allowAttempt(now, ip, downloadID) {
+		return false, common.ErrTooManyAttemptsError
+	}
+
+	if !access.CheckToken(secret) {
+		s.addAttempt(now, ip, downloadID)
+
+		if !access.Check(secret) {
+			return false, nil
+		}
+	}
+
+	s.setCookie(w, downloadID, access)
+
+	return true, nil
+}
+
+func (s *sessions) allowAttempt(now time.Time, ip netip.Addr, downloadID string) bool {
+	return s.attempts.allow(now, addressKey+ip.String(), s.cfg.LoginLimit.PerAddress) &&
+		s.attempts.allow(now, downloadKey+downloadID+valueSeparator+ip.String(), s.cfg.LoginLimit.PerDistribution)
+}
+
+func (s *sessions) addAttempt(now time.Time, ip netip.Addr, downloadID string) {
+	s.attempts.add(now, addressKey+ip.String())
+	s.attempts.add(now, downloadKey+downloadID+valueSeparator+ip.String())
+}
+
+func (s *sessions) setCookie(w http.ResponseWriter, downloadID string, access *entity.Access) {
+	expires := strconv.FormatInt(s.now().Add(s.cfg.SessionTTL).Unix(), 10)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookiePrefix + downloadID,
+		Path:     "/",
+		Value:    expires + valueSeparator + s.signature(downloadID, expires, access),
+		Domain:   s.cookie.Domain,
+		MaxAge:   int(s.cfg.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   s.cookie.IsSecure(),
+		// Lax keeps the session on the links to the page from the other sites
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *sessions) signature(downloadID, expires string, access *entity.Access) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(downloadID + valueSeparator + expires + "\n" + access.Password + "\n" + access.Preview + "\n" + strings.Join(access.Tokens, "\n")))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
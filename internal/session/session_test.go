@@ -0,0 +1,151 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/stretchr/testify/require"
+)
+
+const downloadID = "0123456789abcdef0123456789abcdef01234567"
+
+func TestSessions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ip := netip.MustParseAddr("192.0.2.1")
+	limit := config.LoginLimitConfig{PerAddress: 100, PerDistribution: 100, Window: time.Minute}
+
+	hash, err := entity.HashPassword("password")
+	require.NoError(t, err)
+	access := &entity.Access{Password: hash, Tokens: []string{"token"}}
+
+	s, err := NewSessions(&config.AccessConfig{Secret: "secret", SessionTTL: time.Hour, LoginLimit: limit}, &config.CookieConfig{})
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+
+	login := func(secret string) (*http.Cookie, bool) {
+		w := httptest.NewRecorder()
+		ok, err := s.Grant(w, ip, downloadID, access, secret)
+		require.NoError(t, err)
+		cookies := w.Result().Cookies()
+		if len(cookies) < 1 {
+			return nil, ok
+		}
+
+		return cookies[0], ok
+	}
+
+	check := func(cookie *http.Cookie, id string, access *entity.Access) bool {
+		r := httptest.NewRequest(http.MethodGet, "/share/"+id+"/", nil)
+		r.AddCookie(cookie)
+
+		return s.Check(r, id, access)
+	}
+
+	for _, secret := range []string{"", "wrong", "Password"} {
+		cookie, ok := login(secret)
+		require.False(t, ok, secret)
+		require.Nil(t, cookie, secret)
+	}
+
+	_, ok := login("token")
+	require.True(t, ok)
+
+	cookie, ok := login("password")
+	require.True(t, ok)
+	require.Equal(t, "access_"+downloadID, cookie.Name)
+	require.True(t, cookie.Secure)
+	require.True(t, cookie.HttpOnly)
+	require.True(t, check(cookie, downloadID, access))
+
+	require.False(t, check(cookie, "f"+downloadID[1:], access), "the session is of one download")
+	require.False(t, check(cookie, downloadID, &entity.Access{Tokens: []string{"other"}}), "the changed access ends the session")
+
+	tampered := *cookie
+	tampered.Value = "1800000000" + cookie.Value[len("1700003600"):]
+	require.False(t, check(&tampered, downloadID, access))
+
+	other, err := NewSessions(&config.AccessConfig{SessionTTL: time.Hour, LoginLimit: limit}, &config.CookieConfig{})
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	require.False(t, other.Check(r, downloadID, access), "another instance without the secret")
+
+	// The draft is opened only by the preview token
+	draft := &entity.Access{Password: hash, Preview: "preview"}
+	ok, _ = s.Grant(httptest.NewRecorder(), ip, downloadID, draft, "password")
+	require.False(t, ok)
+	ok, _ = s.GrantToken(httptest.NewRecorder(), ip, downloadID, draft, "preview")
+	require.True(t, ok)
+	require.False(t, check(cookie, downloadID, draft))
+
+	s.now = func() time.Time { return now.Add(2 * time.Hour) }
+	require.False(t, check(cookie, downloadID, access), "the session has expired")
+}
+
+func TestGrantLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	hash, err := entity.HashPassword("password")
+	require.NoError(t, err)
+	access := &entity.Access{Password: hash, Tokens: []string{"token"}}
+
+	s, err := NewSessions(&config.AccessConfig{
+		SessionTTL: time.Hour,
+		LoginLimit: config.LoginLimitConfig{PerAddress: 3, PerDistribution: 2, Window: time.Minute},
+	}, &config.CookieConfig{})
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+
+	// The query token never checks the password
+	ok, err := s.GrantToken(httptest.NewRecorder(), ip, downloadID, access, "password")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = s.GrantToken(httptest.NewRecorder(), ip, downloadID, access, "token")
+	require.NoError(t, err)
+	require.True(t, ok, "the right token is not counted")
+
+	ok, err = s.Grant(httptest.NewRecorder(), ip, downloadID, access, "wrong")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = s.Grant(httptest.NewRecorder(), ip, downloadID, access, "password")
+	require.ErrorIs(t, err, common.ErrTooManyAttemptsError, "the address is over its limit on the download")
+
+	other := netip.MustParseAddr("192.0.2.2")
+	ok, err = s.Grant(httptest.NewRecorder(), other, downloadID, access, "password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The other addresses are not locked out by the one over its limit
+	ok, err = s.GrantToken(httptest.NewRecorder(), netip.MustParseAddr("192.0.2.3"), downloadID, access, "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The limit of the address on one download
+	other = netip.MustParseAddr("192.0.2.4")
+	for range 2 {
+		ok, err = s.Grant(httptest.NewRecorder(), other, downloadID, access, "wrong")
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+
+	_, err = s.Grant(httptest.NewRecorder(), other, downloadID, access, "password")
+	require.ErrorIs(t, err, common.ErrTooManyAttemptsError, "the second address is over its limit on the download")
+
+	ok, err = s.Grant(httptest.NewRecorder(), other, "1123456789abcdef0123456789abcdef01234567", access, "password")
+	require.NoError(t, err)
+	require.True(t, ok, "the other download")
+
+	s.now = func() time.Time { return now.Add(time.Minute) }
+	ok, err = s.Grant(httptest.NewRecorder(), ip, downloadID, access, "password")
+	require.NoError(t, err)
+	require.True(t, ok, "the next window")
+}
@@ -0,0 +1,60 @@
+package statuspage
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+)
+
+// pages answer the requests of the distributions and files outside their publish window.
+type pages struct {
+	expiredStatus int
+	content       map[int][]byte // The HTML by the status, a plain text is sent if it is missing
+}
+
+func NewPages(cfg *config.UnpublishedConfig) (*pages, error) {
+	p := &pages{
+		expiredStatus: cfg.ExpiredStatus,
+		content:       make(map[int][]byte),
+	}
+
+	for status, path := range map[int]string{
+		http.StatusNotFound: cfg.NotFoundPage,
+		http.StatusGone:     cfg.GonePage,
+	} {
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %d page: %w", status, err)
+		}
+
+		p.content[status] = data
+	}
+
+	return p, nil
+}
+
+// Write responds to the request of the pending or expired distribution or file.
+func (p *pages) Write(w http.ResponseWriter, scheduleStatus string) {
+	status := http.StatusNotFound
+	if scheduleStatus == entity.ScheduleStatusExpired {
+		status = p.expiredStatus
+	}
+
+	content, exists := p.content[status]
+	if !exists {
+		http.Error(w, http.StatusText(status), status)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(content)
+}
@@ -0,0 +1,45 @@
+package statuspage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPages(t *testing.T) {
+	gone := filepath.Join(t.TempDir(), "gone.html")
+	require.NoError(t, os.WriteFile(gone, []byte("<h1>Gone</h1>"), 0o644))
+
+	_, err := NewPages(&config.UnpublishedConfig{ExpiredStatus: http.StatusGone, NotFoundPage: gone + ".missing"})
+	require.Error(t, err)
+
+	write := func(p *pages, status string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.Write(w, status)
+
+		return w
+	}
+
+	p, err := NewPages(&config.UnpublishedConfig{ExpiredStatus: http.StatusGone, GonePage: gone})
+	require.NoError(t, err)
+
+	w := write(p, entity.ScheduleStatusPending)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	w = write(p, entity.ScheduleStatusExpired)
+	require.Equal(t, http.StatusGone, w.Code)
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, "<h1>Gone</h1>", w.Body.String())
+
+	// The expired distributions look like they have never existed
+	p, err = NewPages(&config.UnpublishedConfig{ExpiredStatus: http.StatusNotFound, GonePage: gone})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, write(p, entity.ScheduleStatusExpired).Code)
+}
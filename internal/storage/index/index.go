@@ -2,21 +2,49 @@ package index
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/jgivc/fetchtracker/internal/common"
 	"github.com/jgivc/fetchtracker/internal/config"
 	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/jgivc/fetchtracker/internal/util"
 )
 
-const (
-	maxDirs = 100
-)
+const previewTokenSize = 16
 
 type FSAdapter interface {
 	ToDownload(folderPath string) (*entity.Download, error)
+	ToCategory(folderPath string, items []*entity.CategoryItem) (*entity.Category, error)
+	Fingerprint(folderPath string) (string, error)
+}
+
+// folderResult is the result of a single folder processed by a worker.
+type folderResult struct {
+	path     string
+	download *entity.Download
+	err      error
+}
+
+// folder is a node of the work_dir tree.
+type folder struct {
+	path     string
+	hasFiles bool
+	children []*folder
+}
+
+// isDownload reports whether the folder should be turned into a download.
+// Folders that contain only subfolders are categories.
+func (f *folder) isDownload() bool {
+	return f.hasFiles || len(f.children) == 0
 }
 
 type indexStorage struct {
@@ -33,29 +61,31 @@ func NewIndexStorage(adapter FSAdapter, cfg *config.IndexerConfig, log *slog.Log
 	}
 }
 
-func (i *indexStorage) Scan(ctx context.Context) ([]*entity.Download, error) {
-	entries, err := os.ReadDir(i.cfg.WorkDir)
-	if err != nil {
-		return nil, err
+/*
+Scan scans work_dir. states are the folder states of the previous index, keyed by download ID.
+If the incremental index is enabled, folders with the same fingerprint are not rendered,
+they are returned as unchanged downloads with ID, SourcePath, Title and TotalFiles only.
+Folders that cannot be processed are reported in ScanResult.Errors. progress may be nil.
+*/
+func (i *indexStorage) Scan(ctx context.Context, states map[string]*entity.FolderState, progress *entity.IndexProgress) (*entity.ScanResult, error) {
+	if progress == nil {
+		progress = &entity.IndexProgress{}
 	}
 
-	var dirs []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			dirs = append(dirs, filepath.Join(i.cfg.WorkDir, entry.Name()))
-		}
+	root := &folder{path: i.cfg.WorkDir}
+	result := &entity.ScanResult{}
 
-		if len(dirs) >= maxDirs {
-			break
-		}
+	var dirs []string
+	if err := i.walk(root, 0, &dirs, result); err != nil {
+		return nil, err
 	}
 
 	if len(dirs) == 0 {
-		return []*entity.Download{}, nil
+		return result, nil
 	}
 
 	in := make(chan string, len(dirs))
-	out := make(chan *entity.Download, len(dirs))
+	out := make(chan *folderResult, len(dirs))
 
 	for _, dir := range dirs {
 		in <- dir
@@ -65,7 +95,7 @@ func (i *indexStorage) Scan(ctx context.Context) ([]*entity.Download, error) {
 	var wg sync.WaitGroup
 	wg.Add(i.cfg.Workers)
 	for n := 0; n < i.cfg.Workers; n++ {
-		go i.worker(ctx, n, in, out, &wg)
+		go i.worker(ctx, n, states, progress, in, out, &wg)
 	}
 
 	go func() {
@@ -73,37 +103,320 @@ func (i *indexStorage) Scan(ctx context.Context) ([]*entity.Download, error) {
 		close(out)
 	}()
 
-	var downloads []*entity.Download
-	for download := range out {
+	downloads := make(map[string]*entity.Download)
+	for res := range out {
+		if res.err != nil {
+			result.Errors = append(result.Errors, newFolderError(res.path, res.err))
+
+			continue
+		}
+
+		download := res.download
 		i.log.Info("Found folder", slog.String("id", download.ID), slog.String("path", download.SourcePath))
-		downloads = append(downloads, download)
+		// The drafts are not listed in the categories
+		if !download.Access.IsDraft() {
+			downloads[download.SourcePath] = download
+		}
+		result.Downloads = append(result.Downloads, download)
+
+		if maxFiles := i.cfg.FolderLimits(download.SourcePath).MaxFiles; download.TotalFiles > maxFiles {
+			i.log.Warn("Folder files truncated", slog.String("path", download.SourcePath), slog.Int("limit", maxFiles), slog.Int("total", download.TotalFiles))
+			result.Truncated = append(result.Truncated, &entity.Truncation{
+				SourcePath: download.SourcePath,
+				Kind:       entity.TruncatedFiles,
+				Limit:      maxFiles,
+				Total:      download.TotalFiles,
+			})
+		}
 	}
 
-	return downloads, nil
+	now := time.Now()
+	for _, child := range root.children {
+		i.buildCategory(child, downloads, now, result)
+	}
+
+	return result, nil
 }
 
-func (i *indexStorage) worker(ctx context.Context, n int, in chan string, out chan *entity.Download, wg *sync.WaitGroup) {
+/*
+walk reads the folder entries and descends into subfolders until cfg.MaxDepth is reached.
+Folders that should become downloads are collected into dirs.
+Folders with more subfolders than the max_dirs limit are reported in result.Truncated.
+*/
+func (i *indexStorage) walk(node *folder, depth int, dirs *[]string, result *entity.ScanResult) error {
+	entries, err := os.ReadDir(node.path)
+	if err != nil {
+		return err
+	}
+
+	maxDirs := i.cfg.FolderLimits(node.path).MaxDirs
+
+	var dirCount int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			node.hasFiles = true
+
+			continue
+		}
+
+		if depth >= i.cfg.MaxDepth {
+			continue
+		}
+
+		dirCount++
+		if dirCount > maxDirs {
+			continue
+		}
+
+		child := &folder{path: filepath.Join(node.path, entry.Name())}
+		if err := i.walk(child, depth+1, dirs, result); err != nil {
+			i.log.Error("Cannot read folder", slog.String("folder_path", child.path), slog.Any("error", err))
+			result.Errors = append(result.Errors, newFolderError(child.path, err))
+
+			continue
+		}
+
+		node.children = append(node.children, child)
+	}
+
+	if dirCount > maxDirs {
+		i.log.Warn("Folder subfolders truncated", slog.String("path", node.path), slog.Int("limit", maxDirs), slog.Int("total", dirCount))
+		result.Truncated = append(result.Truncated, &entity.Truncation{
+			SourcePath: node.path,
+			Kind:       entity.TruncatedDirs,
+			Limit:      maxDirs,
+			Total:      dirCount,
+		})
+	}
+
+	if depth > 0 && node.isDownload() {
+		*dirs = append(*dirs, node.path)
+	}
+
+	return nil
+}
+
+/*
+buildCategory creates categories for the folder and its subfolders bottom-up.
+It returns nil if the folder is not a category or has no visible items.
+The items with publish windows are listed only in their windows: the category gets a listing page for every time
+the listed items change, the page of the request time is served.
+*/
+func (i *indexStorage) buildCategory(node *folder, downloads map[string]*entity.Download, now time.Time, result *entity.ScanResult) *entity.Category {
+	if len(node.children) == 0 {
+		return nil
+	}
+
+	var items []*entity.CategoryItem
+	// A folder with both files and subfolders is listed once, as a category, and its own download goes first.
+	if download, exists := downloads[node.path]; exists {
+		items = append(items, downloadItem(download))
+	}
+
+	for _, child := range node.children {
+		if category := i.buildCategory(child, downloads, now, result); category != nil {
+			items = append(items, &entity.CategoryItem{ID: category.ID, Title: category.Title, Kind: entity.ShareKindCategory, Windows: category.Windows})
+
+			continue
+		}
+
+		if download, exists := downloads[child.path]; exists {
+			items = append(items, downloadItem(download))
+		}
+	}
+
+	items = slices.DeleteFunc(items, func(item *entity.CategoryItem) bool {
+		return item.IsGone(now)
+	})
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	category, err := i.adapter.ToCategory(node.path, items)
+	if err != nil {
+		i.log.Error("Cannot build category", slog.String("folder_path", node.path), slog.Any("error", err))
+
+		return nil
+	}
+
+	if err := i.scheduleCategory(category, items, now); err != nil {
+		i.log.Error("Cannot build category", slog.String("folder_path", node.path), slog.Any("error", err))
+
+		return nil
+	}
+
+	i.log.Info("Found category", slog.String("id", category.ID), slog.String("path", category.SourcePath))
+	result.Categories = append(result.Categories, category)
+
+	return category
+}
+
+// scheduleCategory renders the listing pages of the category at now and at every time the listed items change.
+func (i *indexStorage) scheduleCategory(category *entity.Category, items []*entity.CategoryItem, now time.Time) error {
+	changes := entity.ListingChanges(items, now)
+	if len(changes) < 1 && !slices.ContainsFunc(items, func(item *entity.CategoryItem) bool { return !item.IsListed(now) }) {
+		return nil
+	}
+
+	render := func(at time.Time) (string, error) {
+		listed := slices.DeleteFunc(slices.Clone(items), func(item *entity.CategoryItem) bool {
+			return !item.IsListed(at)
+		})
+		if len(listed) < 1 {
+			return "", nil
+		}
+
+		page, err := i.adapter.ToCategory(category.SourcePath, listed)
+		if err != nil {
+			return "", err
+		}
+
+		return page.PageContent, nil
+	}
+
+	content, err := render(now)
+	if err != nil {
+		return err
+	}
+	category.PageContent = content
+	category.PageHash = util.GetIDFromString(&content)
+
+	for _, at := range changes {
+		content, err := render(at)
+		if err != nil {
+			return err
+		}
+
+		category.Pages = append(category.Pages, &entity.CategoryPage{From: at, Content: content})
+	}
+
+	// The category is listed while any of its items is
+	for _, item := range items {
+		if item.Windows == nil {
+			category.Windows = nil
+
+			break
+		}
+
+		category.Windows = append(category.Windows, item.Windows...)
+	}
+
+	return nil
+}
+
+// downloadItem returns the category item of the download, listed in its publish window.
+func downloadItem(download *entity.Download) *entity.CategoryItem {
+	item := &entity.CategoryItem{ID: download.ID, Title: download.Title, Kind: entity.ShareKindDownload}
+	if download.Access != nil && !download.Access.Schedule.IsEmpty() {
+		item.Windows = []entity.Schedule{download.Access.Schedule}
+	}
+
+	return item
+}
+
+func (i *indexStorage) worker(ctx context.Context, n int, states map[string]*entity.FolderState, progress *entity.IndexProgress, in chan string, out chan *folderResult, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	log := i.log.With(slog.Int("worker_id", n))
 	log.Info("Started")
 
 	for folderPath := range in {
-		download, err := i.adapter.ToDownload(folderPath)
+		download, err := i.toDownload(folderPath, states)
 		if err != nil {
 			log.Error("Cannot scan folder", slog.String("folder_path", folderPath), slog.Any("error", err))
-
-			continue
+			progress.Failed.Add(1)
+		} else if !download.Unchanged {
+			progress.Rendered.Add(1)
 		}
+		progress.Scanned.Add(1)
 
 		select {
 		case <-ctx.Done():
 			log.Info("Interrupted")
 
 			return
-		case out <- download:
+		case out <- &folderResult{path: folderPath, download: download, err: err}:
 		}
 	}
 
 	log.Info("Done")
 }
+
+func (i *indexStorage) toDownload(folderPath string, states map[string]*entity.FolderState) (*entity.Download, error) {
+	fingerprint, err := i.adapter.Fingerprint(folderPath)
+	if err != nil {
+		i.log.Error("Cannot get folder fingerprint", slog.String("folder_path", folderPath), slog.Any("error", err))
+	}
+
+	id := util.GetIDFromString(&folderPath)
+	// The page is rendered again when a file window opens or closes, the files outside their windows are not listed
+	if state, exists := states[id]; i.cfg.Incremental && exists && fingerprint != "" && state.Fingerprint == fingerprint &&
+		slices.Equal(state.Hidden, state.Access.HiddenFiles(time.Now())) {
+		i.log.Debug("Folder is unchanged", slog.String("folder_path", folderPath))
+
+		return &entity.Download{
+			ID:          id,
+			Title:       state.Title,
+			SourcePath:  folderPath,
+			TotalFiles:  state.TotalFiles,
+			Fingerprint: fingerprint,
+			Unchanged:   true,
+			Counting:    state.Counting,
+			Access:      state.Access,
+			Hidden:      state.Hidden,
+		}, nil
+	}
+
+	download, err := i.adapter.ToDownload(folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	download.Fingerprint = fingerprint
+
+	if !download.Enabled {
+		if err := setPreview(download, states[id]); err != nil {
+			return nil, err
+		}
+	}
+
+	return download, nil
+}
+
+// setPreview makes the disabled download a draft. The preview token is kept from the previous index, so the links of the authors keep working.
+func setPreview(download *entity.Download, state *entity.FolderState) error {
+	if download.Access == nil {
+		download.Access = &entity.Access{}
+	}
+
+	if state != nil && state.Access.IsDraft() {
+		download.Access.Preview = state.Access.Preview
+
+		return nil
+	}
+
+	token := make([]byte, previewTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return fmt.Errorf("cannot generate preview token: %w", err)
+	}
+
+	download.Access.Preview = base64.RawURLEncoding.EncodeToString(token)
+
+	return nil
+}
+
+// newFolderError returns the error of the skipped folder with the reason found in the error chain.
+func newFolderError(folderPath string, err error) *entity.FolderError {
+	reason := entity.SkipReasonError
+	switch {
+	case errors.Is(err, common.ErrFolderHasNoFilesError):
+		reason = entity.SkipReasonNoFiles
+	case errors.Is(err, common.ErrBrokenFileReferenceError):
+		reason = entity.SkipReasonBrokenFileRef
+	case errors.Is(err, common.ErrTemplateError):
+		reason = entity.SkipReasonTemplateError
+	}
+
+	return &entity.FolderError{SourcePath: folderPath, Reason: reason, Error: err.Error()}
+}
@@ -0,0 +1,237 @@
+package index
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jgivc/fetchtracker/internal/common"
+	"github.com/jgivc/fetchtracker/internal/config"
+	"github.com/jgivc/fetchtracker/internal/entity"
+	"github.com/jgivc/fetchtracker/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+// The folders with the pending and expired files are scheduled around the test start
+var (
+	testPublishAt = time.Now().Add(time.Hour)
+	testExpiresAt = time.Now().Add(-time.Hour)
+)
+
+type testAdapter struct{}
+
+func (a *testAdapter) ToDownload(folderPath string) (*entity.Download, error) {
+	entries, err := os.ReadDir(folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	download := &entity.Download{ID: util.GetIDFromString(&folderPath), Title: filepath.Base(folderPath), SourcePath: folderPath, Enabled: true}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			download.Files = append(download.Files, &entity.File{Name: entry.Name()})
+			// The draft file stands for enabled: false in the frontmatter
+			download.Enabled = download.Enabled && entry.Name() != "draft"
+
+			switch entry.Name() {
+			case "pending":
+				download.Access = &entity.Access{Schedule: entity.Schedule{PublishAt: testPublishAt}}
+			case "expired":
+				download.Access = &entity.Access{Schedule: entity.Schedule{ExpiresAt: testExpiresAt}}
+			}
+		}
+	}
+
+	if len(download.Files) < 1 {
+		return nil, common.ErrFolderHasNoFilesError
+	}
+
+	return download, nil
+}
+
+func (a *testAdapter) Fingerprint(folderPath string) (string, error) {
+	return folderPath, nil
+}
+
+func (a *testAdapter) ToCategory(folderPath string, items []*entity.CategoryItem) (*entity.Category, error) {
+	titles := make([]string, 0, len(items))
+	for _, item := range items {
+		titles = append(titles, item.Title)
+	}
+
+	return &entity.Category{ID: util.GetIDFromString(&folderPath), Title: filepath.Base(folderPath), SourcePath: folderPath, Items: items, PageContent: strings.Join(titles, ",")}, nil
+}
+
+func TestScan(t *testing.T) {
+	files := []string{
+		"one/file1.img",
+		"products/alpha/1.0/file1.img",
+		"products/alpha/2.0/file1.img",
+		"products/beta/file1.img",
+		"products/beta/docs/readme.txt",
+		"products/gamma/1.0/2025/file1.img",
+	}
+
+	testCases := []struct {
+		name               string
+		maxDepth           int
+		expectedDownloads  []string
+		expectedCategories map[string][]string
+		expectedErrors     []string
+	}{
+		{
+			name:              "Only direct subfolders",
+			maxDepth:          1,
+			expectedDownloads: []string{"one"},
+			expectedErrors:    []string{"empty", "products"},
+		},
+		{
+			name:               "Two levels",
+			maxDepth:           2,
+			expectedDownloads:  []string{"one", "products/beta"},
+			expectedCategories: map[string][]string{"products": {"beta"}},
+			expectedErrors:     []string{"empty", "products/alpha", "products/gamma"},
+		},
+		{
+			name:              "Three levels",
+			maxDepth:          3,
+			expectedDownloads: []string{"one", "products/alpha/1.0", "products/alpha/2.0", "products/beta", "products/beta/docs"},
+			expectedCategories: map[string][]string{
+				"products":       {"alpha", "beta"},
+				"products/alpha": {"1.0", "2.0"},
+				"products/beta":  {"beta", "docs"},
+			},
+			expectedErrors: []string{"empty", "products/gamma/1.0"},
+		},
+	}
+
+	workDir := t.TempDir()
+	for _, file := range files {
+		path := filepath.Join(workDir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(file), 0644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(workDir, "empty"), 0755))
+
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.IndexerConfig{WorkDir: workDir, Workers: 2, MaxDepth: tc.maxDepth, Limits: config.FolderConfig{MaxDirs: 100}}
+			store := NewIndexStorage(&testAdapter{}, cfg, log)
+
+			result, err := store.Scan(context.Background(), nil, nil)
+			require.NoError(t, err)
+
+			var downloads []string
+			for _, download := range result.Downloads {
+				rel, err := filepath.Rel(workDir, download.SourcePath)
+				require.NoError(t, err)
+				downloads = append(downloads, rel)
+			}
+			sort.Strings(downloads)
+			require.Equal(t, tc.expectedDownloads, downloads)
+
+			var errs []string
+			for _, e := range result.Errors {
+				rel, err := filepath.Rel(workDir, e.SourcePath)
+				require.NoError(t, err)
+				errs = append(errs, rel)
+				require.Equal(t, entity.SkipReasonNoFiles, e.Reason)
+			}
+			sort.Strings(errs)
+			require.Equal(t, tc.expectedErrors, errs)
+
+			categories := make(map[string][]string)
+			for _, category := range result.Categories {
+				rel, err := filepath.Rel(workDir, category.SourcePath)
+				require.NoError(t, err)
+
+				var items []string
+				for _, item := range category.Items {
+					items = append(items, item.Title)
+				}
+				sort.Strings(items)
+				categories[rel] = items
+			}
+
+			if tc.expectedCategories == nil {
+				require.Empty(t, categories)
+			} else {
+				require.Equal(t, tc.expectedCategories, categories)
+			}
+		})
+	}
+}
+
+func TestScanDrafts(t *testing.T) {
+	workDir := t.TempDir()
+	for _, file := range []string{"products/alpha/file1.img", "products/beta/file1.img", "products/beta/draft"} {
+		path := filepath.Join(workDir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(file), 0644))
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	cfg := &config.IndexerConfig{WorkDir: workDir, Workers: 2, MaxDepth: 2, Limits: config.FolderConfig{MaxDirs: 100}}
+	store := NewIndexStorage(&testAdapter{}, cfg, log)
+
+	scan := func(states map[string]*entity.FolderState) (*entity.Download, *entity.ScanResult) {
+		result, err := store.Scan(context.Background(), states, nil)
+		require.NoError(t, err)
+		require.Len(t, result.Downloads, 2)
+
+		var draft *entity.Download
+		for _, download := range result.Downloads {
+			if download.Title == "beta" {
+				draft = download
+			} else {
+				require.False(t, download.Access.IsDraft())
+			}
+		}
+
+		return draft, result
+	}
+
+	draft, result := scan(nil)
+	require.True(t, draft.Access.IsDraft())
+	require.Len(t, result.Categories, 1)
+	require.Len(t, result.Categories[0].Items, 1, "the draft is not listed")
+	require.Equal(t, "alpha", result.Categories[0].Items[0].Title)
+
+	// The preview link stays the same after the next index
+	again, _ := scan(map[string]*entity.FolderState{draft.ID: {Fingerprint: "changed", Access: draft.Access}})
+	require.Equal(t, draft.Access.Preview, again.Access.Preview)
+}
+
+func TestScanSchedule(t *testing.T) {
+	workDir := t.TempDir()
+	for _, file := range []string{"products/alpha/file1.img", "products/beta/file1.img", "products/beta/pending", "products/gamma/file1.img", "products/gamma/expired"} {
+		path := filepath.Join(workDir, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(file), 0644))
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{}))
+	cfg := &config.IndexerConfig{WorkDir: workDir, Workers: 2, MaxDepth: 2, Limits: config.FolderConfig{MaxDirs: 100}}
+	store := NewIndexStorage(&testAdapter{}, cfg, log)
+
+	result, err := store.Scan(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Len(t, result.Downloads, 3)
+	require.Len(t, result.Categories, 1)
+
+	category := result.Categories[0]
+	require.Len(t, category.Items, 2, "the expired download is never listed again")
+	require.Equal(t, "alpha", category.PageContent, "the pending download is not listed yet")
+	require.Len(t, category.Pages, 1)
+	require.True(t, testPublishAt.Equal(category.Pages[0].From))
+	require.Equal(t, "alpha,beta", entity.CategoryContentAt(category.PageContent, category.Pages, testPublishAt))
+	require.Nil(t, category.Windows, "alpha is always listed, so is the category")
+}
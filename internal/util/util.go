@@ -3,6 +3,8 @@ package util
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"path/filepath"
+	"strings"
 )
 
 func GetIDFromString(str *string) string {
@@ -11,3 +13,14 @@ func GetIDFromString(str *string) string {
 
 	return hex.EncodeToString(hasher.Sum(nil))
 }
+
+// IsInFolders reports whether path is one of the folders or is inside one of them.
+func IsInFolders(path string, folders []string) bool {
+	for _, folder := range folders {
+		if path == folder || strings.HasPrefix(path, strings.TrimSuffix(folder, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}